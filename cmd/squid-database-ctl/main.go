@@ -0,0 +1,19 @@
+//
+// main.go
+// Copyright (C) 2024 rmelo <Ricardo Melo <rmelo@ludia.com>>
+//
+// Distributed under terms of the MIT license.
+//
+
+// Command squid-database-ctl manages user records. It runs 'squid-vault-auth ctl'.
+package main
+
+import (
+	"os"
+
+	"github.com/cropalato/squid-vault-auth/internal/cli"
+)
+
+func main() {
+	os.Exit(cli.Run("ctl", os.Args[1:]))
+}
@@ -0,0 +1,19 @@
+//
+// main.go
+// Copyright (C) 2024 rmelo <Ricardo Melo <rmelo@ludia.com>>
+//
+// Distributed under terms of the MIT license.
+//
+
+// Command squid-database-digest is kept for compatibility. It runs 'squid-vault-auth digest-helper'.
+package main
+
+import (
+	"os"
+
+	"github.com/cropalato/squid-vault-auth/internal/cli"
+)
+
+func main() {
+	os.Exit(cli.Run("digest-helper", os.Args[1:]))
+}
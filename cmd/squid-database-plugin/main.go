@@ -5,27 +5,15 @@
 // Distributed under terms of the MIT license.
 //
 
+// Command squid-database-plugin is kept for compatibility. It runs 'squid-vault-auth vault-plugin'.
 package main
 
 import (
-	"log"
 	"os"
 
-	"github.com/cropalato/squid-vault-auth/internal/squid"
-	dbplugin "github.com/hashicorp/vault/sdk/database/dbplugin/v5"
+	"github.com/cropalato/squid-vault-auth/internal/cli"
 )
 
 func main() {
-	err := Run()
-	if err != nil {
-		log.Println(err)
-		os.Exit(1)
-	}
-}
-
-// Run instantiates a squid object, and runs the RPC server for the plugin
-func Run() error {
-	dbplugin.ServeMultiplex(squid.New)
-
-	return nil
+	os.Exit(cli.Run("vault-plugin", os.Args[1:]))
 }
@@ -0,0 +1,26 @@
+//
+// main.go
+// Copyright (C) 2024 rmelo <Ricardo Melo <rmelo@ludia.com>>
+//
+// Distributed under terms of the MIT license.
+//
+
+// Command squid-vault-auth runs squid db service, the squid helpers and the
+// Vault plugin from a single binary:
+//
+//	squid-vault-auth server
+//	squid-vault-auth auth-helper
+//
+// It can also be called through a symlink named after the historical binaries,
+// e.g. squid-database-auth.
+package main
+
+import (
+	"os"
+
+	"github.com/cropalato/squid-vault-auth/internal/cli"
+)
+
+func main() {
+	os.Exit(cli.Main(os.Args))
+}
@@ -0,0 +1,120 @@
+//
+// acl.go
+// Copyright (C) 2024 rmelo <Ricardo Melo <rmelo@ludia.com>>
+//
+// Distributed under terms of the MIT license.
+//
+
+package cli
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"time"
+
+	"github.com/cropalato/squid-vault-auth/internal/db"
+	"github.com/cropalato/squid-vault-auth/internal/helper"
+	"github.com/cropalato/squid-vault-auth/internal/varenv"
+)
+
+// aclHelper is the squid external acl helper checking group membership.
+type aclHelper struct {
+	*source
+}
+
+// ACLHelper runs the squid external acl helper on stdin/stdout.
+func ACLHelper(args []string) error {
+	fs := newFlagSet("acl-helper")
+	sourceCfg := registerSourceFlags(fs)
+	concurrency := fs.Int("concurrency", varenv.LookupEnvOrInt("SQUIDDB_CONCURRENCY", 0), "number of requests processed in parallel. It must match the 'concurrency' option of squid external_acl_type")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	s, err := sourceCfg.open(nil)
+	if err != nil {
+		return err
+	}
+	defer s.close()
+	a := &aclHelper{source: s}
+	return helper.Serve(os.Stdin, os.Stdout, *concurrency, helper.Instrument("acl", a.checkGroup))
+}
+
+// checkGroup checks the user of a squid request is member of one of the groups: '<username> <group> [<group> ...]'.
+func (a *aclHelper) checkGroup(fields []string) helper.Reply {
+	var user db.UserRecord
+
+	if len(fields) < 2 {
+		return helper.ERR("invalid request")
+	}
+	if a.local != nil {
+		return a.checkGroupLocal(fields[0], fields[1:])
+	}
+	status, err := a.squiddb.Do(context.Background(), http.MethodGet, "/api/v1/users/"+url.PathEscape(fields[0]), nil, &user)
+	if err != nil {
+		log.Printf("failed fetching user %s: %s", fields[0], err)
+		return a.checkGroupOffline(fields[0], fields[1:])
+	}
+	a.online()
+	switch status {
+	case http.StatusOK:
+	case http.StatusNotFound:
+		// unknown and expired users are reported as not found.
+		return helper.ERR(db.ReasonUnknownUser)
+	default:
+		log.Printf("failed fetching user %s: status code %d", fields[0], status)
+		return helper.BH("unexpected reply from squid db service")
+	}
+	return memberOf(&user, fields[0], fields[1:])
+}
+
+// checkGroupLocal checks the group membership against the database file.
+func (a *aclHelper) checkGroupLocal(username string, groups []string) helper.Reply {
+	user, err := a.local.Get(username)
+	switch {
+	case errors.Is(err, db.ErrUserNotFound):
+		return helper.ERR(db.ReasonUnknownUser)
+	case err != nil:
+		log.Printf("failed reading user %s: %s", username, err)
+		return helper.BH("failed reading squid db file")
+	case user.IsExpired(time.Now(), a.grace):
+		return helper.ERR(db.ReasonUnknownUser)
+	}
+	return memberOf(user, username, groups)
+}
+
+// checkGroupOffline checks the group membership against the offline snapshot.
+func (a *aclHelper) checkGroupOffline(username string, groups []string) helper.Reply {
+	now := time.Now()
+	s, err := a.offline(now)
+	if err != nil {
+		return helper.BH(err.Error())
+	}
+	user := s.Lookup(username)
+	if user == nil || user.IsExpired(now, s.ExpiryGrace) {
+		return helper.ERR(db.ReasonUnknownUser)
+	}
+	return memberOf(user, username, groups)
+}
+
+// memberOf replies OK if user is member of one of the groups.
+func memberOf(user *db.UserRecord, username string, groups []string) helper.Reply {
+	if user.Username != username {
+		return helper.ERR(db.ReasonUnknownUser)
+	}
+	if user.Disabled {
+		return helper.ERR(db.ReasonDisabled)
+	}
+	for _, g := range user.Groups {
+		for _, want := range groups {
+			if g == want {
+				return helper.OK().With("user", user.Username)
+			}
+		}
+	}
+	return helper.ERR("not in group")
+}
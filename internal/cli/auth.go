@@ -0,0 +1,168 @@
+//
+// auth.go
+// Copyright (C) 2024 rmelo <Ricardo Melo <rmelo@ludia.com>>
+//
+// Distributed under terms of the MIT license.
+//
+
+package cli
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/cropalato/squid-vault-auth/internal/db"
+	"github.com/cropalato/squid-vault-auth/internal/helper"
+	"github.com/cropalato/squid-vault-auth/internal/varenv"
+	"github.com/cropalato/squid-vault-auth/internal/webservices"
+)
+
+// authHelper is the squid basic auth helper.
+type authHelper struct {
+	*source
+	cache *helper.Cache
+	// groupNotes adds the user groups to OK replies, as group= annotations.
+	groupNotes bool
+}
+
+// AuthHelper runs the squid basic auth helper on stdin/stdout.
+func AuthHelper(args []string) error {
+	fs := newFlagSet("auth-helper")
+	sourceCfg := registerSourceFlags(fs)
+	concurrency := fs.Int("concurrency", varenv.LookupEnvOrInt("SQUIDDB_CONCURRENCY", 0), "number of requests processed in parallel. It must match the 'concurrency' option of squid auth_param")
+	cache_ttl := fs.Duration("cache_ttl", varenv.LookupEnvOrDuration("SQUIDDB_CACHE_TTL", time.Minute), "how long a successful authentication is cached. '0' disables it")
+	negative_cache_ttl := fs.Duration("negative_cache_ttl", varenv.LookupEnvOrDuration("SQUIDDB_NEGATIVE_CACHE_TTL", 5*time.Second), "how long a failed authentication is cached. '0' disables it")
+	cache_size := fs.Int("cache_size", varenv.LookupEnvOrInt("SQUIDDB_CACHE_SIZE", 10000), "maximum number of cached authentications")
+	group_notes := fs.Bool("group_notes", varenv.LookupEnvOrBool("SQUIDDB_GROUP_NOTES", false), "add the user groups to successful replies, as group= annotations matched by the squid note ACL")
+	cache_poll := fs.Duration("cache_poll", varenv.LookupEnvOrDuration("SQUIDDB_CACHE_POLL", 10*time.Second), "how often squid db service is asked for changed users, to evict them from the cache")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	var err error
+	a := &authHelper{groupNotes: *group_notes}
+	a.cache, err = helper.NewCache(*cache_ttl, *negative_cache_ttl, *cache_size)
+	if err != nil {
+		return err
+	}
+	// in direct-file mode, the cache is flushed every time the file changes.
+	a.source, err = sourceCfg.open(a.cache.Flush)
+	if err != nil {
+		return err
+	}
+	defer a.close()
+	if a.squiddb != nil && (*cache_ttl > 0 || *negative_cache_ttl > 0) && *cache_poll > 0 {
+		go a.watchChanges(*cache_poll)
+	}
+	return helper.Serve(os.Stdin, os.Stdout, *concurrency, helper.Instrument("auth", a.verify))
+}
+
+// verify checks the credential of a squid request: '<username> <password>'.
+// Trailing fields, sent by squid when auth_param key_extras is set, are ignored.
+func (a *authHelper) verify(fields []string) helper.Reply {
+	var verdict webservices.VerifyResponse
+	if len(fields) < 2 {
+		return helper.ERR("invalid request")
+	}
+	if a.local != nil {
+		// flushes the cache if the file changed.
+		a.local.Refresh()
+	}
+	if r, ok := a.cache.Get(fields[0], fields[1]); ok {
+		return r
+	}
+	if a.local != nil {
+		return a.verifyLocal(fields[0], fields[1])
+	}
+	req := webservices.VerifyRequest{Username: fields[0], Password: fields[1]}
+	status, err := a.squiddb.Do(context.Background(), http.MethodPost, "/api/v1/verify", req, &verdict)
+	if err != nil {
+		log.Printf("failed verifying user %s: %s", fields[0], err)
+		return a.verifyOffline(fields[0], fields[1])
+	}
+	a.online()
+	if status != http.StatusOK {
+		log.Printf("failed verifying user %s: status code %d", fields[0], status)
+		return helper.BH("unexpected reply from squid db service")
+	}
+	r := helper.ERR(verdict.Reason)
+	var notAfter time.Time
+	if verdict.Result == webservices.VerifyAllow {
+		r = a.allow(fields[0], verdict.Groups)
+		if verdict.ExpiresAt > 0 {
+			notAfter = time.Unix(verdict.ExpiresAt, 0)
+		}
+	}
+	a.cache.Put(fields[0], fields[1], r, notAfter)
+	return r
+}
+
+// allow returns the OK reply of user, annotated with its groups if enabled.
+func (a *authHelper) allow(user string, groups []string) helper.Reply {
+	r := helper.OK().With("user", user)
+	if a.groupNotes {
+		for _, g := range groups {
+			r = r.With("group", g)
+		}
+	}
+	return r
+}
+
+// verifyLocal checks a credential against the database file.
+func (a *authHelper) verifyLocal(user string, password string) helper.Reply {
+	u, err := a.local.Get(user)
+	if err != nil && !errors.Is(err, db.ErrUserNotFound) {
+		log.Printf("failed reading user %s: %s", user, err)
+		return helper.BH("failed reading squid db file")
+	}
+	ok, reason := db.CheckCredential(u, password, time.Now(), a.grace)
+	r := helper.ERR(reason)
+	var notAfter time.Time
+	if ok {
+		r = a.allow(user, u.Groups)
+		notAfter = u.ExpiresAt(a.grace)
+	}
+	a.cache.Put(user, password, r, notAfter)
+	return r
+}
+
+// verifyOffline checks a credential against the offline snapshot.
+// Offline answers are never cached.
+func (a *authHelper) verifyOffline(user string, password string) helper.Reply {
+	now := time.Now()
+	s, err := a.offline(now)
+	if err != nil {
+		return helper.BH(err.Error())
+	}
+	u := s.Lookup(user)
+	ok, reason := db.CheckCredential(u, password, now, s.ExpiryGrace)
+	if ok {
+		return a.allow(user, u.Groups)
+	}
+	return helper.ERR(reason)
+}
+
+// watchChanges evicts from the cache the users changed on squid db service.
+func (a *authHelper) watchChanges(interval time.Duration) {
+	var epoch string
+	var revision uint64
+	for range time.Tick(interval) {
+		var changes webservices.ChangesResponse
+		status, err := a.squiddb.Do(context.Background(), http.MethodGet, "/api/v1/changes?since="+strconv.FormatUint(revision, 10), nil, &changes)
+		if err != nil || status != http.StatusOK {
+			log.Printf("failed fetching user changes: status %d, %v", status, err)
+			continue
+		}
+		if changes.Reset || changes.Epoch != epoch {
+			a.cache.Flush()
+		} else {
+			a.cache.Evict(changes.Users...)
+		}
+		epoch, revision = changes.Epoch, changes.Revision
+	}
+}
@@ -0,0 +1,95 @@
+//
+// auth_test.go
+// Copyright (C) 2024 rmelo <Ricardo Melo <rmelo@ludia.com>>
+//
+// Distributed under terms of the MIT license.
+//
+
+package cli
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/cropalato/squid-vault-auth/internal/client"
+	"github.com/cropalato/squid-vault-auth/internal/helper"
+	"github.com/cropalato/squid-vault-auth/internal/webservices"
+)
+
+// newTestAuthHelper returns an auth helper calling a fake squid db service
+// allowing bob with password secret, without cache nor offline snapshot.
+func newTestAuthHelper(t *testing.T, groupNotes bool, groups ...string) *authHelper {
+	t.Helper()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req webservices.VerifyRequest
+		_ = json.NewDecoder(r.Body).Decode(&req)
+		resp := webservices.VerifyResponse{Result: webservices.VerifyDeny, Reason: "invalid credential"}
+		switch {
+		case req.Username == "bob" && req.Password == "secret":
+			resp = webservices.VerifyResponse{Result: webservices.VerifyAllow, Reason: "ok", Groups: groups}
+		case req.Username == "broken":
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		_ = json.NewEncoder(w).Encode(resp)
+	}))
+	t.Cleanup(srv.Close)
+	c, err := client.New(client.Config{URL: srv.URL, Timeout: time.Second})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cache, err := helper.NewCache(0, 0, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &authHelper{source: &source{squiddb: c}, cache: cache, groupNotes: groupNotes}
+}
+
+func TestVerify(t *testing.T) {
+	a := newTestAuthHelper(t, false)
+	for _, tc := range []struct {
+		line string
+		want string
+	}{
+		{"bob secret", "OK user=bob"},
+		// key_extras are appended after the credential.
+		{"bob secret 10.0.0.1 GET", "OK user=bob"},
+		{"bob wrong", `ERR message="invalid credential" log="invalid credential"`},
+		{"bob", `ERR message="invalid request" log="invalid request"`},
+	} {
+		fields, err := helper.Fields(tc.line)
+		if err != nil {
+			t.Fatalf("Fields(%q) error = %v", tc.line, err)
+		}
+		if got := a.verify(fields).String(); got != tc.want {
+			t.Errorf("verify(%q) = %q, want %q", tc.line, got, tc.want)
+		}
+	}
+}
+
+func TestGroupNotes(t *testing.T) {
+	groups := []string{"admins", "proxy users", `a"b`}
+	for _, tc := range []struct {
+		groupNotes bool
+		line       string
+		want       string
+	}{
+		{false, "bob secret", "OK user=bob"},
+		// group names are quoted like the other kv-pair values.
+		{true, "bob secret", `OK user=bob group=admins group="proxy users" group="a\"b"`},
+		{true, "bob wrong", `ERR message="invalid credential" log="invalid credential"`},
+		{true, "broken secret", `BH message="unexpected reply from squid db service" log="unexpected reply from squid db service"`},
+	} {
+		a := newTestAuthHelper(t, tc.groupNotes, groups...)
+		fields, err := helper.Fields(tc.line)
+		if err != nil {
+			t.Fatalf("Fields(%q) error = %v", tc.line, err)
+		}
+		if got := a.verify(fields).String(); got != tc.want {
+			t.Errorf("group_notes=%v: verify(%q) = %q, want %q", tc.groupNotes, tc.line, got, tc.want)
+		}
+	}
+}
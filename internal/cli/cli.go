@@ -0,0 +1,99 @@
+//
+// cli.go
+// Copyright (C) 2024 rmelo <Ricardo Melo <rmelo@ludia.com>>
+//
+// Distributed under terms of the MIT license.
+//
+
+// Package cli implements the commands of the squid-vault-auth binary.
+//
+// The command is picked from the first argument, or from the name the binary
+// was called with, so symlinks named after the historical binaries
+// (squid-database, squid-database-auth, ...) keep working.
+package cli
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// command is a subcommand of the squid-vault-auth binary.
+type command struct {
+	name string
+	// alias is the historical binary name running this command.
+	alias string
+	usage string
+	run   func(args []string) error
+}
+
+// commands lists all subcommands, in the order they are shown in the usage.
+var commands = []command{
+	{"server", "squid-database", "run squid db service", Server},
+	{"auth-helper", "squid-database-auth", "run the squid basic auth helper", AuthHelper},
+	{"acl-helper", "squid-database-validator", "run the squid external acl helper checking groups", ACLHelper},
+	{"digest-helper", "squid-database-digest", "run the squid digest auth helper", DigestHelper},
+	{"vault-plugin", "squid-database-plugin", "run the Vault database plugin", VaultPlugin},
+	{"ctl", "squid-database-ctl", "manage user records through squid db service", Ctl},
+}
+
+// Main runs the command selected by the binary name or by args[1], and returns the exit code.
+func Main(args []string) int {
+	name := filepath.Base(args[0])
+	for _, c := range commands {
+		if c.alias == name {
+			return Run(c.name, args[1:])
+		}
+	}
+	if len(args) < 2 {
+		usage(os.Stderr)
+		return 2
+	}
+	switch args[1] {
+	case "help", "-h", "-help", "--help":
+		usage(os.Stdout)
+		return 0
+	}
+	return Run(args[1], args[2:])
+}
+
+// Run runs the command named name with args, and returns the exit code.
+func Run(name string, args []string) int {
+	for _, c := range commands {
+		if c.name != name {
+			continue
+		}
+		err := c.run(args)
+		if errors.Is(err, flag.ErrHelp) {
+			return 0
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %s\n", c.name, err)
+			return 1
+		}
+		return 0
+	}
+	fmt.Fprintf(os.Stderr, "unknown command %q\n", name)
+	usage(os.Stderr)
+	return 2
+}
+
+// usage prints the list of commands to w.
+func usage(w io.Writer) {
+	var b strings.Builder
+	b.WriteString("Usage: squid-vault-auth <command> [flags]\n\nCommands:\n")
+	for _, c := range commands {
+		fmt.Fprintf(&b, "  %-14s %s (also run as %s)\n", c.name, c.usage, c.alias)
+	}
+	b.WriteString("\nRun 'squid-vault-auth <command> -h' to list the flags of a command.\n")
+	_, _ = io.WriteString(w, b.String())
+}
+
+// newFlagSet returns an empty flag set for the command name.
+func newFlagSet(name string) *flag.FlagSet {
+	return flag.NewFlagSet(name, flag.ContinueOnError)
+}
@@ -0,0 +1,72 @@
+//
+// cli_test.go
+// Copyright (C) 2024 rmelo <Ricardo Melo <rmelo@ludia.com>>
+//
+// Distributed under terms of the MIT license.
+//
+
+package cli
+
+import (
+	"errors"
+	"flag"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// fakeCommands replaces the commands with ones recording how they were run.
+func fakeCommands(t *testing.T) *[]string {
+	var calls []string
+	saved := commands
+	t.Cleanup(func() { commands = saved })
+	commands = nil
+	for _, c := range saved {
+		name := c.name
+		c.run = func(args []string) error {
+			calls = append(calls, name+" "+strings.Join(args, " "))
+			switch {
+			case len(args) > 0 && args[0] == "-h":
+				return flag.ErrHelp
+			case len(args) > 0 && args[0] == "-fail":
+				return errors.New("failed")
+			}
+			return nil
+		}
+		commands = append(commands, c)
+	}
+	return &calls
+}
+
+func TestDispatch(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		args []string
+		code int
+		call string
+	}{
+		{"subcommand", []string{"/usr/bin/squid-vault-auth", "server", "-debug"}, 0, "server -debug"},
+		{"alias", []string{"/app/squid-database-auth", "-concurrency", "2"}, 0, "auth-helper -concurrency 2"},
+		{"alias ignores subcommands", []string{"squid-database-ctl", "server"}, 0, "ctl server"},
+		{"relative alias", []string{"./squid-database-digest"}, 0, "digest-helper "},
+		{"help flag", []string{"squid-vault-auth", "acl-helper", "-h"}, 0, "acl-helper -h"},
+		{"failure", []string{"squid-vault-auth", "vault-plugin", "-fail"}, 1, "vault-plugin -fail"},
+		{"help", []string{"squid-vault-auth", "help"}, 0, ""},
+		{"no command", []string{"squid-vault-auth"}, 2, ""},
+		{"unknown command", []string{"squid-vault-auth", "squid-database"}, 2, ""},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			calls := fakeCommands(t)
+			if code := Main(tc.args); code != tc.code {
+				t.Errorf("Main(%q) = %d, want %d", tc.args, code, tc.code)
+			}
+			var want []string
+			if tc.call != "" {
+				want = []string{tc.call}
+			}
+			if !reflect.DeepEqual(*calls, want) {
+				t.Errorf("Main(%q) ran %q, want %q", tc.args, *calls, want)
+			}
+		})
+	}
+}
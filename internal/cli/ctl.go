@@ -0,0 +1,530 @@
+//
+// ctl.go
+// Copyright (C) 2024 rmelo <Ricardo Melo <rmelo@ludia.com>>
+//
+// Distributed under terms of the MIT license.
+//
+
+package cli
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/cropalato/squid-vault-auth/internal/client"
+	"github.com/cropalato/squid-vault-auth/internal/credentials"
+	"github.com/cropalato/squid-vault-auth/internal/db"
+	"github.com/cropalato/squid-vault-auth/internal/hash"
+	"github.com/cropalato/squid-vault-auth/internal/varenv"
+	"github.com/cropalato/squid-vault-auth/internal/webservices"
+)
+
+// Output formats of the ctl command.
+const (
+	outputTable = "table"
+	outputJSON  = "json"
+)
+
+const ctlUsage = `Usage: squid-vault-auth ctl [flags] <command> [args]
+
+Commands:
+  user create <username> [-password <password>] [-group <group>]... [-expires <date>]
+  user get <username>
+  user list [-group <group>] [-prefix <prefix>] [-state active|expired|disabled] [-sort username|exp_date]
+  user update <username> [-password <password>|-] [-groups <group>,...] [-expires <date>] [-disabled=true|false]
+  user delete <username>
+  user expire-now <username>
+  group add <username> <group>...
+  group remove <username> <group>...
+  principal list
+  principal set <username> -role admin|vault|helper|reader [-password <password>] [-cert_subject <subject>]
+  principal delete <username>
+  token create <name> -scope <scope>... [-ttl <duration>]
+  token list
+  token revoke <id>
+  hash [-cost <cost>] [<password>]
+
+Passwords are read from stdin when they aren't given as argument, or given as '-'.
+Dates are a duration from now (e.g. 24h), an RFC 3339 date, a unix timestamp, or 'never'.
+`
+
+// ctl manages user records through the squid db service API.
+type ctl struct {
+	squiddb *client.Client
+	output  string
+	stdin   *bufio.Reader
+	stdout  io.Writer
+}
+
+// Ctl runs the admin CLI.
+func Ctl(args []string) error {
+	fs := newFlagSet("ctl")
+	clientCfg := client.RegisterFlags(fs)
+	output := fs.String("o", varenv.LookupEnvOrString("SQUIDDB_OUTPUT", outputTable), "output format: 'table' or 'json'")
+	fs.Usage = func() {
+		fmt.Fprint(fs.Output(), ctlUsage+"\nFlags:\n")
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *output != outputTable && *output != outputJSON {
+		return fmt.Errorf("unknown output format %q", *output)
+	}
+	c := &ctl{output: *output, stdin: bufio.NewReader(os.Stdin), stdout: os.Stdout}
+	args = fs.Args()
+	if len(args) > 0 && args[0] == "hash" {
+		// hashing doesn't need squid db service.
+		return c.hash(args[1:])
+	}
+	var err error
+	c.squiddb, err = client.New(*clientCfg)
+	if err != nil {
+		return err
+	}
+	switch {
+	case len(args) < 2:
+	case args[0] == "user":
+		return c.user(args[1], args[2:])
+	case args[0] == "group":
+		return c.group(args[1], args[2:])
+	case args[0] == "principal":
+		return c.principal(args[1], args[2:])
+	case args[0] == "token":
+		return c.token(args[1], args[2:])
+	}
+	fs.Usage()
+	return errors.New("missing command")
+}
+
+// user runs the user subcommand verb.
+func (c *ctl) user(verb string, args []string) error {
+	if verb == "list" {
+		return c.list(args)
+	}
+	if verb == "create" || verb == "update" {
+		// flags are accepted after the username.
+		if len(args) == 0 {
+			return fmt.Errorf("user %s requires a username", verb)
+		}
+		if verb == "create" {
+			return c.create(args[0], args[1:])
+		}
+		return c.update(args[0], args[1:])
+	}
+	if len(args) != 1 {
+		return fmt.Errorf("user %s requires a username", verb)
+	}
+	switch verb {
+	case "get":
+		u, err := c.get(args[0])
+		if err != nil {
+			return err
+		}
+		return c.print([]db.UserRecord{*u}, u)
+	case "delete":
+		return c.request(http.MethodDelete, userPath(args[0]), nil)
+	case "expire-now":
+		now := time.Now().Unix()
+		return c.patch(args[0], db.UserPatch{ExpDate: &now})
+	}
+	return fmt.Errorf("unknown user command %q", verb)
+}
+
+// group runs the group subcommand verb.
+func (c *ctl) group(verb string, args []string) error {
+	if len(args) < 2 {
+		return fmt.Errorf("group %s requires a username and groups", verb)
+	}
+	// groups are changed by squid db service, so concurrent changes aren't lost.
+	groups := args[1:]
+	switch verb {
+	case "add":
+		return c.patch(args[0], db.UserPatch{AddGroups: &groups})
+	case "remove":
+		return c.patch(args[0], db.UserPatch{RemoveGroups: &groups})
+	}
+	return fmt.Errorf("unknown group command %q", verb)
+}
+
+// principal runs the principal subcommand verb, managing the API principals.
+func (c *ctl) principal(verb string, args []string) error {
+	switch {
+	case verb == "list":
+		var principals []credentials.Credential
+		status, err := c.squiddb.Do(context.Background(), http.MethodGet, "/api/v1/principals", nil, &principals)
+		if err != nil {
+			return err
+		}
+		if status != http.StatusOK {
+			return fmt.Errorf("failed listing principals: status code %d", status)
+		}
+		if c.output == outputJSON {
+			return c.printJSON(principals)
+		}
+		w := tabwriter.NewWriter(c.stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(w, "USERNAME\tROLE\tCERT SUBJECT")
+		for _, p := range principals {
+			fmt.Fprintf(w, "%s\t%s\t%s\n", p.Username, p.Role, p.CertSubject)
+		}
+		return w.Flush()
+	case len(args) == 0:
+		return fmt.Errorf("principal %s requires a username", verb)
+	case verb == "set":
+		fs := newFlagSet("principal set")
+		role := fs.String("role", "", "role of the principal: admin, vault, helper or reader")
+		password := fs.String("password", "", "password of the principal. Read from stdin when empty or '-', unless -cert_subject is set")
+		certSubject := fs.String("cert_subject", "", "subject or common name of the client certificate authenticating the principal")
+		if err := fs.Parse(args[1:]); err != nil {
+			return err
+		}
+		if !credentials.ValidRole(*role) {
+			return fmt.Errorf("unknown role %q", *role)
+		}
+		if *password == "-" || (*password == "" && *certSubject == "") {
+			var err error
+			if *password, err = c.readPassword(); err != nil {
+				return err
+			}
+		}
+		req := webservices.PrincipalRequest{Password: *password, Role: *role, CertSubject: *certSubject}
+		return c.request(http.MethodPut, "/api/v1/principals/"+url.PathEscape(args[0]), req)
+	case verb == "delete":
+		return c.request(http.MethodDelete, "/api/v1/principals/"+url.PathEscape(args[0]), nil)
+	}
+	return fmt.Errorf("unknown principal command %q", verb)
+}
+
+// token runs the token subcommand verb, managing the API tokens.
+func (c *ctl) token(verb string, args []string) error {
+	switch {
+	case verb == "list":
+		var tokens []credentials.Token
+		status, err := c.squiddb.Do(context.Background(), http.MethodGet, "/api/v1/tokens", nil, &tokens)
+		if err != nil {
+			return err
+		}
+		if status != http.StatusOK {
+			return fmt.Errorf("failed listing tokens: status code %d", status)
+		}
+		if c.output == outputJSON {
+			return c.printJSON(tokens)
+		}
+		w := tabwriter.NewWriter(c.stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(w, "ID\tNAME\tSCOPES\tEXPIRES\tLAST USED")
+		for _, t := range tokens {
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", t.ID, t.Name, strings.Join(t.Scopes, ","), formatDate(t.ExpiresAt), formatDate(t.LastUsed))
+		}
+		return w.Flush()
+	case len(args) == 0:
+		return fmt.Errorf("token %s requires an argument", verb)
+	case verb == "create":
+		var scopes multiFlag
+		fs := newFlagSet("token create")
+		fs.Var(&scopes, "scope", "scope of the token: users:write, users:read, users:list, verify, sync, secrets, principals, rotate or metrics. Can be repeated")
+		ttl := fs.Duration("ttl", 0, "lifetime of the token. '0' never expires")
+		if err := fs.Parse(args[1:]); err != nil {
+			return err
+		}
+		req := webservices.TokenRequest{Name: args[0], Scopes: scopes}
+		if *ttl > 0 {
+			req.TTL = ttl.String()
+		}
+		var t webservices.IssuedToken
+		// a retried creation could issue two tokens.
+		status, err := c.squiddb.DoOnce(context.Background(), http.MethodPost, "/api/v1/tokens", req, &t)
+		if err != nil {
+			return err
+		}
+		if status != http.StatusCreated {
+			return fmt.Errorf("request rejected: status code %d", status)
+		}
+		if c.output == outputJSON {
+			return c.printJSON(t)
+		}
+		// the secret is printed alone, so it can be piped.
+		fmt.Fprintf(os.Stderr, "Issued token %s, expires %s. It can't be shown again.\n", t.ID, formatDate(t.ExpiresAt))
+		_, err = fmt.Fprintln(c.stdout, t.Secret)
+		return err
+	case verb == "revoke":
+		return c.request(http.MethodDelete, "/api/v1/tokens/"+url.PathEscape(args[0]), nil)
+	}
+	return fmt.Errorf("unknown token command %q", verb)
+}
+
+// create adds a new user record.
+func (c *ctl) create(username string, args []string) error {
+	var groups multiFlag
+	fs := newFlagSet("user create")
+	password := fs.String("password", "", "password of the user. Read from stdin when empty or '-'")
+	fs.Var(&groups, "group", "group of the user. Can be repeated")
+	expires := fs.String("expires", "never", "expiration date of the user")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	exp, err := parseDate(*expires, time.Now())
+	if err != nil {
+		return err
+	}
+	if *password == "" || *password == "-" {
+		if *password, err = c.readPassword(); err != nil {
+			return err
+		}
+	}
+	u := db.UserRecord{Username: username, Password: *password, Groups: groups, ExpDate: exp}
+	if u.Groups == nil {
+		u.Groups = []string{}
+	}
+	return c.request(http.MethodPut, "/api/v1/users", u)
+}
+
+// update changes the fields of a user record given as flags.
+func (c *ctl) update(username string, args []string) error {
+	var p db.UserPatch
+	fs := newFlagSet("user update")
+	fs.Func("password", "new password of the user. '-' reads it from stdin", func(v string) error {
+		if v == "-" {
+			var err error
+			if v, err = c.readPassword(); err != nil {
+				return err
+			}
+		}
+		p.Password = &v
+		return nil
+	})
+	fs.Func("groups", "comma separated list replacing the groups of the user", func(v string) error {
+		groups := []string{}
+		for _, g := range strings.Split(v, ",") {
+			if g = strings.TrimSpace(g); g != "" {
+				groups = append(groups, g)
+			}
+		}
+		p.Groups = &groups
+		return nil
+	})
+	fs.Func("expires", "new expiration date of the user", func(v string) error {
+		exp, err := parseDate(v, time.Now())
+		p.ExpDate = &exp
+		return err
+	})
+	fs.Func("disabled", "disable or enable the user", func(v string) error {
+		disabled, err := strconv.ParseBool(v)
+		p.Disabled = &disabled
+		return err
+	})
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if p.Password == nil && p.Groups == nil && p.ExpDate == nil && p.Disabled == nil {
+		return errors.New("nothing to update")
+	}
+	return c.patch(username, p)
+}
+
+// hash prints the bcrypt hash of a password, e.g. for SQUIDDB_PASS.
+func (c *ctl) hash(args []string) error {
+	fs := newFlagSet("hash")
+	cost := fs.Int("cost", 15, "bcrypt cost")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	password := fs.Arg(0)
+	if password == "" || password == "-" {
+		var err error
+		if password, err = c.readPassword(); err != nil {
+			return err
+		}
+	}
+	h, err := hash.HashPasswordCost(password, *cost)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintln(c.stdout, h)
+	return err
+}
+
+// list prints the user records selected by the filters given as flags,
+// fetching all pages.
+func (c *ctl) list(args []string) error {
+	fs := newFlagSet("user list")
+	group := fs.String("group", "", "only list the members of this group")
+	prefix := fs.String("prefix", "", "only list the usernames starting with this prefix")
+	state := fs.String("state", db.StateAll, "only list the users in this state: active, expired, disabled or all")
+	order := fs.String("sort", db.SortUsername, "order of the users: username or exp_date")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	params := url.Values{}
+	for k, v := range map[string]string{"group": *group, "prefix": *prefix, "state": *state, "sort": *order} {
+		if v != "" {
+			params.Set(k, v)
+		}
+	}
+	users := []db.UserRecord{}
+	for {
+		var page webservices.UserList
+		status, err := c.squiddb.Do(context.Background(), http.MethodGet, "/api/v1/users?"+params.Encode(), nil, &page)
+		if err != nil {
+			return err
+		}
+		if status != http.StatusOK {
+			return fmt.Errorf("failed listing users: status code %d", status)
+		}
+		users = append(users, page.Users...)
+		if page.Next == "" {
+			break
+		}
+		params.Set("cursor", page.Next)
+	}
+	return c.print(users, users)
+}
+
+// get returns the record of username.
+func (c *ctl) get(username string) (*db.UserRecord, error) {
+	var u db.UserRecord
+	status, err := c.squiddb.Do(context.Background(), http.MethodGet, userPath(username), nil, &u)
+	if err != nil {
+		return nil, err
+	}
+	switch status {
+	case http.StatusOK:
+		return &u, nil
+	case http.StatusNotFound:
+		return nil, fmt.Errorf("user %s not found", username)
+	}
+	return nil, fmt.Errorf("failed fetching user %s: status code %d", username, status)
+}
+
+// patch sends a partial update of username.
+func (c *ctl) patch(username string, p db.UserPatch) error {
+	return c.request(http.MethodPatch, userPath(username), p)
+}
+
+// request sends a change to squid db service and prints its reply.
+// Changes are sent once: a retry of an applied change would be reported as
+// a conflict or not found.
+func (c *ctl) request(method string, path string, in interface{}) error {
+	var reply map[string]interface{}
+	status, err := c.squiddb.DoOnce(context.Background(), method, path, in, &reply)
+	if err != nil {
+		return err
+	}
+	switch {
+	case status == http.StatusNotFound:
+		return errors.New("not found")
+	case status == http.StatusConflict:
+		return errors.New("already exists")
+	case status == http.StatusForbidden:
+		return errors.New("permission denied")
+	case status < 200 || status > 299:
+		return fmt.Errorf("request rejected: status code %d", status)
+	}
+	if reply == nil {
+		// e.g. 204 replies have no body.
+		return nil
+	}
+	if c.output == outputJSON {
+		return c.printJSON(reply)
+	}
+	if msg, ok := reply["msg"].(string); ok {
+		_, err = fmt.Fprintln(c.stdout, msg)
+	}
+	return err
+}
+
+// print writes users as a table, or v as json.
+func (c *ctl) print(users []db.UserRecord, v interface{}) error {
+	if c.output == outputJSON {
+		return c.printJSON(v)
+	}
+	now := time.Now()
+	w := tabwriter.NewWriter(c.stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "USERNAME\tGROUPS\tEXPIRES\tSTATE")
+	for _, u := range users {
+		expires := formatDate(u.ExpDate)
+		state := "active"
+		switch {
+		case u.Disabled:
+			state = "disabled"
+		case u.IsExpired(now, 0):
+			state = "expired"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", u.Username, strings.Join(u.Groups, ","), expires, state)
+	}
+	return w.Flush()
+}
+
+// printJSON writes v as indented json.
+func (c *ctl) printJSON(v interface{}) error {
+	enc := json.NewEncoder(c.stdout)
+	enc.SetIndent("", "  ")
+	return enc.Encode(v)
+}
+
+// readPassword reads a password from the first line of stdin.
+func (c *ctl) readPassword() (string, error) {
+	fmt.Fprint(os.Stderr, "Password: ")
+	line, err := c.stdin.ReadString('\n')
+	if err != nil && !(errors.Is(err, io.EOF) && line != "") {
+		return "", fmt.Errorf("failed reading password: %w", err)
+	}
+	password := strings.TrimRight(line, "\r\n")
+	if password == "" {
+		return "", errors.New("password cannot be empty")
+	}
+	return password, nil
+}
+
+// parseDate parses an expiration date: a duration from now, an RFC 3339 date,
+// a unix timestamp, or 'never'. It returns a unix timestamp, 0 meaning never.
+func parseDate(v string, now time.Time) (int64, error) {
+	if v == "never" || v == "" {
+		return 0, nil
+	}
+	if d, err := time.ParseDuration(v); err == nil {
+		return now.Add(d).Unix(), nil
+	}
+	if t, err := time.Parse(time.RFC3339, v); err == nil {
+		return t.Unix(), nil
+	}
+	if ts, err := strconv.ParseInt(v, 10, 64); err == nil {
+		return ts, nil
+	}
+	return 0, fmt.Errorf("invalid date %q", v)
+}
+
+// formatDate formats a unix timestamp, 0 meaning never.
+func formatDate(ts int64) string {
+	if ts == 0 {
+		return "never"
+	}
+	return time.Unix(ts, 0).UTC().Format(time.RFC3339)
+}
+
+// userPath returns the API path of a user record.
+func userPath(username string) string {
+	return "/api/v1/users/" + url.PathEscape(username)
+}
+
+// multiFlag is a flag accepting several values.
+type multiFlag []string
+
+func (m *multiFlag) String() string {
+	return strings.Join(*m, ",")
+}
+
+func (m *multiFlag) Set(v string) error {
+	*m = append(*m, v)
+	return nil
+}
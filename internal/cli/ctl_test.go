@@ -0,0 +1,192 @@
+//
+// ctl_test.go
+// Copyright (C) 2024 rmelo <Ricardo Melo <rmelo@ludia.com>>
+//
+// Distributed under terms of the MIT license.
+//
+
+package cli
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cropalato/squid-vault-auth/internal/client"
+	"github.com/cropalato/squid-vault-auth/internal/db"
+)
+
+func TestParseDate(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	for _, tc := range []struct {
+		in   string
+		want int64
+		err  bool
+	}{
+		{"never", 0, false},
+		{"", 0, false},
+		{"24h", 1700000000 + 86400, false},
+		{"-1m", 1700000000 - 60, false},
+		{"2024-01-02T03:04:05Z", 1704164645, false},
+		{"1800000000", 1800000000, false},
+		{"tomorrow", 0, true},
+		{"2024-01-02", 0, true},
+	} {
+		got, err := parseDate(tc.in, now)
+		if got != tc.want || (err != nil) != tc.err {
+			t.Errorf("parseDate(%q) = %d, %v, want %d, error %v", tc.in, got, err, tc.want, tc.err)
+		}
+	}
+}
+
+// request is a request received by the fake squid db service.
+type request struct {
+	method string
+	path   string
+	body   map[string]interface{}
+}
+
+// newTestCtl returns a ctl calling a fake squid db service, which records
+// the requests it receives and replies with status.
+func newTestCtl(t *testing.T, output string, stdin string, status int) (*ctl, *bytes.Buffer, *[]request) {
+	var requests []request
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		req := request{method: r.Method, path: r.URL.Path}
+		data, _ := io.ReadAll(r.Body)
+		if len(data) > 0 {
+			if err := json.Unmarshal(data, &req.body); err != nil {
+				t.Errorf("invalid request body %s: %v", data, err)
+			}
+		}
+		requests = append(requests, req)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		_, _ = w.Write([]byte(`{"msg": "done"}`))
+	}))
+	t.Cleanup(srv.Close)
+	squiddb, err := client.New(client.Config{URL: srv.URL, Timeout: time.Second, Retries: 3, Backoff: time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var stdout bytes.Buffer
+	return &ctl{squiddb: squiddb, output: output, stdin: bufio.NewReader(strings.NewReader(stdin)), stdout: &stdout}, &stdout, &requests
+}
+
+func TestCtlPatch(t *testing.T) {
+	for _, tc := range []struct {
+		name  string
+		verb  string
+		args  []string
+		stdin string
+		want  string
+		err   bool
+	}{
+		{"group add", "group add", []string{"bob", "ops", "dev"}, "", `{"add_groups":["ops","dev"]}`, false},
+		{"group remove", "group remove", []string{"bob", "admins"}, "", `{"remove_groups":["admins"]}`, false},
+		{"group without groups", "group add", []string{"bob"}, "", "", true},
+		{"update", "user update", []string{"bob", "-groups", " ops, ,dev", "-disabled=true", "-expires", "1800000000"}, "", `{"disabled":true,"exp_date":1800000000,"groups":["ops","dev"]}`, false},
+		{"update no groups", "user update", []string{"bob", "-groups", ""}, "", `{"groups":[]}`, false},
+		{"update password from stdin", "user update", []string{"bob", "-password", "-"}, "secret\n", `{"password":"secret"}`, false},
+		{"update nothing", "user update", []string{"bob"}, "", "", true},
+		{"update invalid disabled", "user update", []string{"bob", "-disabled=maybe"}, "", "", true},
+		{"update invalid date", "user update", []string{"bob", "-expires", "soon"}, "", "", true},
+		{"update unknown flag", "user update", []string{"bob", "-group", "ops"}, "", "", true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			c, stdout, requests := newTestCtl(t, outputTable, tc.stdin, http.StatusOK)
+			object, verb, _ := strings.Cut(tc.verb, " ")
+			var err error
+			if object == "group" {
+				err = c.group(verb, tc.args)
+			} else {
+				err = c.user(verb, tc.args)
+			}
+			if tc.err {
+				if err == nil || len(*requests) != 0 {
+					t.Fatalf("expected an error and no request, got %v and %d requests", err, len(*requests))
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(*requests) != 1 {
+				t.Fatalf("got %d requests, want 1", len(*requests))
+			}
+			req := (*requests)[0]
+			got, _ := json.Marshal(req.body)
+			if req.method != http.MethodPatch || req.path != "/api/v1/users/bob" || string(got) != tc.want {
+				t.Errorf("got %s %s %s, want PATCH /api/v1/users/bob %s", req.method, req.path, got, tc.want)
+			}
+			if stdout.String() != "done\n" {
+				t.Errorf("output = %q, want the reply message", stdout.String())
+			}
+		})
+	}
+}
+
+func TestCtlRequestErrors(t *testing.T) {
+	for status, want := range map[int]string{
+		http.StatusNotFound:  "not found",
+		http.StatusForbidden: "permission denied",
+		http.StatusConflict:  "already exists",
+		http.StatusTeapot:    "request rejected: status code 418",
+	} {
+		c, _, _ := newTestCtl(t, outputTable, "", status)
+		if err := c.user("delete", []string{"bob"}); err == nil || err.Error() != want {
+			t.Errorf("status %d: error = %v, want %q", status, err, want)
+		}
+	}
+}
+
+func TestCtlNoRetry(t *testing.T) {
+	for name, run := range map[string]func(c *ctl) error{
+		"user create":  func(c *ctl) error { return c.user("create", []string{"bob", "-password", "-"}) },
+		"token create": func(c *ctl) error { return c.token("create", []string{"ci"}) },
+	} {
+		c, _, requests := newTestCtl(t, outputTable, "secret\n", http.StatusServiceUnavailable)
+		if err := run(c); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+		if len(*requests) != 1 {
+			t.Errorf("%s: got %d requests, want 1", name, len(*requests))
+		}
+	}
+}
+
+func TestCtlPrint(t *testing.T) {
+	now := time.Now()
+	users := []db.UserRecord{
+		{Username: "alice", Groups: []string{"ops", "dev"}},
+		{Username: "bob", Groups: []string{}, ExpDate: 1700000000},
+		{Username: "carol", Groups: []string{"ops"}, ExpDate: now.Add(time.Hour).Unix(), Disabled: true},
+	}
+
+	c, stdout, _ := newTestCtl(t, outputTable, "", http.StatusOK)
+	if err := c.print(users, users); err != nil {
+		t.Fatal(err)
+	}
+	carolExp := formatDate(users[2].ExpDate)
+	want := "USERNAME  GROUPS   EXPIRES               STATE\n" +
+		"alice     ops,dev  never                 active\n" +
+		"bob                2023-11-14T22:13:20Z  expired\n" +
+		"carol     ops      " + carolExp + "  disabled\n"
+	if stdout.String() != want {
+		t.Errorf("table output:\n%s\nwant:\n%s", stdout.String(), want)
+	}
+
+	c, stdout, _ = newTestCtl(t, outputJSON, "", http.StatusOK)
+	if err := c.print(users[:1], users[0]); err != nil {
+		t.Fatal(err)
+	}
+	want = "{\n  \"username\": \"alice\",\n  \"groups\": [\n    \"ops\",\n    \"dev\"\n  ],\n  \"exp_date\": 0\n}\n"
+	if stdout.String() != want {
+		t.Errorf("json output:\n%s\nwant:\n%s", stdout.String(), want)
+	}
+}
@@ -0,0 +1,112 @@
+//
+// digest.go
+// Copyright (C) 2024 rmelo <Ricardo Melo <rmelo@ludia.com>>
+//
+// Distributed under terms of the MIT license.
+//
+
+package cli
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/cropalato/squid-vault-auth/internal/db"
+	"github.com/cropalato/squid-vault-auth/internal/helper"
+	"github.com/cropalato/squid-vault-auth/internal/varenv"
+	"github.com/cropalato/squid-vault-auth/internal/webservices"
+)
+
+// digestHelper is the squid digest auth helper.
+type digestHelper struct {
+	*source
+}
+
+// DigestHelper runs the squid digest auth helper on stdin/stdout.
+func DigestHelper(args []string) error {
+	fs := newFlagSet("digest-helper")
+	sourceCfg := registerSourceFlags(fs)
+	concurrency := fs.Int("concurrency", varenv.LookupEnvOrInt("SQUIDDB_CONCURRENCY", 0), "number of requests processed in parallel. It must match the 'concurrency' option of squid auth_param")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	s, err := sourceCfg.open(nil)
+	if err != nil {
+		return err
+	}
+	defer s.close()
+	d := &digestHelper{source: s}
+	return helper.Serve(os.Stdin, os.Stdout, *concurrency, helper.Instrument("digest", d.lookup))
+}
+
+// parseDigestRequest splits a squid digest request: '"<username>":"<realm>" [key_extras]'.
+// Only the first field is parsed, the key_extras squid may append are ignored.
+func parseDigestRequest(fields []string) (string, string, bool) {
+	if len(fields) == 0 || !strings.HasPrefix(fields[0], "\"") {
+		return "", "", false
+	}
+	user, realm, ok := strings.Cut(fields[0][1:], "\":\"")
+	if !ok || !strings.HasSuffix(realm, "\"") {
+		return "", "", false
+	}
+	return user, strings.TrimSuffix(realm, "\""), true
+}
+
+// lookup returns the HA1 of the user of a squid request for the realm.
+func (d *digestHelper) lookup(fields []string) helper.Reply {
+	var digest webservices.DigestResponse
+
+	user, realm, ok := parseDigestRequest(fields)
+	if !ok {
+		return helper.ERR("invalid request")
+	}
+	if d.local != nil {
+		return d.lookupLocal(user, realm)
+	}
+	req := webservices.DigestRequest{Username: user, Realm: realm}
+	status, err := d.squiddb.Do(context.Background(), http.MethodPost, "/api/v1/digest", req, &digest)
+	if err != nil {
+		log.Printf("failed fetching digest of user %s: %s", user, err)
+		return d.lookupOffline(user, realm)
+	}
+	d.online()
+	if status != http.StatusOK {
+		log.Printf("failed fetching digest of user %s: status code %d", user, status)
+		return helper.BH("unexpected reply from squid db service")
+	}
+	return digestReply(digest.HA1, digest.Reason)
+}
+
+// lookupLocal returns the HA1 of user for the realm from the database file.
+func (d *digestHelper) lookupLocal(user string, realm string) helper.Reply {
+	u, err := d.local.Get(user)
+	if err != nil && !errors.Is(err, db.ErrUserNotFound) {
+		log.Printf("failed reading user %s: %s", user, err)
+		return helper.BH("failed reading squid db file")
+	}
+	return digestReply(db.DigestCredential(u, realm, time.Now(), d.grace))
+}
+
+// lookupOffline returns the HA1 of user for the realm from the offline snapshot.
+func (d *digestHelper) lookupOffline(user string, realm string) helper.Reply {
+	now := time.Now()
+	s, err := d.offline(now)
+	if err != nil {
+		return helper.BH(err.Error())
+	}
+	return digestReply(db.DigestCredential(s.Lookup(user), realm, now, s.ExpiryGrace))
+}
+
+// digestReply returns the squid reply carrying ha1, or the reason it is missing.
+func digestReply(ha1 string, reason string) helper.Reply {
+	if ha1 == "" {
+		return helper.ERR(reason)
+	}
+	return helper.OK().With("ha1", ha1)
+}
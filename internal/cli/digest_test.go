@@ -0,0 +1,42 @@
+//
+// digest_test.go
+// Copyright (C) 2024 rmelo <Ricardo Melo <rmelo@ludia.com>>
+//
+// Distributed under terms of the MIT license.
+//
+
+package cli
+
+import (
+	"testing"
+
+	"github.com/cropalato/squid-vault-auth/internal/helper"
+)
+
+func TestParseDigestRequest(t *testing.T) {
+	for _, tc := range []struct {
+		line  string
+		user  string
+		realm string
+		ok    bool
+	}{
+		{`"bob":"proxy"`, "bob", "proxy", true},
+		{`"bob":"proxy" group=admins`, "bob", "proxy", true},
+		{`"bob%20smith":"squid%20proxy" ip=10.0.0.1 "x":"y"`, "bob smith", "squid proxy", true},
+		{`"":"proxy"`, "", "proxy", true},
+		{`bob:proxy`, "", "", false},
+		{`"bob"`, "", "", false},
+		{`"bob":"proxy`, "", "", false},
+		{`"bob" :"proxy"`, "", "", false},
+		{``, "", "", false},
+	} {
+		fields, err := helper.Fields(tc.line)
+		if err != nil {
+			t.Fatalf("Fields(%q) error = %v", tc.line, err)
+		}
+		user, realm, ok := parseDigestRequest(fields)
+		if user != tc.user || realm != tc.realm || ok != tc.ok {
+			t.Errorf("parseDigestRequest(%q) = %q, %q, %v, want %q, %q, %v", tc.line, user, realm, ok, tc.user, tc.realm, tc.ok)
+		}
+	}
+}
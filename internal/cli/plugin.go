@@ -0,0 +1,20 @@
+//
+// plugin.go
+// Copyright (C) 2024 rmelo <Ricardo Melo <rmelo@ludia.com>>
+//
+// Distributed under terms of the MIT license.
+//
+
+package cli
+
+import (
+	"github.com/cropalato/squid-vault-auth/internal/squid"
+	dbplugin "github.com/hashicorp/vault/sdk/database/dbplugin/v5"
+)
+
+// VaultPlugin instantiates a squid object, and runs the RPC server for the plugin.
+// Vault passes its own flags to plugins, so args are left to the plugin SDK.
+func VaultPlugin(args []string) error {
+	dbplugin.ServeMultiplex(squid.New)
+	return nil
+}
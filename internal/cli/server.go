@@ -0,0 +1,115 @@
+//
+// server.go
+// Copyright (C) 2024 rmelo <Ricardo Melo <rmelo@ludia.com>>
+//
+// Distributed under terms of the MIT license.
+//
+
+package cli
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/cropalato/squid-vault-auth/internal/conf"
+	"github.com/cropalato/squid-vault-auth/internal/db"
+	"github.com/cropalato/squid-vault-auth/internal/tlsutil"
+	"github.com/cropalato/squid-vault-auth/internal/webservices"
+	"github.com/rs/zerolog/log"
+)
+
+// shutdownTimeout is how long in-flight requests are waited for on shutdown.
+const shutdownTimeout = 20 * time.Second
+
+// Server runs the RESTApi server used to manage users for squid-proxy server.
+//
+// You Should use env variables to config the service.
+// ex.:
+//
+//	export SQUIDDB_PATH=/tmp/squid-vault.json
+//	export SQUIDDB_PASS='$2a$14$vN59c/ZmesroW/oYaDn3yeAPutg4wkVM5t6n9CNrOcTMJ.zDVtcUm' #secret
+//	export SQUIDDB_USER=admin
+func Server(args []string) error {
+	fs := newFlagSet("server")
+	cfg := conf.RegisterFlags(fs)
+	tlsCfg := tlsutil.RegisterServerFlags(fs)
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if err := cfg.Load(); err != nil {
+		return err
+	}
+
+	srv := http.Server{
+		Addr:              cfg.Addr,
+		ReadTimeout:       3 * time.Second,
+		WriteTimeout:      20 * time.Second,
+		IdleTimeout:       30 * time.Second,
+		ReadHeaderTimeout: 2 * time.Second,
+	}
+
+	handlers, err := webservices.NewHandlers(cfg)
+	if err != nil {
+		return fmt.Errorf("failed loading database %s: %w", cfg.DbPath, err)
+	}
+	defer handlers.UserDB.Close()
+
+	// on SIGINT/SIGTERM, the server is shut down, then the background jobs
+	// are stopped and waited for, so the last token uses are flushed.
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	jobsCtx, stopJobs := context.WithCancel(context.Background())
+	defer stopJobs()
+	run := func(job func(context.Context)) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			job(jobsCtx)
+		}()
+	}
+	run(handlers.Tokens.Run)
+	if cfg.ReapInterval > 0 {
+		handlers.Reaper = db.NewReaper(handlers.UserDB, cfg.ReapInterval)
+		run(handlers.Reaper.Run)
+	}
+	srv.Handler = webservices.NewRouter(handlers)
+	listen := srv.ListenAndServe
+	if tlsCfg.Enabled() {
+		reloader, err := tlsutil.NewReloader(*tlsCfg)
+		if err != nil {
+			return err
+		}
+		run(reloader.Run)
+		srv.TLSConfig = reloader.TLSConfig()
+		listen = func() error { return srv.ListenAndServeTLS("", "") }
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	served := make(chan error, 1)
+	go func() {
+		served <- listen()
+	}()
+	select {
+	case err := <-served:
+		return err
+	case <-ctx.Done():
+	}
+	log.Info().Msg("shutting down")
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if err := srv.Shutdown(shutdownCtx); err != nil {
+		return fmt.Errorf("failed shutting down: %w", err)
+	}
+	if err := <-served; !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return nil
+}
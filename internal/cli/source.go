@@ -0,0 +1,99 @@
+//
+// source.go
+// Copyright (C) 2024 rmelo <Ricardo Melo <rmelo@ludia.com>>
+//
+// Distributed under terms of the MIT license.
+//
+
+package cli
+
+import (
+	"context"
+	"flag"
+	"log"
+	"time"
+
+	"github.com/cropalato/squid-vault-auth/internal/client"
+	"github.com/cropalato/squid-vault-auth/internal/db"
+	"github.com/cropalato/squid-vault-auth/internal/helper"
+	"github.com/cropalato/squid-vault-auth/internal/snapshot"
+	"github.com/cropalato/squid-vault-auth/internal/varenv"
+)
+
+// sourceConfig holds the flags shared by all helpers, selecting where user
+// records are read from.
+type sourceConfig struct {
+	client   *client.Config
+	snapshot *snapshot.Config
+	metrics  *helper.MetricsConfig
+	dbPath   string
+	backend  string
+	grace    time.Duration
+}
+
+// registerSourceFlags defines the flags shared by all helpers in fs.
+func registerSourceFlags(fs *flag.FlagSet) *sourceConfig {
+	c := &sourceConfig{client: client.RegisterFlags(fs), snapshot: snapshot.RegisterFlags(fs), metrics: helper.RegisterMetricsFlags(fs)}
+	fs.StringVar(&c.dbPath, "db_path", varenv.LookupEnvOrString("SQUIDDB_PATH", ""), "read the squid db file in place, instead of calling squid db service. Disabled when empty")
+	fs.StringVar(&c.backend, "db_backend", varenv.LookupEnvOrString("SQUIDDB_BACKEND", db.BackendJSON), "storage backend of the squid db file. Only 'json' can be read in place")
+	fs.DurationVar(&c.grace, "expiry_grace", varenv.LookupEnvOrDuration("SQUIDDB_EXPIRY_GRACE", 0), "how long a user record is still accepted after its expiration date, in direct-file mode")
+	return c
+}
+
+// source is where a helper reads user records from: the database file in
+// direct-file mode, or squid db service with its offline snapshot.
+type source struct {
+	squiddb  *client.Client
+	fallback *snapshot.Fallback
+	// local is set in direct-file mode, when the database file is read in place.
+	local *db.Reader
+	grace time.Duration
+	// stopMetrics stops exposing the helper metrics.
+	stopMetrics func()
+}
+
+// open returns the source described by c. onChange, if not nil, is called
+// every time the database file changes in direct-file mode.
+func (c *sourceConfig) open(onChange func()) (*source, error) {
+	s := &source{grace: c.grace}
+	var err error
+	if c.dbPath != "" {
+		s.local, err = db.NewReader(c.backend, c.dbPath, onChange)
+	} else {
+		s.squiddb, err = client.New(*c.client)
+		if err == nil {
+			s.fallback, err = snapshot.Start(context.Background(), *c.snapshot, s.squiddb)
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	s.stopMetrics = helper.StartMetrics(*c.metrics)
+	return s, nil
+}
+
+// close releases the source, writing the metrics textfile one last time.
+func (s *source) close() {
+	s.stopMetrics()
+}
+
+// online records squid db service answered.
+func (s *source) online() {
+	if s.fallback != nil {
+		s.fallback.Online()
+	}
+}
+
+// offline returns the offline snapshot, used when squid db service is unreachable.
+func (s *source) offline(now time.Time) (*snapshot.Snapshot, error) {
+	if s.fallback == nil {
+		return nil, client.ErrUnavailable
+	}
+	snap, err := s.fallback.Snapshot(now)
+	if err != nil {
+		log.Printf("failed using offline snapshot: %s", err)
+		return nil, client.ErrUnavailable
+	}
+	helper.OfflineReplies.Inc()
+	return snap, nil
+}
@@ -0,0 +1,205 @@
+//
+// client.go
+// Copyright (C) 2024 rmelo <Ricardo Melo <rmelo@ludia.com>>
+//
+// Distributed under terms of the MIT license.
+//
+
+// Package implementing the client used by helpers to call squid db service.
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/cropalato/squid-vault-auth/internal/tlsutil"
+	"github.com/cropalato/squid-vault-auth/internal/varenv"
+)
+
+// ErrUnavailable no squid db service endpoint answered
+var ErrUnavailable = errors.New("squid db service unavailable")
+
+// maxBackoff caps the delay between two attempts.
+const maxBackoff = 5 * time.Second
+
+// Config of a Client.
+type Config struct {
+	// URL is a comma separated list of squid db service endpoints, in order of preference.
+	URL      string
+	Username string
+	Password string
+	// Token is an API bearer token. When set, it is used instead of Username and Password.
+	Token string
+	// Timeout of a single HTTP request.
+	Timeout time.Duration
+	// Retries is how many times a failed request is retried.
+	Retries int
+	// Backoff is the delay before the first retry. It doubles on every retry.
+	Backoff time.Duration
+	// Cooldown is how long a failing endpoint is skipped.
+	Cooldown time.Duration
+	// TLS configures https endpoints.
+	TLS *tlsutil.ClientConfig
+}
+
+// RegisterFlags defines the client flags in fs, using SQUIDDB_* env variables as defaults.
+func RegisterFlags(fs *flag.FlagSet) *Config {
+	c := &Config{}
+	fs.StringVar(&c.URL, "url", varenv.LookupEnvOrString("SQUIDDB_URL", "http://127.0.0.1:8080"), "comma separated list of squid db service URLs, in order of preference. format: 'http[s]://(<fqdn>|<ip>)[:<port>]'")
+	fs.StringVar(&c.Username, "admin_user", varenv.LookupEnvOrString("SQUIDDB_USER", "admin"), "admin account used to call squid db service API'")
+	fs.StringVar(&c.Password, "admin_pass", varenv.LookupEnvOrString("SQUIDDB_PASS", "admin"), "admin password used to call squid db service API")
+	fs.StringVar(&c.Token, "token", varenv.LookupEnvOrString("SQUIDDB_TOKEN", ""), "API token used to call squid db service API, instead of admin_user and admin_pass")
+	fs.DurationVar(&c.Timeout, "timeout", varenv.LookupEnvOrDuration("SQUIDDB_TIMEOUT", 5*time.Second), "timeout of a single request to squid db service")
+	fs.IntVar(&c.Retries, "retries", varenv.LookupEnvOrInt("SQUIDDB_RETRIES", 3), "how many times a failed request to squid db service is retried")
+	fs.DurationVar(&c.Backoff, "backoff", varenv.LookupEnvOrDuration("SQUIDDB_BACKOFF", 200*time.Millisecond), "delay before the first retry. It doubles on every retry")
+	fs.DurationVar(&c.Cooldown, "cooldown", varenv.LookupEnvOrDuration("SQUIDDB_COOLDOWN", 30*time.Second), "how long a failing squid db service URL is skipped")
+	c.TLS = tlsutil.RegisterClientFlags(fs)
+	return c
+}
+
+type endpoint struct {
+	url string
+	// downUntil is the unix time in nanoseconds until the endpoint is skipped.
+	downUntil atomic.Int64
+}
+
+// Client calls squid db service, failing over between endpoints and retrying
+// failed requests. It is safe for concurrent use.
+type Client struct {
+	cfg       Config
+	http      *http.Client
+	endpoints []*endpoint
+}
+
+// New creates a client from cfg.
+func New(cfg Config) (*Client, error) {
+	c := &Client{cfg: cfg, http: &http.Client{Timeout: cfg.Timeout}}
+	if cfg.TLS != nil {
+		tlsConfig, err := cfg.TLS.TLSConfig()
+		if err != nil {
+			return nil, err
+		}
+		if tlsConfig != nil {
+			transport := http.DefaultTransport.(*http.Transport).Clone()
+			transport.TLSClientConfig = tlsConfig
+			c.http.Transport = transport
+		}
+	}
+	for _, u := range strings.Split(cfg.URL, ",") {
+		u = strings.TrimRight(strings.TrimSpace(u), "/")
+		if u != "" {
+			c.endpoints = append(c.endpoints, &endpoint{url: u})
+		}
+	}
+	if len(c.endpoints) == 0 {
+		return nil, errors.New("no squid db service URL configured")
+	}
+	return c, nil
+}
+
+// pick returns the first healthy endpoint, or the one coming back first if all are down.
+func (c *Client) pick(now time.Time) *endpoint {
+	best := c.endpoints[0]
+	for _, e := range c.endpoints {
+		if e.downUntil.Load() <= now.UnixNano() {
+			return e
+		}
+		if e.downUntil.Load() < best.downUntil.Load() {
+			best = e
+		}
+	}
+	return best
+}
+
+// Do sends a request to squid db service and returns the status code.
+// in is sent as json, and out is decoded from the json reply if it is 2xx.
+// Network errors and 5xx replies are retried on the next healthy endpoint.
+// ErrUnavailable is returned once all retries failed.
+func (c *Client) Do(ctx context.Context, method string, path string, in interface{}, out interface{}) (int, error) {
+	return c.send(ctx, method, path, in, out, c.cfg.Retries)
+}
+
+// DoOnce is like Do, but the request is sent a single time, to the first
+// healthy endpoint. It is used for changes that must not be applied twice,
+// e.g. creations: on ErrUnavailable, the change may have been applied or not.
+func (c *Client) DoOnce(ctx context.Context, method string, path string, in interface{}, out interface{}) (int, error) {
+	return c.send(ctx, method, path, in, out, 0)
+}
+
+// send sends a request, retrying it up to retries times.
+func (c *Client) send(ctx context.Context, method string, path string, in interface{}, out interface{}, retries int) (int, error) {
+	var data []byte
+	if in != nil {
+		var err error
+		data, err = json.Marshal(in)
+		if err != nil {
+			return 0, err
+		}
+	}
+	backoff := c.cfg.Backoff
+	var lastErr error
+	for attempt := 0; attempt <= retries; attempt++ {
+		if attempt > 0 {
+			select {
+			case <-ctx.Done():
+				return 0, fmt.Errorf("%w: %v", ErrUnavailable, ctx.Err())
+			case <-time.After(backoff):
+			}
+			backoff = min(2*backoff, maxBackoff)
+		}
+		e := c.pick(time.Now())
+		status, err := c.do(ctx, e.url, method, path, data, out)
+		if err == nil {
+			return status, nil
+		}
+		lastErr = fmt.Errorf("%s: %w", e.url, err)
+		e.downUntil.Store(time.Now().Add(c.cfg.Cooldown).UnixNano())
+	}
+	return 0, fmt.Errorf("%w: %v", ErrUnavailable, lastErr)
+}
+
+// do sends a single request. Only failures worth a retry are returned as errors.
+func (c *Client) do(ctx context.Context, base string, method string, path string, data []byte, out interface{}) (int, error) {
+	var body io.Reader
+	if data != nil {
+		body = bytes.NewReader(data)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, base+path, body)
+	if err != nil {
+		return 0, err
+	}
+	if data != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if c.cfg.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.cfg.Token)
+	} else {
+		req.SetBasicAuth(c.cfg.Username, c.cfg.Password)
+	}
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 500 {
+		return resp.StatusCode, fmt.Errorf("server replied with status code %d", resp.StatusCode)
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 || resp.StatusCode == http.StatusNoContent || out == nil {
+		_, _ = io.Copy(io.Discard, resp.Body)
+		return resp.StatusCode, nil
+	}
+	if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+		return resp.StatusCode, fmt.Errorf("failed decoding reply: %w", err)
+	}
+	return resp.StatusCode, nil
+}
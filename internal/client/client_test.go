@@ -0,0 +1,164 @@
+//
+// client_test.go
+// Copyright (C) 2024 rmelo <Ricardo Melo <rmelo@ludia.com>>
+//
+// Distributed under terms of the MIT license.
+//
+
+package client
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// server counts the requests it receives and replies with status.
+type server struct {
+	*httptest.Server
+	status atomic.Int32
+	hits   atomic.Int32
+}
+
+func newServer(t *testing.T, status int) *server {
+	s := &server{}
+	s.status.Store(int32(status))
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.hits.Add(1)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(int(s.status.Load()))
+		_, _ = w.Write([]byte(`{"ok":true}`))
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+// downURL returns the URL of a closed server, refusing connections.
+func downURL() string {
+	s := httptest.NewServer(http.NotFoundHandler())
+	s.Close()
+	return s.URL
+}
+
+func newClient(t *testing.T, url string, retries int, cooldown time.Duration) *Client {
+	c, err := New(Config{URL: url, Timeout: time.Second, Retries: retries, Backoff: time.Millisecond, Cooldown: cooldown})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func TestFailover(t *testing.T) {
+	secondary := newServer(t, http.StatusOK)
+	c := newClient(t, downURL()+","+secondary.URL, 1, time.Minute)
+
+	var out struct{ OK bool }
+	status, err := c.Do(context.Background(), http.MethodGet, "/verify", nil, &out)
+	if err != nil || status != http.StatusOK || !out.OK {
+		t.Fatalf("Do() = %d, %v, %+v, want 200 from the secondary", status, err, out)
+	}
+	if secondary.hits.Load() != 1 {
+		t.Errorf("secondary got %d requests, want 1", secondary.hits.Load())
+	}
+}
+
+func TestCooldown(t *testing.T) {
+	primary := newServer(t, http.StatusServiceUnavailable)
+	secondary := newServer(t, http.StatusOK)
+	cooldown := 100 * time.Millisecond
+	c := newClient(t, primary.URL+","+secondary.URL, 1, cooldown)
+
+	// the primary fails, and the request is retried on the secondary.
+	if status, err := c.Do(context.Background(), http.MethodGet, "/", nil, nil); err != nil || status != http.StatusOK {
+		t.Fatalf("Do() = %d, %v, want 200", status, err)
+	}
+	// the primary is skipped while cooling down, even once it is back.
+	primary.status.Store(http.StatusOK)
+	if status, err := c.Do(context.Background(), http.MethodGet, "/", nil, nil); err != nil || status != http.StatusOK {
+		t.Fatalf("Do() = %d, %v, want 200", status, err)
+	}
+	if primary.hits.Load() != 1 || secondary.hits.Load() != 2 {
+		t.Fatalf("during cooldown: primary got %d requests, secondary %d, want 1 and 2", primary.hits.Load(), secondary.hits.Load())
+	}
+	// once the cooldown is over, the primary is preferred again.
+	time.Sleep(cooldown)
+	if status, err := c.Do(context.Background(), http.MethodGet, "/", nil, nil); err != nil || status != http.StatusOK {
+		t.Fatalf("Do() = %d, %v, want 200", status, err)
+	}
+	if primary.hits.Load() != 2 || secondary.hits.Load() != 2 {
+		t.Errorf("after cooldown: primary got %d requests, secondary %d, want 2 and 2", primary.hits.Load(), secondary.hits.Load())
+	}
+}
+
+func TestNoRetryOnClientError(t *testing.T) {
+	primary := newServer(t, http.StatusNotFound)
+	secondary := newServer(t, http.StatusOK)
+	c := newClient(t, primary.URL+","+secondary.URL, 3, time.Minute)
+
+	var out struct{ OK bool }
+	status, err := c.Do(context.Background(), http.MethodGet, "/", nil, &out)
+	if err != nil || status != http.StatusNotFound {
+		t.Fatalf("Do() = %d, %v, want 404", status, err)
+	}
+	if out.OK {
+		t.Error("4xx reply was decoded")
+	}
+	if primary.hits.Load() != 1 || secondary.hits.Load() != 0 {
+		t.Errorf("primary got %d requests, secondary %d, want 1 and 0", primary.hits.Load(), secondary.hits.Load())
+	}
+	// the endpoint is not put in cooldown.
+	if _, err := c.Do(context.Background(), http.MethodGet, "/", nil, nil); err != nil || primary.hits.Load() != 2 {
+		t.Errorf("primary got %d requests, want 2: %v", primary.hits.Load(), err)
+	}
+}
+
+func TestRetryOnServerError(t *testing.T) {
+	s := newServer(t, http.StatusInternalServerError)
+	retries := 3
+	c := newClient(t, s.URL, retries, time.Minute)
+
+	status, err := c.Do(context.Background(), http.MethodGet, "/", nil, nil)
+	if !errors.Is(err, ErrUnavailable) || status != 0 {
+		t.Fatalf("Do() = %d, %v, want ErrUnavailable", status, err)
+	}
+	if got := int(s.hits.Load()); got != retries+1 {
+		t.Errorf("server got %d requests, want %d", got, retries+1)
+	}
+}
+
+func TestDoOnce(t *testing.T) {
+	primary := newServer(t, http.StatusServiceUnavailable)
+	secondary := newServer(t, http.StatusOK)
+	c := newClient(t, primary.URL+","+secondary.URL, 3, time.Minute)
+
+	if _, err := c.DoOnce(context.Background(), http.MethodPost, "/", nil, nil); !errors.Is(err, ErrUnavailable) {
+		t.Fatalf("DoOnce() error = %v, want ErrUnavailable", err)
+	}
+	if primary.hits.Load() != 1 || secondary.hits.Load() != 0 {
+		t.Errorf("primary got %d requests, secondary %d, want 1 and 0", primary.hits.Load(), secondary.hits.Load())
+	}
+	// the failing endpoint is put in cooldown, as with Do.
+	if status, err := c.DoOnce(context.Background(), http.MethodPost, "/", nil, nil); err != nil || status != http.StatusOK {
+		t.Fatalf("DoOnce() = %d, %v, want 200 from the secondary", status, err)
+	}
+}
+
+func TestRetryCanceled(t *testing.T) {
+	s := newServer(t, http.StatusInternalServerError)
+	c, err := New(Config{URL: s.URL, Timeout: time.Second, Retries: 3, Backoff: time.Hour, Cooldown: time.Minute})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err := c.Do(ctx, http.MethodGet, "/", nil, nil); !errors.Is(err, ErrUnavailable) {
+		t.Fatalf("Do() error = %v, want ErrUnavailable", err)
+	}
+	if s.hits.Load() != 1 {
+		t.Errorf("server got %d requests, want 1", s.hits.Load())
+	}
+}
@@ -8,7 +8,11 @@
 package conf
 
 import (
-	"github.com/kelseyhightower/envconfig"
+	"flag"
+	"strings"
+	"time"
+
+	"github.com/cropalato/squid-vault-auth/internal/varenv"
 	"github.com/pkg/errors"
 	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
@@ -22,14 +26,63 @@ var (
 	ErrMissingEnvironmentAdminSecret = errors.New("Missing Admin_secret ENV Variable")
 )
 
-// Config for the environment
+// Config of squid db service.
 type Config struct {
-	Debug       bool   `envconfig:"DEBUG"`
-	Addr        string `envconfig:"ADDR" default:":8080"`
-	AdminID     string `envconfig:"ADMIN_ID"`
-	AdminSecret string `envconfig:"ADMIN_SECRET"`
-	DbPath      string `envconfig:"DB_PATH" default:"/etc/squid-vault.json"`
-	CorsOrigin  string `envconfig:"CORS_ORIGIN" default:"*"`
+	Debug       bool
+	Addr        string
+	AdminID     string
+	AdminSecret string
+	DbPath      string
+	CorsOrigin  string
+	// AdminPath is the file keeping the admin credential rotated through the API.
+	// Defaults to DbPath with a '.admin' suffix.
+	AdminPath string
+	// PrincipalsPath is the file keeping the API principals other than the admin.
+	// Defaults to DbPath with a '.principals' suffix.
+	PrincipalsPath string
+	// TokensPath is the file keeping the API tokens.
+	// Defaults to DbPath with a '.tokens' suffix.
+	TokensPath string
+	// SnapshotKey is the ed25519 private key used to sign the snapshots served to helpers.
+	// Snapshots are disabled when empty.
+	SnapshotKey string
+	// Backend is the storage backend used to keep user records: 'json' or 'bolt'.
+	Backend string
+	// ReapInterval is the delay between two purges of expired records. Zero disables the reaper.
+	ReapInterval time.Duration
+	// ExpiryGrace is how long a record is still accepted after its expiration date.
+	ExpiryGrace time.Duration
+	// ExpiryWindow is how far ahead users are reported as expiring soon in the metrics.
+	ExpiryWindow time.Duration
+	// DigestRealms are the realms digest HA1 values are computed for, when a password is set.
+	DigestRealms []string
+
+	// digestRealms is the comma separated list of realms, as given in flags.
+	digestRealms string
+}
+
+// RegisterFlags defines the squid db service flags in fs, using SQUIDDB_* env
+// variables as defaults. Load must be called once fs is parsed.
+func RegisterFlags(fs *flag.FlagSet) *Config {
+	c := &Config{}
+	fs.StringVar(&c.Addr, "listen", varenv.LookupEnvOrString("SQUIDDB_LISTEN", ":8080"), "IP and port used by squid db service. format: '[<ip>]:<port>'. default: ':8080'")
+	fs.StringVar(&c.AdminID, "admin_user", varenv.LookupEnvOrString("SQUIDDB_USER", "admin"), "admin account used to call squid db service API'")
+	// the dafault password is 'admin'. ypu can use create a new one using
+	// squid-vault-auth ctl hash
+	fs.StringVar(&c.AdminSecret, "admin_pass", varenv.LookupEnvOrString("SQUIDDB_PASS", "$2b$15$QjL.GaBkHXXTifvFFQo2eOVPqzHpQQ7y/axXslpylNACTpeCYR.t6"), "admin password used to call squid db service API")
+	fs.StringVar(&c.PrincipalsPath, "principals_path", varenv.LookupEnvOrString("SQUIDDB_PRINCIPALS_PATH", ""), "file keeping the API principals and their role. default: '<db_path>.principals'")
+	fs.StringVar(&c.TokensPath, "tokens_path", varenv.LookupEnvOrString("SQUIDDB_TOKENS_PATH", ""), "file keeping the API tokens. default: '<db_path>.tokens'")
+	fs.StringVar(&c.AdminPath, "admin_path", varenv.LookupEnvOrString("SQUIDDB_ADMIN_PATH", ""), "file keeping the admin credential rotated through the API. default: '<db_path>.admin'")
+	fs.StringVar(&c.DbPath, "db_path", varenv.LookupEnvOrString("SQUIDDB_PATH", "/etc/squid-vault.json"), "squid db file path")
+	fs.StringVar(&c.Backend, "db_backend", varenv.LookupEnvOrString("SQUIDDB_BACKEND", "json"), "storage backend used to keep user records: 'json' or 'bolt'")
+	fs.StringVar(&c.SnapshotKey, "snapshot_key", varenv.LookupEnvOrString("SQUIDDB_SNAPSHOT_KEY", ""), "ed25519 private key (PEM) used to sign the snapshots served to helpers. Snapshots are disabled when empty")
+	fs.StringVar(&c.CorsOrigin, "cors_origin", varenv.LookupEnvOrString("SQUIDDB_CORS", "*"), "configure Access-Control-Allow-Origin header")
+	fs.DurationVar(&c.ReapInterval, "reap_interval", varenv.LookupEnvOrDuration("SQUIDDB_REAP_INTERVAL", time.Minute), "delay between two purges of expired user records. '0' disables it")
+	fs.DurationVar(&c.ExpiryGrace, "expiry_grace", varenv.LookupEnvOrDuration("SQUIDDB_EXPIRY_GRACE", 0), "how long a user record is still accepted after its expiration date")
+	fs.DurationVar(&c.ExpiryWindow, "expiry_window", varenv.LookupEnvOrDuration("SQUIDDB_EXPIRY_WINDOW", 24*time.Hour), "how far ahead users are reported as expiring soon by the squiddb_users_expiring_soon metric")
+	fs.StringVar(&c.digestRealms, "digest_realms", varenv.LookupEnvOrString("SQUIDDB_DIGEST_REALMS", ""), "comma separated list of realms digest HA1 values are computed for, when a password is set")
+	fs.BoolVar(&c.Debug, "debug", varenv.LookupEnvOrBool("SQUIDDB_DEBUG", false), "activate debug mode")
+	return c
 }
 
 func (cfg *Config) validate() error {
@@ -51,26 +104,26 @@ func (cfg *Config) logging() error {
 	return nil
 }
 
-// NewDefaultConfig reads configuration from environment variables and validates it
-func NewDefaultConfig() (*Config, error) {
-	log.Debug().Msg("logging configured")
-	cfg := new(Config)
-	err := envconfig.Process("", cfg)
-	if err != nil {
-		log.Err(errors.Wrap(err, "Failed to parse environment config"))
-		return nil, errors.Wrap(err, "Failed to parse environment config")
+// Load completes the configuration once its flags are parsed, validates it
+// and sets up logging.
+func (cfg *Config) Load() error {
+	cfg.DigestRealms = nil
+	for _, realm := range strings.Split(cfg.digestRealms, ",") {
+		if realm = strings.TrimSpace(realm); realm != "" {
+			cfg.DigestRealms = append(cfg.DigestRealms, realm)
+		}
 	}
-	err = cfg.validate()
+	err := cfg.validate()
 	if err != nil {
 		log.Err(errors.Wrap(err, "failed validation of config"))
-		return nil, errors.Wrap(err, "failed validation of config")
+		return errors.Wrap(err, "failed validation of config")
 	}
 	err = cfg.logging()
 	if err != nil {
 		log.Err(errors.Wrap(err, "failed setup logging based on config"))
-		return nil, errors.Wrap(err, "failed setup logging based on config")
+		return errors.Wrap(err, "failed setup logging based on config")
 	}
 	log.Debug().Msg("Configuration loaded")
 
-	return cfg, nil
+	return nil
 }
@@ -0,0 +1,51 @@
+//
+// conf_test.go
+// Copyright (C) 2024 rmelo <Ricardo Melo <rmelo@ludia.com>>
+//
+// Distributed under terms of the MIT license.
+//
+
+package conf
+
+import (
+	"errors"
+	"flag"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestLoad(t *testing.T) {
+	t.Setenv("SQUIDDB_PATH", "/tmp/env.json")
+	t.Setenv("SQUIDDB_REAP_INTERVAL", "5m")
+	t.Setenv("SQUIDDB_DIGEST_REALMS", "ignored")
+
+	fs := flag.NewFlagSet("server", flag.ContinueOnError)
+	c := RegisterFlags(fs)
+	if err := fs.Parse([]string{"-db_backend", "bolt", "-digest_realms", " proxy, ,squid proxy "}); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Load(); err != nil {
+		t.Fatalf("Load() error = %v", err)
+	}
+	if c.DbPath != "/tmp/env.json" || c.ReapInterval != 5*time.Minute {
+		t.Errorf("env defaults not used: db_path %q, reap_interval %s", c.DbPath, c.ReapInterval)
+	}
+	if c.Backend != "bolt" || c.Addr != ":8080" || c.ExpiryWindow != 24*time.Hour {
+		t.Errorf("unexpected config: backend %q, listen %q, expiry_window %s", c.Backend, c.Addr, c.ExpiryWindow)
+	}
+	if want := []string{"proxy", "squid proxy"}; !reflect.DeepEqual(c.DigestRealms, want) {
+		t.Errorf("DigestRealms = %q, want %q", c.DigestRealms, want)
+	}
+}
+
+func TestLoadInvalid(t *testing.T) {
+	fs := flag.NewFlagSet("server", flag.ContinueOnError)
+	c := RegisterFlags(fs)
+	if err := fs.Parse([]string{"-admin_user", ""}); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Load(); !errors.Is(err, ErrMissingEnvironmentAdminID) {
+		t.Errorf("Load() error = %v, want ErrMissingEnvironmentAdminID", err)
+	}
+}
@@ -0,0 +1,406 @@
+//
+// credentials.go
+// Copyright (C) 2024 rmelo <Ricardo Melo <rmelo@ludia.com>>
+//
+// Distributed under terms of the MIT license.
+//
+
+// Package to manage the credentials used to call the squid db service API.
+package credentials
+
+import (
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/cropalato/squid-vault-auth/internal/fsutil"
+	"github.com/cropalato/squid-vault-auth/internal/hash"
+	"github.com/rs/zerolog/log"
+)
+
+// Roles granted to API principals.
+const (
+	// RoleAdmin can do everything.
+	RoleAdmin = "admin"
+	// RoleVault can create, replace, patch and delete user records.
+	RoleVault = "vault"
+	// RoleHelper can verify credentials and read user records, e.g. to check groups.
+	RoleHelper = "helper"
+	// RoleReader can list and read user records, and scrape the metrics.
+	RoleReader = "reader"
+)
+
+var (
+	// ErrPrincipalNotFound the principal doesn't exist
+	ErrPrincipalNotFound = errors.New("principal not found")
+
+	// ErrPrincipalExists the principal already exists
+	ErrPrincipalExists = errors.New("principal already exist")
+
+	// ErrCertSubjectExists the cert_subject is already mapped to another principal
+	ErrCertSubjectExists = errors.New("cert_subject already used by another principal")
+)
+
+// ValidRole returns true if role is a known role.
+func ValidRole(role string) bool {
+	switch role {
+	case RoleAdmin, RoleVault, RoleHelper, RoleReader:
+		return true
+	}
+	return false
+}
+
+// Credential is an API account. Secret is a bcrypt hash.
+// An empty Role is the admin role.
+type Credential struct {
+	Username string `json:"username"`
+	Secret   string `json:"secret,omitempty"`
+	Role     string `json:"role,omitempty"`
+	// CertSubject authenticates the principal with a client certificate
+	// having this subject, e.g. 'CN=squid,O=Example', or this common name.
+	CertSubject string `json:"cert_subject,omitempty"`
+}
+
+// matchCert returns true if cert authenticates c, by its full subject or its
+// common name. dn is true if the full subject matched.
+func (c *Credential) matchCert(cert *x509.Certificate) (ok bool, dn bool) {
+	if c.CertSubject == "" {
+		return false, false
+	}
+	if c.CertSubject == cert.Subject.String() {
+		return true, true
+	}
+	return c.CertSubject == cert.Subject.CommonName, false
+}
+
+// overlapCertSubjects returns true if a certificate could match both a and
+// b, e.g. 'CN=squid,O=Example' and 'squid'.
+func overlapCertSubjects(a string, b string) bool {
+	if a == "" || b == "" {
+		return false
+	}
+	return a == b || subjectCN(a) == b || subjectCN(b) == a
+}
+
+// subjectCN returns the common name of a subject written as a distinguished
+// name, e.g. 'squid' for 'CN=squid,O=Example'. It returns an empty string if
+// subject has no CN attribute.
+func subjectCN(subject string) string {
+	var attr strings.Builder
+	escaped := false
+	for i := 0; i <= len(subject); i++ {
+		if i < len(subject) && (escaped || (subject[i] != ',' && subject[i] != '+')) {
+			escaped = !escaped && subject[i] == '\\'
+			attr.WriteByte(subject[i])
+			continue
+		}
+		if k, v, ok := strings.Cut(attr.String(), "="); ok && strings.EqualFold(strings.TrimSpace(k), "CN") {
+			return unescapeDN(v)
+		}
+		attr.Reset()
+	}
+	return ""
+}
+
+// unescapeDN decodes an attribute value of a distinguished name, escaped as
+// done by pkix.Name.String().
+func unescapeDN(v string) string {
+	var b strings.Builder
+	for i := 0; i < len(v); i++ {
+		if v[i] != '\\' || i+1 == len(v) {
+			b.WriteByte(v[i])
+			continue
+		}
+		if i+2 < len(v) {
+			if h, err := hex.DecodeString(v[i+1 : i+3]); err == nil {
+				b.Write(h)
+				i += 2
+				continue
+			}
+		}
+		i++
+		b.WriteByte(v[i])
+	}
+	return b.String()
+}
+
+// Store keeps the admin credential and the other API principals.
+// Rotated admin credentials are persisted in a file, and take precedence over
+// the configured ones on the next start. Principals are kept in their own
+// file, which can also be written by hand.
+type Store struct {
+	path           string
+	principalsPath string
+	admin          Credential
+	principals     map[string]Credential
+	// cost is the bcrypt cost of new secrets.
+	cost int
+	mu   sync.RWMutex
+}
+
+// Open loads the admin credential persisted in path, and the principals
+// kept in principalsPath. If the admin file doesn't exist, def is used until
+// the first rotation. A missing principals file means no other principal.
+func Open(path string, principalsPath string, def Credential) (*Store, error) {
+	def.Role = RoleAdmin
+	s := &Store{path: path, principalsPath: principalsPath, admin: def, principals: map[string]Credential{}, cost: hash.DefaultCost}
+	if err := s.loadPrincipals(); err != nil {
+		log.Err(err)
+		return nil, err
+	}
+	content, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return s, nil
+	}
+	if err != nil {
+		log.Err(err)
+		return nil, err
+	}
+	var c Credential
+	if err := json.Unmarshal(content, &c); err != nil {
+		log.Err(err)
+		return nil, fmt.Errorf("corrupt credential file %s: %w", path, err)
+	}
+	if c.Username == "" || c.Secret == "" {
+		return nil, fmt.Errorf("corrupt credential file %s: missing username or secret", path)
+	}
+	log.Info().Str("username", c.Username).Msg("using admin credential rotated through the API")
+	c.Role = RoleAdmin
+	s.admin = c
+	return s, nil
+}
+
+// loadPrincipals reads the principals file, if it exists.
+func (s *Store) loadPrincipals() error {
+	if s.principalsPath == "" {
+		return nil
+	}
+	content, err := os.ReadFile(s.principalsPath)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var list []Credential
+	if err := json.Unmarshal(content, &list); err != nil {
+		return fmt.Errorf("corrupt principals file %s: %w", s.principalsPath, err)
+	}
+	// a certificate must authenticate a single principal.
+	for i, c := range list {
+		for _, other := range list[:i] {
+			if overlapCertSubjects(c.CertSubject, other.CertSubject) {
+				return fmt.Errorf("corrupt principals file %s: %s and %s have overlapping cert_subject %q and %q", s.principalsPath, other.Username, c.Username, other.CertSubject, c.CertSubject)
+			}
+		}
+		if c.Username == "" || (c.Secret == "" && c.CertSubject == "") {
+			return fmt.Errorf("corrupt principals file %s: missing username, or secret and cert_subject", s.principalsPath)
+		}
+		if !ValidRole(c.Role) {
+			return fmt.Errorf("corrupt principals file %s: unknown role %q for %s", s.principalsPath, c.Role, c.Username)
+		}
+		s.principals[c.Username] = c
+	}
+	log.Info().Int("principals", len(list)).Str("path", s.principalsPath).Msg("loaded API principals")
+	return nil
+}
+
+// savePrincipals persists principals. The caller must hold the write lock.
+func (s *Store) savePrincipals(principals map[string]Credential) error {
+	if s.principalsPath == "" {
+		return errors.New("no principals file configured")
+	}
+	list := make([]Credential, 0, len(principals))
+	for _, c := range principals {
+		list = append(list, c)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Username < list[j].Username })
+	data, err := json.MarshalIndent(list, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := fsutil.WriteFileAtomic(s.principalsPath, data, 0o600); err != nil {
+		log.Err(err)
+		return err
+	}
+	s.principals = principals
+	return nil
+}
+
+// Username returns the admin username.
+func (s *Store) Username() string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.admin.Username
+}
+
+// Validate checks user and pass match the admin credential or a principal.
+// It returns the role of the principal.
+func (s *Store) Validate(user string, pass string) (string, error) {
+	s.mu.RLock()
+	c, ok := s.principals[user]
+	if user == s.admin.Username {
+		c, ok = s.admin, true
+	}
+	s.mu.RUnlock()
+	if !ok {
+		return "", fmt.Errorf("invalid User %s", user)
+	}
+	// principals authenticated by certificate only have no secret.
+	if c.Secret == "" || !hash.CheckPasswordHash(pass, c.Secret) {
+		return "", fmt.Errorf("invalid password for user %s", user)
+	}
+	return c.Role, nil
+}
+
+// ValidateCert returns the principal mapped to the subject of a verified
+// client certificate, and its role. A principal matching the full subject is
+// preferred to one matching the common name. Ambiguous matches are refused.
+func (s *Store) ValidateCert(cert *x509.Certificate) (string, string, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	var byDN, byCN []Credential
+	for _, c := range s.principals {
+		if ok, dn := c.matchCert(cert); ok && dn {
+			byDN = append(byDN, c)
+		} else if ok {
+			byCN = append(byCN, c)
+		}
+	}
+	matches := byDN
+	if len(matches) == 0 {
+		matches = byCN
+	}
+	switch len(matches) {
+	case 0:
+		return "", "", fmt.Errorf("no principal for certificate %s", cert.Subject)
+	case 1:
+		return matches[0].Username, matches[0].Role, nil
+	}
+	return "", "", fmt.Errorf("several principals for certificate %s", cert.Subject)
+}
+
+// Principals returns the principals other than the admin, without their secret.
+func (s *Store) Principals() []Credential {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	list := make([]Credential, 0, len(s.principals))
+	for _, c := range s.principals {
+		c.Secret = ""
+		list = append(list, c)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Username < list[j].Username })
+	return list
+}
+
+// SetPrincipal creates or replaces a principal, and persists it. The
+// principal authenticates with pass, or with a client certificate matching
+// certSubject, or both. certSubject can't match the certificates of another
+// principal, e.g. 'squid' when another principal has 'CN=squid,O=Example'.
+// It returns true if the principal was created.
+func (s *Store) SetPrincipal(user string, pass string, role string, certSubject string) (bool, error) {
+	if user == "" {
+		return false, errors.New("username cannot be empty")
+	}
+	if pass == "" && certSubject == "" {
+		return false, errors.New("password or cert_subject is required")
+	}
+	if !ValidRole(role) {
+		return false, fmt.Errorf("unknown role %q", role)
+	}
+	c := Credential{Username: user, Role: role, CertSubject: certSubject}
+	if pass != "" {
+		var err error
+		if c.Secret, err = hash.HashPasswordCost(pass, s.cost); err != nil {
+			return false, err
+		}
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if user == s.admin.Username {
+		return false, ErrPrincipalExists
+	}
+	for _, other := range s.principals {
+		if other.Username != user && overlapCertSubjects(certSubject, other.CertSubject) {
+			return false, ErrCertSubjectExists
+		}
+	}
+	principals := s.copyPrincipals()
+	_, exists := principals[user]
+	principals[user] = c
+	return !exists, s.savePrincipals(principals)
+}
+
+// DeletePrincipal removes a principal, and persists the change.
+func (s *Store) DeletePrincipal(user string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	principals := s.copyPrincipals()
+	if _, ok := principals[user]; !ok {
+		return ErrPrincipalNotFound
+	}
+	delete(principals, user)
+	return s.savePrincipals(principals)
+}
+
+// copyPrincipals returns a copy of the principals, so failed saves leave them unchanged.
+func (s *Store) copyPrincipals() map[string]Credential {
+	principals := make(map[string]Credential, len(s.principals))
+	for k, v := range s.principals {
+		principals[k] = v
+	}
+	return principals
+}
+
+// Rotate replaces the credential of current, the admin or a principal, and
+// persists it. An empty user keeps the current username.
+// It returns the new username.
+func (s *Store) Rotate(current string, user string, pass string) (string, error) {
+	if pass == "" {
+		return "", errors.New("password cannot be empty")
+	}
+	secret, err := hash.HashPasswordCost(pass, s.cost)
+	if err != nil {
+		return "", err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if user == "" {
+		user = current
+	}
+	if _, taken := s.principals[user]; taken && user != current {
+		return "", ErrPrincipalExists
+	}
+	if current != s.admin.Username {
+		principals := s.copyPrincipals()
+		c, ok := principals[current]
+		if !ok {
+			return "", ErrPrincipalNotFound
+		}
+		if user == s.admin.Username {
+			return "", ErrPrincipalExists
+		}
+		delete(principals, current)
+		principals[user] = Credential{Username: user, Secret: secret, Role: c.Role, CertSubject: c.CertSubject}
+		return user, s.savePrincipals(principals)
+	}
+	c := Credential{Username: user, Secret: secret}
+	data, err := json.MarshalIndent(c, "", "  ")
+	if err != nil {
+		return "", err
+	}
+	if err := fsutil.WriteFileAtomic(s.path, data, 0o600); err != nil {
+		log.Err(err)
+		return "", err
+	}
+	c.Role = RoleAdmin
+	s.admin = c
+	return user, nil
+}
@@ -0,0 +1,165 @@
+//
+// credentials_test.go
+// Copyright (C) 2024 rmelo <Ricardo Melo <rmelo@ludia.com>>
+//
+// Distributed under terms of the MIT license.
+//
+
+package credentials
+
+import (
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+func newTestStore(t *testing.T) (*Store, string, string, Credential) {
+	t.Helper()
+	secret, err := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	path, principalsPath := filepath.Join(dir, "admin"), filepath.Join(dir, "principals")
+	def := Credential{Username: "admin", Secret: string(secret)}
+	return reopen(t, path, principalsPath, def), path, principalsPath, def
+}
+
+func TestRotateAdmin(t *testing.T) {
+	s, path, principalsPath, def := newTestStore(t)
+	if _, err := s.Rotate("admin", "", ""); err == nil {
+		t.Fatal("an empty password must be refused")
+	}
+	if _, err := s.Validate("admin", "secret"); err != nil {
+		t.Fatalf("a refused rotation must keep the credential, got %v", err)
+	}
+
+	user, err := s.Rotate("admin", "root", "rotated")
+	if err != nil || user != "root" {
+		t.Fatalf("unexpected rotation result %s, %v", user, err)
+	}
+	for _, s := range []*Store{s, reopen(t, path, principalsPath, def)} {
+		if _, err := s.Validate("admin", "secret"); err == nil {
+			t.Fatal("the old credential must be refused after a rotation")
+		}
+		if _, err := s.Validate("root", "secret"); err == nil {
+			t.Fatal("the old password must be refused after a rotation")
+		}
+		if role, err := s.Validate("root", "rotated"); err != nil || role != RoleAdmin {
+			t.Fatalf("expected the rotated credential to be admin, got %s, %v", role, err)
+		}
+	}
+}
+
+func TestRotatePrincipal(t *testing.T) {
+	s, path, principalsPath, def := newTestStore(t)
+	if _, err := s.SetPrincipal("squid", "old", RoleHelper, ""); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Rotate("squid", "admin", "x"); err == nil {
+		t.Fatal("a principal must not take the admin username")
+	}
+	if _, err := s.Rotate("squid", "", "rotated"); err != nil {
+		t.Fatal(err)
+	}
+	s = reopen(t, path, principalsPath, def)
+	if _, err := s.Validate("squid", "old"); err == nil {
+		t.Fatal("the old password must be refused after a rotation")
+	}
+	if role, err := s.Validate("squid", "rotated"); err != nil || role != RoleHelper {
+		t.Fatalf("expected the rotated principal to keep its role, got %s, %v", role, err)
+	}
+}
+
+func TestDuplicateCertSubject(t *testing.T) {
+	s, path, principalsPath, def := newTestStore(t)
+	if _, err := s.SetPrincipal("squid", "", RoleHelper, "CN=squid"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.SetPrincipal("other", "", RoleAdmin, "CN=squid"); !errors.Is(err, ErrCertSubjectExists) {
+		t.Fatalf("expected ErrCertSubjectExists, got %v", err)
+	}
+	// a principal can be replaced with its own cert_subject.
+	if _, err := s.SetPrincipal("squid", "", RoleReader, "CN=squid"); err != nil {
+		t.Fatal(err)
+	}
+	if p := reopen(t, path, principalsPath, def).Principals(); len(p) != 1 || p[0].Role != RoleReader {
+		t.Fatalf("unexpected principals %+v", p)
+	}
+
+	content := `[{"username": "a", "cert_subject": "CN=squid", "role": "helper"}, {"username": "b", "cert_subject": "CN=squid", "role": "admin"}]`
+	if err := os.WriteFile(principalsPath, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Open(path, principalsPath, def); err == nil {
+		t.Fatal("a principals file with duplicate cert_subject values must be refused")
+	}
+}
+
+func TestOverlappingCertSubjects(t *testing.T) {
+	s, path, principalsPath, def := newTestStore(t)
+	if _, err := s.SetPrincipal("squid", "", RoleHelper, "CN=squid,O=Example"); err != nil {
+		t.Fatal(err)
+	}
+	// a certificate with the subject CN=squid,O=Example matches both.
+	for _, subject := range []string{"squid", "CN=squid,O=Example"} {
+		if _, err := s.SetPrincipal("other", "", RoleAdmin, subject); !errors.Is(err, ErrCertSubjectExists) {
+			t.Errorf("%s: expected ErrCertSubjectExists, got %v", subject, err)
+		}
+	}
+	// other organizations can't match the same certificates.
+	if _, err := s.SetPrincipal("other", "", RoleReader, "CN=squid,O=Other"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.SetPrincipal("escaped", "", RoleReader, `CN=proxy\, inc,O=Example`); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.SetPrincipal("cn", "", RoleReader, "proxy, inc"); !errors.Is(err, ErrCertSubjectExists) {
+		t.Errorf("expected ErrCertSubjectExists for an escaped common name, got %v", err)
+	}
+
+	content := `[{"username": "a", "cert_subject": "squid", "role": "helper"}, {"username": "b", "cert_subject": "CN=squid,O=Example", "role": "admin"}]`
+	if err := os.WriteFile(principalsPath, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Open(path, principalsPath, def); err == nil {
+		t.Fatal("a principals file with overlapping cert_subject values must be refused")
+	}
+}
+
+func TestValidateCert(t *testing.T) {
+	s, _, _, _ := newTestStore(t)
+	cert := &x509.Certificate{Subject: pkix.Name{CommonName: "squid", Organization: []string{"Example"}}}
+	// overlapping principals, as written before they were refused.
+	s.principals = map[string]Credential{
+		"dn": {Username: "dn", Role: RoleHelper, CertSubject: "CN=squid,O=Example"},
+		"cn": {Username: "cn", Role: RoleAdmin, CertSubject: "squid"},
+	}
+	for i := 0; i < 10; i++ {
+		if user, role, err := s.ValidateCert(cert); err != nil || user != "dn" || role != RoleHelper {
+			t.Fatalf("ValidateCert() = %s, %s, %v, want the full subject match", user, role, err)
+		}
+	}
+	s.principals = map[string]Credential{
+		"a": {Username: "a", Role: RoleHelper, CertSubject: "squid"},
+		"b": {Username: "b", Role: RoleAdmin, CertSubject: "squid"},
+	}
+	if _, _, err := s.ValidateCert(cert); err == nil {
+		t.Fatal("an ambiguous certificate must be refused")
+	}
+}
+
+func reopen(t *testing.T, path string, principalsPath string, def Credential) *Store {
+	t.Helper()
+	s, err := Open(path, principalsPath, def)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.cost = bcrypt.MinCost
+	return s
+}
@@ -0,0 +1,316 @@
+//
+// tokens.go
+// Copyright (C) 2024 rmelo <Ricardo Melo <rmelo@ludia.com>>
+//
+// Distributed under terms of the MIT license.
+//
+
+package credentials
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cropalato/squid-vault-auth/internal/fsutil"
+	"github.com/rs/zerolog/log"
+)
+
+// tokenPrefix starts every token, so they are easy to spot in logs and configs.
+const tokenPrefix = "sqdb_"
+
+// lastUsedPrecision is how often the last-used timestamp of a token is persisted.
+const lastUsedPrecision = time.Minute
+
+// errUnchanged a change of the tokens didn't change anything, so nothing is written.
+var errUnchanged = errors.New("tokens unchanged")
+
+var (
+	// ErrTokenNotFound the token doesn't exist
+	ErrTokenNotFound = errors.New("token not found")
+
+	// ErrInvalidToken the token is unknown or expired
+	ErrInvalidToken = errors.New("invalid token")
+)
+
+// Token is an API bearer token. Only the sha256 digest of its secret is kept.
+// ExpiresAt and LastUsed are unix timestamps, 0 meaning never.
+type Token struct {
+	ID        string   `json:"id"`
+	Name      string   `json:"name"`
+	Scopes    []string `json:"scopes"`
+	CreatedBy string   `json:"created_by,omitempty"`
+	CreatedAt int64    `json:"created_at"`
+	ExpiresAt int64    `json:"expires_at"`
+	LastUsed  int64    `json:"last_used"`
+	Digest    string   `json:"digest,omitempty"`
+}
+
+// IsExpired returns true if the token expiration date is before now.
+func (t *Token) IsExpired(now time.Time) bool {
+	return t.ExpiresAt > 0 && !now.Before(time.Unix(t.ExpiresAt, 0))
+}
+
+// TokenStore keeps the API tokens in a file.
+// Checking a token is a sha256 digest and a map lookup, much cheaper than bcrypt.
+// Last uses are recorded in memory, and persisted by Run.
+type TokenStore struct {
+	path string
+	// tokens are indexed by digest.
+	tokens map[string]Token
+	// dirty is true when last uses aren't persisted yet.
+	dirty bool
+	mu    sync.Mutex
+	// saveMu serializes the writes of the file, which are done without
+	// holding mu so authentications don't wait for the disk.
+	saveMu sync.Mutex
+}
+
+// OpenTokens loads the tokens kept in path. A missing file means no token.
+func OpenTokens(path string) (*TokenStore, error) {
+	s := &TokenStore{path: path, tokens: map[string]Token{}}
+	content, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return s, nil
+	}
+	if err != nil {
+		log.Err(err)
+		return nil, err
+	}
+	var list []Token
+	if err := json.Unmarshal(content, &list); err != nil {
+		log.Err(err)
+		return nil, fmt.Errorf("corrupt token file %s: %w", path, err)
+	}
+	for _, t := range list {
+		if t.ID == "" || t.Digest == "" {
+			return nil, fmt.Errorf("corrupt token file %s: missing id or digest", path)
+		}
+		s.tokens[t.Digest] = t
+	}
+	log.Info().Int("tokens", len(list)).Str("path", path).Msg("loaded API tokens")
+	return s, nil
+}
+
+// digest returns the hex sha256 digest of a token secret.
+func digest(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+// randomString returns n random bytes, encoded with enc.
+func randomString(n int, enc func([]byte) string) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return enc(b), nil
+}
+
+// Issue creates a token. It returns the token, and its secret which isn't
+// kept anywhere: it can't be retrieved later.
+func (s *TokenStore) Issue(name string, scopes []string, expiresAt time.Time, createdBy string, now time.Time) (Token, string, error) {
+	id, err := randomString(8, hex.EncodeToString)
+	if err != nil {
+		return Token{}, "", err
+	}
+	secret, err := randomString(32, base64.RawURLEncoding.EncodeToString)
+	if err != nil {
+		return Token{}, "", err
+	}
+	secret = tokenPrefix + secret
+	t := Token{ID: id, Name: name, Scopes: append([]string{}, scopes...), CreatedBy: createdBy, CreatedAt: now.Unix(), Digest: digest(secret)}
+	if !expiresAt.IsZero() {
+		t.ExpiresAt = expiresAt.Unix()
+	}
+	err = s.update(func(tokens map[string]Token) error {
+		tokens[t.Digest] = t
+		return nil
+	})
+	if err != nil {
+		return Token{}, "", err
+	}
+	t.Digest = ""
+	return t, secret, nil
+}
+
+// Authenticate returns the token matching secret, and records its use in memory.
+// Unknown and expired tokens return ErrInvalidToken.
+func (s *TokenStore) Authenticate(secret string, now time.Time) (Token, error) {
+	if !strings.HasPrefix(secret, tokenPrefix) {
+		return Token{}, ErrInvalidToken
+	}
+	d := digest(secret)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	t, ok := s.tokens[d]
+	if !ok || t.IsExpired(now) {
+		return Token{}, ErrInvalidToken
+	}
+	t.LastUsed = now.Unix()
+	s.tokens[d] = t
+	s.dirty = true
+	t.Digest = ""
+	return t, nil
+}
+
+// List returns all tokens without their digest. Expired tokens are listed
+// until Prune deletes them.
+func (s *TokenStore) List() []Token {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	list := make([]Token, 0, len(s.tokens))
+	for _, t := range s.tokens {
+		t.Digest = ""
+		list = append(list, t)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].CreatedAt != list[j].CreatedAt {
+			return list[i].CreatedAt < list[j].CreatedAt
+		}
+		return list[i].ID < list[j].ID
+	})
+	return list
+}
+
+// Revoke deletes the token with the given id.
+func (s *TokenStore) Revoke(id string) error {
+	return s.update(func(tokens map[string]Token) error {
+		for d, t := range tokens {
+			if t.ID == id {
+				delete(tokens, d)
+				return nil
+			}
+		}
+		return ErrTokenNotFound
+	})
+}
+
+// Prune deletes the tokens expired at now, and returns how many were deleted.
+func (s *TokenStore) Prune(now time.Time) (int, error) {
+	pruned := 0
+	err := s.update(func(tokens map[string]Token) error {
+		for d, t := range tokens {
+			if t.IsExpired(now) {
+				delete(tokens, d)
+				pruned++
+			}
+		}
+		if pruned == 0 {
+			return errUnchanged
+		}
+		return nil
+	})
+	return pruned, err
+}
+
+// Flush persists the last uses recorded since the previous flush.
+func (s *TokenStore) Flush() error {
+	s.mu.Lock()
+	dirty := s.dirty
+	s.dirty = false
+	s.mu.Unlock()
+	if !dirty {
+		return nil
+	}
+	err := s.update(func(map[string]Token) error { return nil })
+	if err != nil {
+		s.mu.Lock()
+		s.dirty = true
+		s.mu.Unlock()
+	}
+	return err
+}
+
+// Run prunes expired tokens and persists last uses every lastUsedPrecision,
+// until ctx is done. Last uses are flushed one last time before returning.
+func (s *TokenStore) Run(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			if err := s.Flush(); err != nil {
+				log.Err(err).Msg("failed recording token uses")
+			}
+			return
+		case now := <-time.After(lastUsedPrecision):
+			if pruned, err := s.Prune(now); err != nil {
+				log.Err(err).Msg("failed pruning expired tokens")
+			} else if pruned > 0 {
+				log.Info().Int("tokens", pruned).Msg("pruned expired tokens")
+			}
+			if err := s.Flush(); err != nil {
+				log.Err(err).Msg("failed recording token uses")
+			}
+		}
+	}
+}
+
+// copyTokens returns a copy of the tokens, so failed saves leave them unchanged.
+func (s *TokenStore) copyTokens() map[string]Token {
+	tokens := make(map[string]Token, len(s.tokens))
+	for k, v := range s.tokens {
+		tokens[k] = v
+	}
+	return tokens
+}
+
+// update applies change to a copy of the tokens, persists it and installs it.
+// Nothing is written if change returns an error, and errUnchanged isn't
+// reported. The file is written without holding mu.
+func (s *TokenStore) update(change func(tokens map[string]Token) error) error {
+	s.saveMu.Lock()
+	defer s.saveMu.Unlock()
+	s.mu.Lock()
+	tokens := s.copyTokens()
+	err := change(tokens)
+	s.mu.Unlock()
+	if errors.Is(err, errUnchanged) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if err := s.save(tokens); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	// last uses recorded while writing are kept in memory, and still dirty.
+	for d, t := range tokens {
+		if cur, ok := s.tokens[d]; ok && cur.LastUsed > t.LastUsed {
+			t.LastUsed = cur.LastUsed
+			tokens[d] = t
+		}
+	}
+	s.tokens = tokens
+	return nil
+}
+
+// save writes tokens to the file. The caller must hold saveMu.
+func (s *TokenStore) save(tokens map[string]Token) error {
+	list := make([]Token, 0, len(tokens))
+	for _, t := range tokens {
+		list = append(list, t)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].ID < list[j].ID })
+	data, err := json.MarshalIndent(list, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := fsutil.WriteFileAtomic(s.path, data, 0o600); err != nil {
+		log.Err(err)
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,109 @@
+//
+// tokens_test.go
+// Copyright (C) 2024 rmelo <Ricardo Melo <rmelo@ludia.com>>
+//
+// Distributed under terms of the MIT license.
+//
+
+package credentials
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestTokenLastUsed(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "tokens.json")
+	s, err := OpenTokens(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	issued, secret, err := s.Issue("squid", []string{"verify"}, time.Time{}, "admin", now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	saved, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the last use is recorded in memory only.
+	used := now.Add(time.Second)
+	if tok, err := s.Authenticate(secret, used); err != nil || tok.ID != issued.ID || tok.LastUsed != used.Unix() {
+		t.Fatalf("Authenticate() = %+v, %v", tok, err)
+	}
+	if content, _ := os.ReadFile(path); !bytes.Equal(content, saved) {
+		t.Error("Authenticate() wrote the token file")
+	}
+	if list := s.List(); list[0].LastUsed != used.Unix() {
+		t.Errorf("last use = %d, want %d", list[0].LastUsed, used.Unix())
+	}
+
+	// it is persisted by Flush, or when the store stops running.
+	if err := s.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if list := reopenTokens(t, path).List(); list[0].LastUsed != used.Unix() {
+		t.Errorf("persisted last use = %d, want %d", list[0].LastUsed, used.Unix())
+	}
+	used = used.Add(time.Second)
+	if _, err := s.Authenticate(secret, used); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	s.Run(ctx)
+	if list := reopenTokens(t, path).List(); list[0].LastUsed != used.Unix() {
+		t.Errorf("last use persisted by Run = %d, want %d", list[0].LastUsed, used.Unix())
+	}
+
+	if _, err := s.Authenticate(secret+"x", used); !errors.Is(err, ErrInvalidToken) {
+		t.Errorf("Authenticate() of a wrong secret error = %v, want ErrInvalidToken", err)
+	}
+}
+
+func TestTokenPrune(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "tokens.json")
+	s, err := OpenTokens(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	for name, expiresAt := range map[string]time.Time{"expired": now.Add(-time.Minute), "valid": now.Add(time.Hour), "forever": {}} {
+		if _, _, err := s.Issue(name, []string{"verify"}, expiresAt, "admin", now.Add(-time.Hour)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if pruned, err := s.Prune(now); err != nil || pruned != 1 {
+		t.Fatalf("Prune() = %d, %v, want 1", pruned, err)
+	}
+	for _, list := range [][]Token{s.List(), reopenTokens(t, path).List()} {
+		if len(list) != 2 {
+			t.Fatalf("got %d tokens, want 2", len(list))
+		}
+		for _, tok := range list {
+			if tok.Name == "expired" {
+				t.Errorf("expired token wasn't pruned")
+			}
+		}
+	}
+	if pruned, err := s.Prune(now); err != nil || pruned != 0 {
+		t.Errorf("second Prune() = %d, %v, want 0", pruned, err)
+	}
+}
+
+func reopenTokens(t *testing.T, path string) *TokenStore {
+	t.Helper()
+	s, err := OpenTokens(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
@@ -0,0 +1,171 @@
+//
+// bolt_store.go
+// Copyright (C) 2024 rmelo <Ricardo Melo <rmelo@ludia.com>>
+//
+// Distributed under terms of the MIT license.
+//
+
+package db
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/cropalato/squid-vault-auth/internal/fsutil"
+	"github.com/rs/zerolog/log"
+	bolt "go.etcd.io/bbolt"
+)
+
+// usersBucket is the bolt bucket holding user records, indexed by username.
+var usersBucket = []byte("users")
+
+// BoltStore keeps user records in an embedded bolt database.
+// Every change only writes the modified record.
+type BoltStore struct {
+	db *bolt.DB
+}
+
+// NewBoltStore opens the bolt database at path, creating it if needed.
+// It fails if another process holds the database.
+func NewBoltStore(path string) (*BoltStore, error) {
+	b, err := bolt.Open(path, 0o600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		log.Err(err)
+		return nil, fmt.Errorf("failed opening bolt database %s: %w", path, err)
+	}
+	err = b.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(usersBucket)
+		return err
+	})
+	if err != nil {
+		_ = b.Close()
+		return nil, err
+	}
+	return &BoltStore{db: b}, nil
+}
+
+// Get returns a user record.
+func (s *BoltStore) Get(user string) (*UserRecord, error) {
+	var u UserRecord
+	err := s.db.View(func(tx *bolt.Tx) error {
+		v := tx.Bucket(usersBucket).Get([]byte(user))
+		if v == nil {
+			return ErrUserNotFound
+		}
+		return json.Unmarshal(v, &u)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &u, nil
+}
+
+// List returns all user records ordered by username.
+func (s *BoltStore) List() ([]UserRecord, error) {
+	var users []UserRecord
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(usersBucket).ForEach(func(_, v []byte) error {
+			var u UserRecord
+			if err := json.Unmarshal(v, &u); err != nil {
+				return err
+			}
+			users = append(users, u)
+			return nil
+		})
+	})
+	return users, err
+}
+
+// Add insert new user record.
+func (s *BoltStore) Add(ur UserRecord) error {
+	return s.put(ur, false)
+}
+
+// Update replaces an existing user record.
+func (s *BoltStore) Update(ur UserRecord) error {
+	return s.put(ur, true)
+}
+
+// put writes ur, checking the record exists or not according to exists.
+func (s *BoltStore) put(ur UserRecord, exists bool) (err error) {
+	defer func(start time.Time) { observeSave(BackendBolt, start, err) }(time.Now())
+	data, err := json.Marshal(ur)
+	if err != nil {
+		return err
+	}
+	return s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(usersBucket)
+		found := b.Get([]byte(ur.Username)) != nil
+		switch {
+		case exists && !found:
+			return ErrUserNotFound
+		case !exists && found:
+			return ErrUserExists
+		}
+		return b.Put([]byte(ur.Username), data)
+	})
+}
+
+// Delete removes a user record.
+func (s *BoltStore) Delete(user string) (err error) {
+	defer func(start time.Time) { observeSave(BackendBolt, start, err) }(time.Now())
+	return s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(usersBucket)
+		if b.Get([]byte(user)) == nil {
+			return ErrUserNotFound
+		}
+		return b.Delete([]byte(user))
+	})
+}
+
+// DeleteMany removes the records of users in a single transaction.
+func (s *BoltStore) DeleteMany(users []string) (deleted []string, err error) {
+	defer func(start time.Time) { observeSave(BackendBolt, start, err) }(time.Now())
+	err = s.db.Update(func(tx *bolt.Tx) error {
+		deleted = nil
+		b := tx.Bucket(usersBucket)
+		for _, user := range users {
+			if b.Get([]byte(user)) == nil {
+				continue
+			}
+			if err := b.Delete([]byte(user)); err != nil {
+				return err
+			}
+			deleted = append(deleted, user)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return deleted, nil
+}
+
+// Ping makes sure the database is open, and holds the users bucket.
+func (s *BoltStore) Ping() error {
+	return s.db.View(func(tx *bolt.Tx) error {
+		if tx.Bucket(usersBucket) == nil {
+			return errors.New("missing users bucket")
+		}
+		return nil
+	})
+}
+
+// Check makes sure the database is open, not read-only, and its file can be
+// opened for writing. Nothing is written, so it doesn't wait for the writers.
+func (s *BoltStore) Check() error {
+	if err := s.Ping(); err != nil {
+		return err
+	}
+	if s.db.IsReadOnly() {
+		return errors.New("database is opened read-only")
+	}
+	return fsutil.CheckWritable(s.db.Path())
+}
+
+// Close releases the bolt database.
+func (s *BoltStore) Close() error {
+	return s.db.Close()
+}
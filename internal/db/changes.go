@@ -0,0 +1,60 @@
+//
+// changes.go
+// Copyright (C) 2024 rmelo <Ricardo Melo <rmelo@ludia.com>>
+//
+// Distributed under terms of the MIT license.
+//
+
+package db
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"sync"
+)
+
+// changeLogSize is how many changes are remembered by a ChangeLog.
+const changeLogSize = 4096
+
+// ChangeLog remembers the users changed recently, so clients caching user
+// records can evict them. Each change increments the revision.
+// The log lives in memory: Epoch changes every time the service restarts.
+type ChangeLog struct {
+	Epoch    string
+	revision uint64
+	users    []string
+	mu       sync.Mutex
+}
+
+// NewChangeLog creates an empty change log with a random epoch.
+func NewChangeLog() *ChangeLog {
+	b := make([]byte, 8)
+	_, _ = rand.Read(b)
+	return &ChangeLog{Epoch: hex.EncodeToString(b)}
+}
+
+// Record appends the changed users to the log.
+func (c *ChangeLog) Record(users ...string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, u := range users {
+		c.revision++
+		c.users = append(c.users, u)
+	}
+	if len(c.users) > changeLogSize {
+		c.users = append([]string{}, c.users[len(c.users)-changeLogSize:]...)
+	}
+}
+
+// Since returns the users changed after revision rev, and the current revision.
+// reset is true if the changes after rev are no longer known, and clients must
+// forget everything they cached.
+func (c *ChangeLog) Since(rev uint64) (users []string, current uint64, reset bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	oldest := c.revision - uint64(len(c.users))
+	if rev > c.revision || rev < oldest {
+		return nil, c.revision, true
+	}
+	return append([]string{}, c.users[rev-oldest:]...), c.revision, false
+}
@@ -0,0 +1,53 @@
+//
+// changes_test.go
+// Copyright (C) 2024 rmelo <Ricardo Melo <rmelo@ludia.com>>
+//
+// Distributed under terms of the MIT license.
+//
+
+package db
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestChangeLog(t *testing.T) {
+	c := NewChangeLog()
+	if users, rev, reset := c.Since(0); len(users) != 0 || rev != 0 || reset {
+		t.Fatalf("expected an empty log, got %v, %d, %v", users, rev, reset)
+	}
+	c.Record("bob", "alice")
+	c.Record("bob")
+	users, rev, reset := c.Since(0)
+	if strings.Join(users, ",") != "bob,alice,bob" || rev != 3 || reset {
+		t.Fatalf("unexpected changes %v, %d, %v", users, rev, reset)
+	}
+	if users, _, _ := c.Since(2); strings.Join(users, ",") != "bob" {
+		t.Fatalf("expected the changes after revision 2, got %v", users)
+	}
+	if users, rev, reset := c.Since(3); len(users) != 0 || rev != 3 || reset {
+		t.Fatalf("expected no change after the current revision, got %v, %d, %v", users, rev, reset)
+	}
+	// a revision from the future comes from another epoch.
+	if _, rev, reset := c.Since(4); !reset || rev != 3 {
+		t.Fatalf("expected a reset for an unknown revision, got %d, %v", rev, reset)
+	}
+	if NewChangeLog().Epoch == c.Epoch {
+		t.Fatal("each change log must have its own epoch")
+	}
+}
+
+func TestChangeLogOverflow(t *testing.T) {
+	c := NewChangeLog()
+	for i := 0; i < changeLogSize+10; i++ {
+		c.Record("bob")
+	}
+	if _, rev, reset := c.Since(5); !reset || rev != changeLogSize+10 {
+		t.Fatalf("expected a reset for a forgotten revision, got %d, %v", rev, reset)
+	}
+	users, _, reset := c.Since(10)
+	if reset || len(users) != changeLogSize {
+		t.Fatalf("expected the %d last changes, got %d, %v", changeLogSize, len(users), reset)
+	}
+}
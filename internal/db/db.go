@@ -5,137 +5,384 @@
 // Distributed under terms of the MIT license.
 //
 
-// Package to manage json file with user records.
+// Package to manage the user records database.
 package db
 
 import (
+	"bytes"
 	"encoding/json"
 	"errors"
-	"os"
+	"fmt"
+	"slices"
 	"sync"
+	"time"
 
 	"github.com/cropalato/squid-vault-auth/internal/conf"
+	"github.com/cropalato/squid-vault-auth/internal/hash"
 	"github.com/rs/zerolog/log"
 )
 
+var (
+	// ErrUserNotFound the user record doesn't exist
+	ErrUserNotFound = errors.New("user not found")
+
+	// ErrUserExists the user record already exists
+	ErrUserExists = errors.New("user already exist")
+
+	// ErrClosed the database was closed
+	ErrClosed = errors.New("database is closed")
+)
+
 type Database struct {
-	Cfg   *conf.Config
-	Users []UserRecord
+	Cfg     *conf.Config
+	Changes *ChangeLog
+	store   Store
 	sync.Mutex
 }
 
 type UserRecord struct {
 	Username string   `json:"username"`
-	Password string   `json:"password"`
+	Password string   `json:"password,omitempty"`
 	Groups   []string `json:"groups"`
 	ExpDate  int64    `json:"exp_date"`
+	Disabled bool     `json:"disabled,omitempty"`
+	// HA1 holds the digest HA1 of the password, per realm.
+	HA1 map[string]string `json:"ha1,omitempty"`
 }
 
-// NewBD load json file.
-// If file doesn't exist, we will create the file.
-func NewBD(c *conf.Config) (*Database, error) {
-	log.Debug().Msg("Creating database object")
-	if _, err := os.Stat(c.DbPath); err != nil {
-		log.Debug().Msg("database file doesn't exist. Creating file " + c.DbPath)
-		err := os.WriteFile(c.DbPath, []byte("[]"), 0o600)
+// UserPatch holds a partial update of a user record, decoded from a JSON
+// merge patch (RFC 7396). Nil fields are left unchanged, and fields set to
+// null in the patch are reset to their default value.
+// AddGroups and RemoveGroups change the groups of the record in place, so
+// concurrent changes of its other groups aren't lost.
+type UserPatch struct {
+	Password     *string   `json:"password,omitempty"`
+	Groups       *[]string `json:"groups,omitempty"`
+	AddGroups    *[]string `json:"add_groups,omitempty"`
+	RemoveGroups *[]string `json:"remove_groups,omitempty"`
+	ExpDate      *int64    `json:"exp_date,omitempty"`
+	Disabled     *bool     `json:"disabled,omitempty"`
+	// HA1 is never read from requests, it is computed from Password.
+	HA1 *map[string]string `json:"-"`
+}
+
+// UnmarshalJSON decodes a JSON merge patch, where null resets a field.
+// The password cannot be removed.
+func (p *UserPatch) UnmarshalJSON(data []byte) error {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return err
+	}
+	for name, v := range fields {
+		null := bytes.Equal(bytes.TrimSpace(v), []byte("null"))
+		var err error
+		switch name {
+		case "password":
+			if null {
+				return errors.New("password cannot be removed")
+			}
+			p.Password = new(string)
+			err = json.Unmarshal(v, p.Password)
+		case "groups":
+			p.Groups = &[]string{}
+			if !null {
+				err = json.Unmarshal(v, p.Groups)
+			}
+		case "add_groups":
+			p.AddGroups = &[]string{}
+			if !null {
+				err = json.Unmarshal(v, p.AddGroups)
+			}
+		case "remove_groups":
+			p.RemoveGroups = &[]string{}
+			if !null {
+				err = json.Unmarshal(v, p.RemoveGroups)
+			}
+		case "exp_date":
+			p.ExpDate = new(int64)
+			err = json.Unmarshal(v, p.ExpDate)
+		case "disabled":
+			p.Disabled = new(bool)
+			err = json.Unmarshal(v, p.Disabled)
+		}
 		if err != nil {
-			log.Panic().Err(err)
+			return fmt.Errorf("invalid %s: %w", name, err)
 		}
 	}
-	log.Debug().Msg("Created database object")
-	return &Database{Cfg: c, Users: nil}, nil
+	return nil
 }
 
-// LoadDatabase read and parse json file.
-func (d *Database) LoadDatabase() error {
-	d.Lock()
-	defer d.Unlock()
-	content, err := os.ReadFile(d.Cfg.DbPath)
-	if err != nil {
-		log.Err(err)
-		return err
+// Apply updates ur with the fields set in p.
+// Groups are replaced first, then RemoveGroups and AddGroups are applied.
+func (p *UserPatch) Apply(ur *UserRecord) {
+	if p.Password != nil {
+		ur.Password = *p.Password
 	}
-	err = json.Unmarshal(content, &d.Users)
-	if err != nil {
-		log.Err(err)
-		return err
+	if p.Groups != nil {
+		ur.Groups = append([]string{}, *p.Groups...)
+	}
+	if p.RemoveGroups != nil || p.AddGroups != nil {
+		groups := []string{}
+		for _, g := range ur.Groups {
+			if p.RemoveGroups == nil || !slices.Contains(*p.RemoveGroups, g) {
+				groups = append(groups, g)
+			}
+		}
+		if p.AddGroups != nil {
+			for _, g := range *p.AddGroups {
+				if !slices.Contains(groups, g) {
+					groups = append(groups, g)
+				}
+			}
+		}
+		ur.Groups = groups
+	}
+	if p.ExpDate != nil {
+		ur.ExpDate = *p.ExpDate
+	}
+	if p.Disabled != nil {
+		ur.Disabled = *p.Disabled
+	}
+	if p.HA1 != nil {
+		ur.HA1 = *p.HA1
 	}
-	return nil
 }
 
-// SaveDatabase upgrade json file.
-func (d *Database) SaveDatabase() error {
-	file, err := json.MarshalIndent(d.Users, "", "  ")
-	if err != nil {
-		log.Err(err)
-		return err
+// Fields returns the names of the fields set in p, so changes can be logged
+// without their values.
+func (p *UserPatch) Fields() []string {
+	fields := []string{}
+	for name, set := range map[string]bool{
+		"password":      p.Password != nil,
+		"groups":        p.Groups != nil,
+		"add_groups":    p.AddGroups != nil,
+		"remove_groups": p.RemoveGroups != nil,
+		"exp_date":      p.ExpDate != nil,
+		"disabled":      p.Disabled != nil,
+	} {
+		if set {
+			fields = append(fields, name)
+		}
 	}
-	if err := os.WriteFile(d.Cfg.DbPath, file, 0o600); err != nil {
-		log.Err(err)
-		return err
+	slices.Sort(fields)
+	return fields
+}
+
+// Reasons returned by CheckCredential.
+const (
+	ReasonOK              = "ok"
+	ReasonUnknownUser     = "unknown user"
+	ReasonInvalidPassword = "invalid password"
+	ReasonExpired         = "expired"
+	ReasonDisabled        = "disabled"
+	ReasonNoDigest        = "no digest credential"
+)
+
+// dummyHash is compared against the password of unknown users, so they take
+// as long to check as known ones and usernames can't be probed by timing.
+// It has the cost of hash.DefaultCost, and the hash of a discarded random password.
+const dummyHash = "$2a$14$QDtxAQdSbcq2suLtokdpCeve8X6PFHKK.Phir8EQl1j2qrgAi3RNS"
+
+// ExpiresAt returns when the record stops being accepted: its expiration
+// date plus grace. It returns the zero time if the record never expires.
+func (u *UserRecord) ExpiresAt(grace time.Duration) time.Time {
+	if u.ExpDate <= 0 {
+		return time.Time{}
 	}
-	return nil
+	return time.Unix(u.ExpDate, 0).Add(grace)
+}
+
+// IsExpired returns true if the record expiration date plus grace is before now.
+// A zero ExpDate means the record never expires.
+func (u *UserRecord) IsExpired(now time.Time, grace time.Duration) bool {
+	return u.ExpDate > 0 && !now.Before(time.Unix(u.ExpDate, 0).Add(grace))
+}
+
+// CheckCredential decides if password grants access to the user record.
+// It returns the decision and the reason behind it. The account state is only
+// disclosed to callers knowing the right password.
+func CheckCredential(u *UserRecord, password string, now time.Time, grace time.Duration) (bool, string) {
+	switch {
+	case u == nil:
+		hash.CheckPasswordHash(password, dummyHash)
+		return false, ReasonUnknownUser
+	case !hash.CheckPasswordHash(password, u.Password):
+		return false, ReasonInvalidPassword
+	case u.Disabled:
+		return false, ReasonDisabled
+	case u.IsExpired(now, grace):
+		return false, ReasonExpired
+	}
+	return true, ReasonOK
+}
+
+// DigestCredential returns the digest HA1 of the user record for realm.
+// It returns an empty HA1 and the reason when the record can't be used.
+func DigestCredential(u *UserRecord, realm string, now time.Time, grace time.Duration) (string, string) {
+	switch {
+	case u == nil:
+		return "", ReasonUnknownUser
+	case u.Disabled:
+		return "", ReasonDisabled
+	case u.IsExpired(now, grace):
+		return "", ReasonExpired
+	case u.HA1[realm] == "":
+		return "", ReasonNoDigest
+	}
+	return u.HA1[realm], ReasonOK
+}
+
+// NewBD opens the storage backend selected in the configuration.
+func NewBD(c *conf.Config) (*Database, error) {
+	log.Debug().Msg("Creating database object")
+	s, err := NewStore(c)
+	if err != nil {
+		return nil, err
+	}
+	log.Debug().Msg("Created database object")
+	return &Database{Cfg: c, Changes: NewChangeLog(), store: s}, nil
+}
+
+// Close releases the storage backend.
+func (d *Database) Close() error {
+	return d.store.Close()
+}
+
+// Ping returns an error if the storage backend can't be read.
+func (d *Database) Ping() error {
+	return d.store.Ping()
+}
+
+// Check returns an error if the storage backend can't be written.
+func (d *Database) Check() error {
+	return d.store.Check()
 }
 
 // GetRecord returns a user record.
+// Expired records are reported as not found.
 func (d *Database) GetRecord(user string) (*UserRecord, error) {
-	d.Lock()
-	defer d.Unlock()
-	for _, r := range d.Users {
-		if r.Username == user {
-			u := &UserRecord{Username: r.Username, Password: r.Password, Groups: r.Groups, ExpDate: r.ExpDate}
-			return u, nil
-		}
+	u, err := d.LookupRecord(user)
+	if err != nil {
+		return nil, err
 	}
-	return nil, errors.New("user not found")
+	if u.IsExpired(time.Now(), d.Cfg.ExpiryGrace) {
+		return nil, ErrUserNotFound
+	}
+	return u, nil
+}
+
+// LookupRecord returns a user record, even if it is expired.
+func (d *Database) LookupRecord(user string) (*UserRecord, error) {
+	return d.store.Get(user)
+}
+
+// ListRecords returns all user records, including expired ones.
+func (d *Database) ListRecords() ([]UserRecord, error) {
+	return d.store.List()
 }
 
 // AddRecord insert new user record.
+// An expired record with the same username is replaced.
 func (d *Database) AddRecord(ur UserRecord) error {
 	d.Lock()
 	defer d.Unlock()
-	for _, r := range d.Users {
-		if r.Username == ur.Username {
-			return errors.New("user already exist")
-			/*
-			   d.Users[i].Password = ur.Password
-			   d.Users[i].Groups = ur.Groups
-			   d.Users[i].ExpDate = ur.ExpDate
-			   return d.SaveDatabase()
-			*/
-		}
+	r, err := d.store.Get(ur.Username)
+	switch {
+	case errors.Is(err, ErrUserNotFound):
+		err = d.store.Add(ur)
+	case err != nil:
+		return err
+	case r.IsExpired(time.Now(), d.Cfg.ExpiryGrace):
+		err = d.store.Update(ur)
+	default:
+		return ErrUserExists
+	}
+	if err == nil {
+		d.Changes.Record(ur.Username)
 	}
-	d.Users = append(d.Users, UserRecord{Username: ur.Username, Password: ur.Password, Groups: ur.Groups, ExpDate: ur.ExpDate})
-	return d.SaveDatabase()
+	return err
+}
+
+// UpsertRecord inserts ur, or replaces the record with the same username.
+// It returns true if the record was created.
+func (d *Database) UpsertRecord(ur UserRecord) (bool, error) {
+	d.Lock()
+	defer d.Unlock()
+	_, err := d.store.Get(ur.Username)
+	created := errors.Is(err, ErrUserNotFound)
+	switch {
+	case created:
+		err = d.store.Add(ur)
+	case err == nil:
+		err = d.store.Update(ur)
+	}
+	if err == nil {
+		d.Changes.Record(ur.Username)
+	}
+	return created, err
 }
 
 // UpdateRecord update user record with new data
 func (d *Database) UpdateRecord(ur UserRecord) error {
 	d.Lock()
 	defer d.Unlock()
-	for i, r := range d.Users {
-		if r.Username == ur.Username {
-			d.Users[i].Password = ur.Password
-			d.Users[i].Groups = ur.Groups
-			d.Users[i].ExpDate = ur.ExpDate
-			return d.SaveDatabase()
-		}
+	err := d.store.Update(ur)
+	if err == nil {
+		d.Changes.Record(ur.Username)
 	}
-	return errors.New("user not found")
+	return err
+}
+
+// PatchRecord updates the fields set in p, keeping the other ones.
+// Expired records can still be patched, so their expiration date can be extended.
+func (d *Database) PatchRecord(user string, p UserPatch) (*UserRecord, error) {
+	d.Lock()
+	defer d.Unlock()
+	ur, err := d.store.Get(user)
+	if err != nil {
+		return nil, err
+	}
+	p.Apply(ur)
+	err = d.store.Update(*ur)
+	if err == nil {
+		d.Changes.Record(user)
+	}
+	return ur, err
 }
 
 // DeleteRecord remove user record if it exist
 func (d *Database) DeleteRecord(user string) error {
 	d.Lock()
 	defer d.Unlock()
-	var indexes []int
-	for i, r := range d.Users {
-		if r.Username == user {
-			indexes = append(indexes, i)
+	err := d.store.Delete(user)
+	if err == nil {
+		d.Changes.Record(user)
+	}
+	return err
+}
+
+// PurgeExpired removes all records expired at now and returns their usernames.
+// They are removed in a single write of the store.
+func (d *Database) PurgeExpired(now time.Time) ([]string, error) {
+	d.Lock()
+	defer d.Unlock()
+	users, err := d.store.List()
+	if err != nil {
+		return nil, err
+	}
+	var expired []string
+	for i := range users {
+		if users[i].IsExpired(now, d.Cfg.ExpiryGrace) {
+			expired = append(expired, users[i].Username)
 		}
 	}
-	for _, index := range indexes {
-		d.Users = append(d.Users[:index], d.Users[index+1:]...)
+	if len(expired) == 0 {
+		return nil, nil
+	}
+	purged, err := d.store.DeleteMany(expired)
+	if err != nil {
+		return nil, err
 	}
-	return d.SaveDatabase()
+	d.Changes.Record(purged...)
+	return purged, nil
 }
@@ -0,0 +1,155 @@
+//
+// db_test.go
+// Copyright (C) 2024 rmelo <Ricardo Melo <rmelo@ludia.com>>
+//
+// Distributed under terms of the MIT license.
+//
+
+package db
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/cropalato/squid-vault-auth/internal/conf"
+)
+
+func newTestDatabase(t *testing.T, backend string, grace time.Duration) *Database {
+	t.Helper()
+	d, err := NewBD(&conf.Config{DbPath: filepath.Join(t.TempDir(), "squid-vault.db"), Backend: backend, ExpiryGrace: grace})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = d.Close() })
+	return d
+}
+
+func TestIsExpired(t *testing.T) {
+	exp := time.Unix(1700000000, 0)
+	u := UserRecord{ExpDate: exp.Unix()}
+	for _, tc := range []struct {
+		now   time.Time
+		grace time.Duration
+		want  bool
+	}{
+		{exp.Add(-time.Nanosecond), 0, false},
+		{exp, 0, true},
+		{exp.Add(time.Minute - time.Nanosecond), time.Minute, false},
+		{exp.Add(time.Minute), time.Minute, true},
+	} {
+		if got := u.IsExpired(tc.now, tc.grace); got != tc.want {
+			t.Errorf("IsExpired(exp%+v, %s) = %v, expected %v", tc.now.Sub(exp), tc.grace, got, tc.want)
+		}
+	}
+	never := UserRecord{}
+	if never.IsExpired(time.Now().Add(100*365*24*time.Hour), 0) {
+		t.Error("a zero exp_date must never expire")
+	}
+}
+
+func TestExpiredRecords(t *testing.T) {
+	d := newTestDatabase(t, BackendJSON, 0)
+	past := time.Now().Add(-time.Minute).Unix()
+	if err := d.AddRecord(UserRecord{Username: "bob", Password: "old", ExpDate: past}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.GetRecord("bob"); !errors.Is(err, ErrUserNotFound) {
+		t.Fatalf("expected an expired record to be hidden, got %v", err)
+	}
+	if u, err := d.LookupRecord("bob"); err != nil || u.Password != "old" {
+		t.Fatalf("expected LookupRecord to return the expired record, got %+v, %v", u, err)
+	}
+
+	// an expired record is replaced, an active one is not.
+	if err := d.AddRecord(UserRecord{Username: "bob", Password: "new"}); err != nil {
+		t.Fatalf("expected the expired record to be replaced, got %v", err)
+	}
+	u, err := d.GetRecord("bob")
+	if err != nil || u.Password != "new" || u.ExpDate != 0 {
+		t.Fatalf("unexpected record %+v, %v", u, err)
+	}
+	if err := d.AddRecord(UserRecord{Username: "bob", Password: "other"}); !errors.Is(err, ErrUserExists) {
+		t.Fatalf("expected ErrUserExists, got %v", err)
+	}
+}
+
+func TestExpiryGrace(t *testing.T) {
+	d := newTestDatabase(t, BackendJSON, time.Hour)
+	if err := d.AddRecord(UserRecord{Username: "bob", ExpDate: time.Now().Add(-time.Minute).Unix()}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.GetRecord("bob"); err != nil {
+		t.Fatalf("expected the record to be accepted during the grace period, got %v", err)
+	}
+}
+
+func TestPatchGroups(t *testing.T) {
+	for _, tc := range []struct {
+		patch string
+		want  []string
+	}{
+		{`{"add_groups": ["g3", "g1"]}`, []string{"g1", "g2", "g3"}},
+		{`{"remove_groups": ["g1", "g4"]}`, []string{"g2"}},
+		{`{"add_groups": ["g3"], "remove_groups": ["g1", "g2"]}`, []string{"g3"}},
+		{`{"groups": ["g4"], "add_groups": ["g5"]}`, []string{"g4", "g5"}},
+		{`{"add_groups": null}`, []string{"g1", "g2"}},
+	} {
+		var p UserPatch
+		if err := json.Unmarshal([]byte(tc.patch), &p); err != nil {
+			t.Fatalf("%s: %v", tc.patch, err)
+		}
+		u := UserRecord{Groups: []string{"g1", "g2"}}
+		p.Apply(&u)
+		if !reflect.DeepEqual(u.Groups, tc.want) {
+			t.Errorf("%s: groups = %q, want %q", tc.patch, u.Groups, tc.want)
+		}
+	}
+}
+
+func TestPatchFields(t *testing.T) {
+	var p UserPatch
+	if err := json.Unmarshal([]byte(`{"password": "secret", "groups": null, "disabled": true}`), &p); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := p.Fields(), []string{"disabled", "groups", "password"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Fields() = %q, want %q", got, want)
+	}
+}
+
+func TestPatchGroupsConcurrent(t *testing.T) {
+	d := newTestDatabase(t, BackendJSON, 0)
+	if err := d.AddRecord(UserRecord{Username: "bob", Groups: []string{"g0"}}); err != nil {
+		t.Fatal(err)
+	}
+	// every change is kept, none is lost to a concurrent one.
+	want := []string{"g0"}
+	var wg sync.WaitGroup
+	for i := 1; i <= 10; i++ {
+		g := fmt.Sprintf("g%d", i)
+		want = append(want, g)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := d.PatchRecord("bob", UserPatch{AddGroups: &[]string{g}}); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+	u, err := d.GetRecord("bob")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(u.Groups)
+	sort.Strings(want)
+	if !reflect.DeepEqual(u.Groups, want) {
+		t.Errorf("groups = %q, want %q", u.Groups, want)
+	}
+}
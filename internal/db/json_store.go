@@ -0,0 +1,259 @@
+//
+// json_store.go
+// Copyright (C) 2024 rmelo <Ricardo Melo <rmelo@ludia.com>>
+//
+// Distributed under terms of the MIT license.
+//
+
+package db
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/cropalato/squid-vault-auth/internal/fsutil"
+	"github.com/rs/zerolog/log"
+)
+
+// JSONStore keeps all user records in a single json file.
+// Records are indexed in memory, and the whole file is rewritten on every change.
+// The file is locked for the life of the store, so two processes can't overwrite each other.
+type JSONStore struct {
+	path  string
+	lock  *fsutil.Lock
+	users map[string]UserRecord
+	mu    sync.RWMutex
+}
+
+// NewJSONStore lock and load json file.
+// If file doesn't exist, we will create the file.
+// A corrupt file is never loaded, nor overwritten.
+func NewJSONStore(path string) (*JSONStore, error) {
+	l, err := fsutil.LockFile(path + ".lock")
+	if err != nil {
+		log.Err(err)
+		return nil, fmt.Errorf("failed locking database %s: %w", path, err)
+	}
+	if _, err := os.Stat(path); errors.Is(err, fs.ErrNotExist) {
+		log.Debug().Msg("database file doesn't exist. Creating file " + path)
+		err := fsutil.WriteFileAtomic(path, []byte("[]"), 0o600)
+		if err != nil {
+			log.Err(err)
+			_ = l.Unlock()
+			return nil, err
+		}
+	}
+	s := &JSONStore{path: path, lock: l}
+	if err := s.load(); err != nil {
+		_ = l.Unlock()
+		return nil, err
+	}
+	return s, nil
+}
+
+// load read and parse json file.
+func (s *JSONStore) load() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	content, err := os.ReadFile(s.path)
+	if err != nil {
+		log.Err(err)
+		return err
+	}
+	users, err := parseRecords(content)
+	if err != nil {
+		log.Err(err)
+		return fmt.Errorf("corrupt database file %s: %w", s.path, err)
+	}
+	s.users = users
+	return nil
+}
+
+// parseRecords decodes and validates the content of a json database file.
+func parseRecords(content []byte) (map[string]UserRecord, error) {
+	if len(bytes.TrimSpace(content)) == 0 {
+		return nil, errors.New("file is empty")
+	}
+	var list []UserRecord
+	if err := json.Unmarshal(content, &list); err != nil {
+		return nil, err
+	}
+	users := make(map[string]UserRecord, len(list))
+	for i, u := range list {
+		if u.Username == "" {
+			return nil, fmt.Errorf("record %d has no username", i)
+		}
+		if _, ok := users[u.Username]; ok {
+			return nil, fmt.Errorf("duplicated record for user %s", u.Username)
+		}
+		users[u.Username] = u
+	}
+	return users, nil
+}
+
+// save upgrade json file atomically. The caller must hold the write lock.
+func (s *JSONStore) save() (err error) {
+	defer func(start time.Time) { observeSave(BackendJSON, start, err) }(time.Now())
+	file, err := json.MarshalIndent(s.sorted(), "", "  ")
+	if err != nil {
+		log.Err(err)
+		return err
+	}
+	if err := fsutil.WriteFileAtomic(s.path, file, 0o600); err != nil {
+		log.Err(err)
+		return err
+	}
+	return nil
+}
+
+// sorted returns the records ordered by username. The caller must hold the lock.
+func (s *JSONStore) sorted() []UserRecord {
+	users := make([]UserRecord, 0, len(s.users))
+	for _, u := range s.users {
+		users = append(users, copyRecord(u))
+	}
+	sort.Slice(users, func(i, j int) bool { return users[i].Username < users[j].Username })
+	return users
+}
+
+// Get returns a user record.
+func (s *JSONStore) Get(user string) (*UserRecord, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	u, ok := s.users[user]
+	if !ok {
+		return nil, ErrUserNotFound
+	}
+	u = copyRecord(u)
+	return &u, nil
+}
+
+// List returns all user records ordered by username.
+func (s *JSONStore) List() ([]UserRecord, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.sorted(), nil
+}
+
+// Add insert new user record.
+func (s *JSONStore) Add(ur UserRecord) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.users[ur.Username]; ok {
+		return ErrUserExists
+	}
+	s.users[ur.Username] = copyRecord(ur)
+	if err := s.save(); err != nil {
+		delete(s.users, ur.Username)
+		return err
+	}
+	return nil
+}
+
+// Update replaces an existing user record.
+func (s *JSONStore) Update(ur UserRecord) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	old, ok := s.users[ur.Username]
+	if !ok {
+		return ErrUserNotFound
+	}
+	s.users[ur.Username] = copyRecord(ur)
+	if err := s.save(); err != nil {
+		s.users[ur.Username] = old
+		return err
+	}
+	return nil
+}
+
+// Delete removes a user record.
+func (s *JSONStore) Delete(user string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	old, ok := s.users[user]
+	if !ok {
+		return ErrUserNotFound
+	}
+	delete(s.users, user)
+	if err := s.save(); err != nil {
+		s.users[user] = old
+		return err
+	}
+	return nil
+}
+
+// DeleteMany removes the records of users, saving the file once.
+func (s *JSONStore) DeleteMany(users []string) ([]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	old := map[string]UserRecord{}
+	var deleted []string
+	for _, user := range users {
+		if u, ok := s.users[user]; ok {
+			old[user] = u
+			delete(s.users, user)
+			deleted = append(deleted, user)
+		}
+	}
+	if len(deleted) == 0 {
+		return nil, nil
+	}
+	if err := s.save(); err != nil {
+		for user, u := range old {
+			s.users[user] = u
+		}
+		return nil, err
+	}
+	return deleted, nil
+}
+
+// Ping makes sure the store is open, still holds the lock of the database
+// file, and the database file exists.
+func (s *JSONStore) Ping() error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.lock == nil {
+		return ErrClosed
+	}
+	if err := s.lock.Check(); err != nil {
+		return err
+	}
+	_, err := os.Stat(s.path)
+	return err
+}
+
+// Check makes sure the store is open, and a file can be created next to the
+// database file, as every save does.
+func (s *JSONStore) Check() error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.lock == nil {
+		return ErrClosed
+	}
+	f, err := os.CreateTemp(filepath.Dir(s.path), ".squiddb-check-*")
+	if err != nil {
+		return err
+	}
+	_ = f.Close()
+	return os.Remove(f.Name())
+}
+
+// Close releases the database lock.
+func (s *JSONStore) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.lock == nil {
+		return nil
+	}
+	err := s.lock.Unlock()
+	s.lock = nil
+	return err
+}
@@ -0,0 +1,96 @@
+//
+// json_store_test.go
+// Copyright (C) 2024 rmelo <Ricardo Melo <rmelo@ludia.com>>
+//
+// Distributed under terms of the MIT license.
+//
+
+package db
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/cropalato/squid-vault-auth/internal/conf"
+	"github.com/cropalato/squid-vault-auth/internal/fsutil"
+)
+
+func TestJSONStoreLocked(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "squid-vault.json")
+	s, err := NewJSONStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewStore(&conf.Config{DbPath: path, Backend: BackendJSON}); !errors.Is(err, fsutil.ErrLocked) {
+		t.Fatalf("expected ErrLocked, got %v", err)
+	}
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+	s, err = NewJSONStore(path)
+	if err != nil {
+		t.Fatalf("expected the store to open once closed, got %v", err)
+	}
+	_ = s.Close()
+}
+
+func TestJSONStoreLostLock(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "squid-vault.json")
+	s, err := NewJSONStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if err := s.Ping(); err != nil {
+		t.Fatal(err)
+	}
+	// once the lock file is removed, another process can lock a new one.
+	if err := os.Remove(path + ".lock"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Ping(); err == nil {
+		t.Fatal("expected Ping to report the lost lock")
+	}
+	l, err := fsutil.LockFile(path + ".lock")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Unlock()
+	if err := s.Ping(); err == nil {
+		t.Fatal("expected Ping to report the replaced lock")
+	}
+}
+
+func TestJSONStoreCorrupt(t *testing.T) {
+	for name, content := range map[string]string{
+		"empty":              "",
+		"truncated":          `[{"username": "bob"`,
+		"missing username":   `[{"password": "x"}]`,
+		"duplicated records": `[{"username": "bob"}, {"username": "bob"}]`,
+	} {
+		t.Run(name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "squid-vault.json")
+			if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := NewJSONStore(path); err == nil {
+				t.Fatal("expected a corrupt file to be refused")
+			}
+			got, err := os.ReadFile(path)
+			if err != nil || string(got) != content {
+				t.Fatalf("a corrupt file must not be overwritten, got %q, %v", got, err)
+			}
+			// the lock is released, so the file can be fixed and loaded.
+			if err := os.WriteFile(path, []byte("[]"), 0o600); err != nil {
+				t.Fatal(err)
+			}
+			s, err := NewJSONStore(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			_ = s.Close()
+		})
+	}
+}
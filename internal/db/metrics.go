@@ -0,0 +1,116 @@
+//
+// metrics.go
+// Copyright (C) 2024 rmelo <Ricardo Melo <rmelo@ludia.com>>
+//
+// Distributed under terms of the MIT license.
+//
+
+package db
+
+import (
+	"os"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/rs/zerolog/log"
+)
+
+var (
+	// SaveDuration measures the writes of the storage backends.
+	SaveDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "squiddb",
+		Name:      "store_save_duration_seconds",
+		Help:      "Time spent writing the database, by backend and result.",
+		Buckets:   prometheus.ExponentialBuckets(0.0005, 2, 14),
+	}, []string{"backend", "result"})
+
+	// ReaperRuns counts the reaper runs, by result.
+	ReaperRuns = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "squiddb",
+		Name:      "reaper_runs_total",
+		Help:      "Runs of the expiry reaper, by result.",
+	}, []string{"result"})
+
+	// ReaperPurged counts the records removed by the reaper.
+	ReaperPurged = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "squiddb",
+		Name:      "reaper_purged_total",
+		Help:      "User records removed by the expiry reaper.",
+	})
+)
+
+// observeSave records a write of backend started at start.
+func observeSave(backend string, start time.Time, err error) {
+	result := "ok"
+	if err != nil {
+		result = "error"
+	}
+	SaveDuration.WithLabelValues(backend, result).Observe(time.Since(start).Seconds())
+}
+
+// Collector computes the user record metrics of a database at scrape time.
+type Collector struct {
+	db *Database
+
+	users    *prometheus.Desc
+	groups   *prometheus.Desc
+	expiring *prometheus.Desc
+	size     *prometheus.Desc
+}
+
+// NewCollector returns a collector of d. Active users expiring within
+// Cfg.ExpiryWindow are reported as expiring soon.
+func NewCollector(d *Database) *Collector {
+	return &Collector{
+		db:       d,
+		users:    prometheus.NewDesc("squiddb_users", "User records, by state.", []string{"state"}, nil),
+		groups:   prometheus.NewDesc("squiddb_group_users", "Active user records, by group.", []string{"group"}, nil),
+		expiring: prometheus.NewDesc("squiddb_users_expiring_soon", "Active user records expiring within the configured window.", nil, nil),
+		size:     prometheus.NewDesc("squiddb_database_size_bytes", "Size of the database file.", nil, nil),
+	}
+}
+
+// Describe implements prometheus.Collector.
+func (c *Collector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.users
+	ch <- c.groups
+	ch <- c.expiring
+	ch <- c.size
+}
+
+// Collect implements prometheus.Collector.
+func (c *Collector) Collect(ch chan<- prometheus.Metric) {
+	if info, err := os.Stat(c.db.Cfg.DbPath); err == nil {
+		ch <- prometheus.MustNewConstMetric(c.size, prometheus.GaugeValue, float64(info.Size()))
+	}
+	users, err := c.db.ListRecords()
+	if err != nil {
+		log.Err(err).Msg("failed listing users for metrics")
+		return
+	}
+	now := time.Now()
+	states := map[string]int{StateActive: 0, StateExpired: 0, StateDisabled: 0}
+	groups := map[string]int{}
+	expiring := 0
+	for i := range users {
+		u := &users[i]
+		state := u.State(now, c.db.Cfg.ExpiryGrace)
+		states[state]++
+		if state != StateActive {
+			continue
+		}
+		for _, g := range u.Groups {
+			groups[g]++
+		}
+		if u.ExpDate > 0 && time.Unix(u.ExpDate, 0).Before(now.Add(c.db.Cfg.ExpiryWindow)) {
+			expiring++
+		}
+	}
+	for state, n := range states {
+		ch <- prometheus.MustNewConstMetric(c.users, prometheus.GaugeValue, float64(n), state)
+	}
+	for g, n := range groups {
+		ch <- prometheus.MustNewConstMetric(c.groups, prometheus.GaugeValue, float64(n), g)
+	}
+	ch <- prometheus.MustNewConstMetric(c.expiring, prometheus.GaugeValue, float64(expiring))
+}
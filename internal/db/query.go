@@ -0,0 +1,188 @@
+//
+// query.go
+// Copyright (C) 2024 rmelo <Ricardo Melo <rmelo@ludia.com>>
+//
+// Distributed under terms of the MIT license.
+//
+
+package db
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Orders supported by Query.
+const (
+	SortUsername = "username"
+	SortExpiry   = "exp_date"
+)
+
+// States filtered by Query.
+const (
+	StateAll      = "all"
+	StateActive   = "active"
+	StateExpired  = "expired"
+	StateDisabled = "disabled"
+)
+
+// ErrInvalidQuery the query parameters are invalid
+var ErrInvalidQuery = errors.New("invalid query")
+
+// Query selects a page of user records.
+type Query struct {
+	// Group keeps the members of the group, if set.
+	Group string
+	// Prefix keeps the usernames starting with it, if set.
+	Prefix string
+	// State keeps the records in this state: active, expired, disabled or all.
+	State string
+	// ExpiresAfter and ExpiresBefore keep the records expiring in this range,
+	// if set. Records never expiring are outside of any range.
+	ExpiresAfter  time.Time
+	ExpiresBefore time.Time
+	// Sort is the order of the records: username or exp_date.
+	// Records never expiring are last when sorted by exp_date.
+	Sort string
+	// Cursor is the Next value of the previous page.
+	Cursor string
+	// Limit is the maximum number of records returned.
+	Limit int
+}
+
+// cursor is the position of the last record of a page.
+type cursor struct {
+	Sort     string `json:"s"`
+	ExpDate  int64  `json:"e,omitempty"`
+	Username string `json:"u"`
+}
+
+// State returns the state of the record at now: active, expired or disabled.
+func (u *UserRecord) State(now time.Time, grace time.Duration) string {
+	switch {
+	case u.Disabled:
+		return StateDisabled
+	case u.IsExpired(now, grace):
+		return StateExpired
+	}
+	return StateActive
+}
+
+// expiryKey returns the sort key of the record expiration date.
+func (u *UserRecord) expiryKey() int64 {
+	if u.ExpDate == 0 {
+		return math.MaxInt64
+	}
+	return u.ExpDate
+}
+
+// QueryRecords returns the page of records selected by q, and the cursor of
+// the next page, empty on the last page.
+func (d *Database) QueryRecords(q Query, now time.Time) ([]UserRecord, string, error) {
+	if q.Sort == "" {
+		q.Sort = SortUsername
+	}
+	if q.State == "" {
+		q.State = StateAll
+	}
+	switch q.Sort {
+	case SortUsername, SortExpiry:
+	default:
+		return nil, "", fmt.Errorf("%w: unknown sort order %q", ErrInvalidQuery, q.Sort)
+	}
+	switch q.State {
+	case StateAll, StateActive, StateExpired, StateDisabled:
+	default:
+		return nil, "", fmt.Errorf("%w: unknown state %q", ErrInvalidQuery, q.State)
+	}
+	var after *cursor
+	if q.Cursor != "" {
+		c, err := decodeCursor(q.Cursor)
+		if err != nil || c.Sort != q.Sort {
+			// cursors are only valid with the order they were created for.
+			return nil, "", fmt.Errorf("%w: invalid cursor", ErrInvalidQuery)
+		}
+		after = c
+	}
+
+	users, err := d.ListRecords()
+	if err != nil {
+		return nil, "", err
+	}
+	less := func(a, b *UserRecord) bool {
+		if q.Sort == SortExpiry && a.expiryKey() != b.expiryKey() {
+			return a.expiryKey() < b.expiryKey()
+		}
+		return a.Username < b.Username
+	}
+	sort.Slice(users, func(i, j int) bool { return less(&users[i], &users[j]) })
+
+	var page []UserRecord
+	var last *UserRecord
+	for i := range users {
+		u := &users[i]
+		if after != nil && !less(&UserRecord{Username: after.Username, ExpDate: after.ExpDate}, u) {
+			continue
+		}
+		if !q.match(u, now, d.Cfg.ExpiryGrace) {
+			continue
+		}
+		if q.Limit > 0 && len(page) == q.Limit {
+			return page, encodeCursor(cursor{Sort: q.Sort, ExpDate: last.ExpDate, Username: last.Username}), nil
+		}
+		page = append(page, *u)
+		last = u
+	}
+	return page, "", nil
+}
+
+// match returns true if u is selected by the filters of q.
+func (q *Query) match(u *UserRecord, now time.Time, grace time.Duration) bool {
+	if q.Prefix != "" && !strings.HasPrefix(u.Username, q.Prefix) {
+		return false
+	}
+	if q.Group != "" {
+		found := false
+		for _, g := range u.Groups {
+			found = found || g == q.Group
+		}
+		if !found {
+			return false
+		}
+	}
+	if q.State != StateAll && u.State(now, grace) != q.State {
+		return false
+	}
+	if !q.ExpiresAfter.IsZero() && (u.ExpDate == 0 || u.ExpDate < q.ExpiresAfter.Unix()) {
+		return false
+	}
+	if !q.ExpiresBefore.IsZero() && (u.ExpDate == 0 || u.ExpDate >= q.ExpiresBefore.Unix()) {
+		return false
+	}
+	return true
+}
+
+// encodeCursor returns the opaque representation of c.
+func encodeCursor(c cursor) string {
+	data, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+// decodeCursor parses a cursor returned by encodeCursor.
+func decodeCursor(v string) (*cursor, error) {
+	data, err := base64.RawURLEncoding.DecodeString(v)
+	if err != nil {
+		return nil, err
+	}
+	var c cursor
+	if err := json.Unmarshal(data, &c); err != nil {
+		return nil, err
+	}
+	return &c, nil
+}
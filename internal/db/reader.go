@@ -0,0 +1,98 @@
+//
+// reader.go
+// Copyright (C) 2024 rmelo <Ricardo Melo <rmelo@ludia.com>>
+//
+// Distributed under terms of the MIT license.
+//
+
+package db
+
+import (
+	"fmt"
+	"os"
+	"sync"
+
+	"github.com/rs/zerolog/log"
+)
+
+// Reader gives read-only access to a database file, in place and without
+// taking the lock of the store. It is used by helpers running on the same
+// host as squid-database.
+//
+// The json file is reloaded when it changes. The bolt backend isn't
+// supported: squid-database holds an exclusive lock on the bolt database, so
+// it can't be read in place while the service runs.
+type Reader struct {
+	path     string
+	onChange func()
+	mu       sync.Mutex
+	info     os.FileInfo
+	users    map[string]UserRecord
+}
+
+// NewReader opens the database file at path, written by the given backend.
+// onChange, if not nil, is called every time the file changes.
+func NewReader(backend string, path string, onChange func()) (*Reader, error) {
+	switch backend {
+	case "", BackendJSON:
+	case BackendBolt:
+		return nil, fmt.Errorf("the %s backend can't be read in place, call squid db service instead", backend)
+	default:
+		return nil, fmt.Errorf("unknown database backend %q", backend)
+	}
+	r := &Reader{path: path, onChange: onChange}
+	if _, err := r.refresh(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// refresh reloads the database file if it changed since the last call.
+// The caller must hold the lock, except in NewReader.
+func (r *Reader) refresh() (bool, error) {
+	info, err := os.Stat(r.path)
+	if err != nil {
+		return false, err
+	}
+	if r.info != nil && os.SameFile(r.info, info) && r.info.ModTime().Equal(info.ModTime()) && r.info.Size() == info.Size() {
+		return false, nil
+	}
+	content, err := os.ReadFile(r.path)
+	if err != nil {
+		return false, err
+	}
+	users, err := parseRecords(content)
+	if err != nil {
+		return false, fmt.Errorf("corrupt database file %s: %w", r.path, err)
+	}
+	r.users = users
+	r.info = info
+	return true, nil
+}
+
+// Refresh reloads the database file if it changed, and calls onChange.
+// If the file can't be reloaded, the last good content is kept.
+func (r *Reader) Refresh() {
+	r.mu.Lock()
+	changed, err := r.refresh()
+	r.mu.Unlock()
+	if err != nil {
+		log.Error().Err(err).Msg("failed reloading database file " + r.path + ", using its last good content")
+	}
+	if changed && r.onChange != nil {
+		r.onChange()
+	}
+}
+
+// Get returns the record of user, even if it is expired, or ErrUserNotFound.
+func (r *Reader) Get(user string) (*UserRecord, error) {
+	r.Refresh()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	u, ok := r.users[user]
+	if !ok {
+		return nil, ErrUserNotFound
+	}
+	u = copyRecord(u)
+	return &u, nil
+}
@@ -0,0 +1,81 @@
+//
+// reader_test.go
+// Copyright (C) 2024 rmelo <Ricardo Melo <rmelo@ludia.com>>
+//
+// Distributed under terms of the MIT license.
+//
+
+package db
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestReaderReload(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "squid-vault.json")
+	s := openTestStore(t, BackendJSON, path)
+	defer s.Close()
+	if err := s.Add(UserRecord{Username: "bob", Password: "p1"}); err != nil {
+		t.Fatal(err)
+	}
+
+	changes := 0
+	r, err := NewReader(BackendJSON, path, func() { changes++ })
+	if err != nil {
+		t.Fatalf("NewReader() error = %v", err)
+	}
+	if u, err := r.Get("bob"); err != nil || u.Password != "p1" {
+		t.Fatalf("Get(bob) = %+v, %v", u, err)
+	}
+	if changes != 0 {
+		t.Errorf("onChange called %d times without change", changes)
+	}
+
+	// the store replaces the file while the reader is open.
+	if err := s.Update(UserRecord{Username: "bob", Password: "p2"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Add(UserRecord{Username: "alice", Password: "p1"}); err != nil {
+		t.Fatal(err)
+	}
+	if u, err := r.Get("bob"); err != nil || u.Password != "p2" {
+		t.Errorf("Get(bob) after update = %+v, %v, want the new password", u, err)
+	}
+	if _, err := r.Get("alice"); err != nil {
+		t.Errorf("Get(alice) after add error = %v", err)
+	}
+	if changes != 1 {
+		t.Errorf("onChange called %d times, want 1", changes)
+	}
+
+	// a corrupt file is ignored, and the last good content is kept.
+	if err := os.WriteFile(path, []byte("{"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if u, err := r.Get("bob"); err != nil || u.Password != "p2" {
+		t.Errorf("Get(bob) from a corrupt file = %+v, %v, want the last good record", u, err)
+	}
+	if _, err := r.Get("carol"); !errors.Is(err, ErrUserNotFound) {
+		t.Errorf("Get(carol) error = %v, want ErrUserNotFound", err)
+	}
+}
+
+func TestReaderBolt(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "squid-vault.db")
+	s := openTestStore(t, BackendBolt, path)
+	defer s.Close()
+
+	// bolt can't be read in place while the store holds it: the reader must
+	// refuse it right away, instead of waiting on the lock.
+	start := time.Now()
+	if _, err := NewReader(BackendBolt, path, nil); err == nil {
+		t.Fatal("NewReader() of a bolt database succeeded")
+	}
+	if d := time.Since(start); d > 100*time.Millisecond {
+		t.Errorf("NewReader() took %s", d)
+	}
+}
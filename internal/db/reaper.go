@@ -0,0 +1,120 @@
+//
+// reaper.go
+// Copyright (C) 2024 rmelo <Ricardo Melo <rmelo@ludia.com>>
+//
+// Distributed under terms of the MIT license.
+//
+
+package db
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// Reaper periodically removes expired records from the database.
+// It makes sure accounts Vault failed to revoke don't live forever.
+type Reaper struct {
+	db       *Database
+	interval time.Duration
+
+	runs    atomic.Uint64
+	purged  atomic.Uint64
+	failed  atomic.Uint64
+	lastRun atomic.Int64
+
+	created time.Time
+	mu      sync.Mutex
+	// lastErr is the error of the last run, nil if it succeeded.
+	lastErr error
+}
+
+// NewReaper creates a reaper purging d every interval.
+func NewReaper(d *Database, interval time.Duration) *Reaper {
+	return &Reaper{db: d, interval: interval, created: time.Now()}
+}
+
+// Run purges expired records until ctx is done.
+func (r *Reaper) Run(ctx context.Context) {
+	log.Info().Dur("interval", r.interval).Msg("expiry reaper started")
+	ticker := time.NewTicker(r.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			log.Info().Msg("expiry reaper stopped")
+			return
+		case now := <-ticker.C:
+			_, _ = r.Reap(now)
+		}
+	}
+}
+
+// Reap removes the records expired at now and returns how many were removed.
+func (r *Reaper) Reap(now time.Time) (int, error) {
+	users, err := r.db.PurgeExpired(now)
+	r.runs.Add(1)
+	r.lastRun.Store(now.UnixNano())
+	r.purged.Add(uint64(len(users)))
+	ReaperPurged.Add(float64(len(users)))
+	r.mu.Lock()
+	r.lastErr = err
+	r.mu.Unlock()
+	if err != nil {
+		r.failed.Add(1)
+		ReaperRuns.WithLabelValues("error").Inc()
+		log.Error().Err(err).Int("purged", len(users)).Msg("expiry reaper failed to save database")
+		return len(users), err
+	}
+	ReaperRuns.WithLabelValues("ok").Inc()
+	if len(users) > 0 {
+		log.Info().Int("purged", len(users)).Strs("usernames", users).Msg("expiry reaper removed expired records")
+	} else {
+		log.Debug().Msg("expiry reaper found no expired record")
+	}
+	return len(users), nil
+}
+
+// Runs returns how many times the reaper ran.
+func (r *Reaper) Runs() uint64 {
+	return r.runs.Load()
+}
+
+// Purged returns how many records the reaper removed.
+func (r *Reaper) Purged() uint64 {
+	return r.purged.Load()
+}
+
+// Failures returns how many reaps failed to save the database.
+func (r *Reaper) Failures() uint64 {
+	return r.failed.Load()
+}
+
+// LastRun returns when the reaper ran for the last time.
+func (r *Reaper) LastRun() time.Time {
+	return time.Unix(0, r.lastRun.Load())
+}
+
+// Check returns an error if the last run failed, or if the reaper didn't run
+// for two intervals.
+func (r *Reaper) Check(now time.Time) error {
+	r.mu.Lock()
+	err := r.lastErr
+	r.mu.Unlock()
+	if err != nil {
+		return fmt.Errorf("last run failed: %w", err)
+	}
+	last := r.created
+	if r.lastRun.Load() > 0 {
+		last = r.LastRun()
+	}
+	if now.Sub(last) > 2*r.interval {
+		return fmt.Errorf("no run since %s", last.UTC().Format(time.RFC3339))
+	}
+	return nil
+}
@@ -0,0 +1,56 @@
+//
+// reaper_test.go
+// Copyright (C) 2024 rmelo <Ricardo Melo <rmelo@ludia.com>>
+//
+// Distributed under terms of the MIT license.
+//
+
+package db
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestReap(t *testing.T) {
+	d := newTestDatabase(t, BackendJSON, 0)
+	now := time.Now()
+	for _, u := range []UserRecord{
+		{Username: "expired1", ExpDate: now.Add(-time.Hour).Unix()},
+		{Username: "expired2", ExpDate: now.Unix()},
+		{Username: "active", ExpDate: now.Add(time.Hour).Unix()},
+		{Username: "forever"},
+	} {
+		if err := d.AddRecord(u); err != nil {
+			t.Fatal(err)
+		}
+	}
+	_, rev, _ := d.Changes.Since(0)
+
+	r := NewReaper(d, time.Minute)
+	n, err := r.Reap(now)
+	if err != nil || n != 2 {
+		t.Fatalf("expected 2 records purged, got %d, %v", n, err)
+	}
+	if r.Runs() != 1 || r.Purged() != 2 || r.Failures() != 0 || !r.LastRun().Equal(now) {
+		t.Fatalf("unexpected counters: runs %d, purged %d, failures %d, last run %s", r.Runs(), r.Purged(), r.Failures(), r.LastRun())
+	}
+	for _, user := range []string{"expired1", "expired2"} {
+		if _, err := d.LookupRecord(user); !errors.Is(err, ErrUserNotFound) {
+			t.Errorf("expected %s to be purged, got %v", user, err)
+		}
+	}
+	for _, user := range []string{"active", "forever"} {
+		if _, err := d.LookupRecord(user); err != nil {
+			t.Errorf("expected %s to be kept, got %v", user, err)
+		}
+	}
+	if users, _, _ := d.Changes.Since(rev); len(users) != 2 {
+		t.Errorf("purged users must be recorded in the change log, got %v", users)
+	}
+
+	if n, err := r.Reap(now); err != nil || n != 0 || r.Runs() != 2 || r.Purged() != 2 {
+		t.Fatalf("expected an empty second run, got %d, %v", n, err)
+	}
+}
@@ -0,0 +1,70 @@
+//
+// store.go
+// Copyright (C) 2024 rmelo <Ricardo Melo <rmelo@ludia.com>>
+//
+// Distributed under terms of the MIT license.
+//
+
+package db
+
+import (
+	"fmt"
+
+	"github.com/cropalato/squid-vault-auth/internal/conf"
+)
+
+// Storage backends supported by NewStore.
+const (
+	BackendJSON = "json"
+	BackendBolt = "bolt"
+)
+
+// Store is a storage backend for user records.
+// Implementations must be safe for concurrent use.
+type Store interface {
+	// Get returns the record of user, or ErrUserNotFound.
+	Get(user string) (*UserRecord, error)
+	// List returns all records.
+	List() ([]UserRecord, error)
+	// Add inserts a new record, or returns ErrUserExists.
+	Add(ur UserRecord) error
+	// Update replaces an existing record, or returns ErrUserNotFound.
+	Update(ur UserRecord) error
+	// Delete removes the record of user, or returns ErrUserNotFound.
+	Delete(user string) error
+	// DeleteMany removes the records of users in a single write, skipping
+	// missing ones, and returns the users removed. Nothing is removed on error.
+	DeleteMany(users []string) ([]string, error)
+	// Ping returns an error if the store can't be read.
+	Ping() error
+	// Check returns an error if the store can't be written.
+	Check() error
+	// Close releases the resources held by the store.
+	Close() error
+}
+
+// NewStore opens the storage backend selected by c.Backend.
+func NewStore(c *conf.Config) (Store, error) {
+	switch c.Backend {
+	case "", BackendJSON:
+		return NewJSONStore(c.DbPath)
+	case BackendBolt:
+		return NewBoltStore(c.DbPath)
+	}
+	return nil, fmt.Errorf("unknown database backend %q", c.Backend)
+}
+
+// copyRecord returns a copy of ur not sharing memory with it.
+func copyRecord(ur UserRecord) UserRecord {
+	if ur.Groups != nil {
+		ur.Groups = append([]string{}, ur.Groups...)
+	}
+	if ur.HA1 != nil {
+		ha1 := make(map[string]string, len(ur.HA1))
+		for realm, v := range ur.HA1 {
+			ha1[realm] = v
+		}
+		ur.HA1 = ha1
+	}
+	return ur
+}
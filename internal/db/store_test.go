@@ -0,0 +1,99 @@
+//
+// store_test.go
+// Copyright (C) 2024 rmelo <Ricardo Melo <rmelo@ludia.com>>
+//
+// Distributed under terms of the MIT license.
+//
+
+package db
+
+import (
+	"errors"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/cropalato/squid-vault-auth/internal/conf"
+)
+
+func openTestStore(t *testing.T, backend string, path string) Store {
+	t.Helper()
+	s, err := NewStore(&conf.Config{DbPath: path, Backend: backend})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func usernamesOf(users []UserRecord) string {
+	names := make([]string, len(users))
+	for i, u := range users {
+		names[i] = u.Username
+	}
+	return strings.Join(names, ",")
+}
+
+func TestStore(t *testing.T) {
+	for _, backend := range []string{BackendJSON, BackendBolt} {
+		t.Run(backend, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "squid-vault.db")
+			s := openTestStore(t, backend, path)
+
+			for _, tc := range []struct {
+				name string
+				op   func() error
+				want error
+			}{
+				{"add", func() error { return s.Add(UserRecord{Username: "bob", Password: "p1", Groups: []string{"g1"}}) }, nil},
+				{"add alice", func() error { return s.Add(UserRecord{Username: "alice", Password: "p1"}) }, nil},
+				{"add carol", func() error { return s.Add(UserRecord{Username: "carol", Password: "p1"}) }, nil},
+				{"add existing", func() error { return s.Add(UserRecord{Username: "bob", Password: "p2"}) }, ErrUserExists},
+				{"update", func() error { return s.Update(UserRecord{Username: "bob", Password: "p2", Groups: []string{"g2"}}) }, nil},
+				{"update unknown", func() error { return s.Update(UserRecord{Username: "dave"}) }, ErrUserNotFound},
+				{"delete", func() error { return s.Delete("carol") }, nil},
+				{"delete unknown", func() error { return s.Delete("carol") }, ErrUserNotFound},
+				{"ping", s.Ping, nil},
+				{"check", s.Check, nil},
+			} {
+				if err := tc.op(); !errors.Is(err, tc.want) {
+					t.Fatalf("%s: expected %v, got %v", tc.name, tc.want, err)
+				}
+			}
+			if _, err := s.Get("carol"); !errors.Is(err, ErrUserNotFound) {
+				t.Fatalf("expected ErrUserNotFound, got %v", err)
+			}
+
+			// records survive a restart.
+			if err := s.Close(); err != nil {
+				t.Fatal(err)
+			}
+			if s.Ping() == nil || s.Check() == nil {
+				t.Fatal("a closed store must fail its checks")
+			}
+			s = openTestStore(t, backend, path)
+			defer s.Close()
+			u, err := s.Get("bob")
+			if err != nil || u.Password != "p2" || strings.Join(u.Groups, ",") != "g2" {
+				t.Fatalf("unexpected record after reopen: %+v, %v", u, err)
+			}
+			list, err := s.List()
+			if err != nil || usernamesOf(list) != "alice,bob" {
+				t.Fatalf("unexpected records after reopen: %s, %v", usernamesOf(list), err)
+			}
+
+			// the returned records don't share memory with the store.
+			u.Groups[0] = "changed"
+			if u, _ := s.Get("bob"); u.Groups[0] != "g2" {
+				t.Fatal("records returned by Get must be copies")
+			}
+
+			deleted, err := s.DeleteMany([]string{"alice", "nobody", "bob"})
+			if err != nil || strings.Join(deleted, ",") != "alice,bob" {
+				t.Fatalf("unexpected DeleteMany result: %v, %v", deleted, err)
+			}
+			if list, _ := s.List(); len(list) != 0 {
+				t.Fatalf("expected no record left, got %s", usernamesOf(list))
+			}
+		})
+	}
+}
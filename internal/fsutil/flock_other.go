@@ -0,0 +1,21 @@
+//
+// flock_other.go
+// Copyright (C) 2024 rmelo <Ricardo Melo <rmelo@ludia.com>>
+//
+// Distributed under terms of the MIT license.
+//
+
+//go:build !unix
+
+package fsutil
+
+import "os"
+
+// lock is a no-op, advisory locks are only supported on unix systems.
+func lock(_ *os.File) error {
+	return nil
+}
+
+func unlock(_ *os.File) error {
+	return nil
+}
@@ -0,0 +1,121 @@
+//
+// fsutil.go
+// Copyright (C) 2024 rmelo <Ricardo Melo <rmelo@ludia.com>>
+//
+// Distributed under terms of the MIT license.
+//
+
+// Package with crash-safe file helpers.
+package fsutil
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// ErrLocked the file is locked by another process
+var ErrLocked = errors.New("file is locked by another process")
+
+// WriteFileAtomic replaces path with data.
+// data is written to a temporary file in the same directory, synced, and renamed
+// over path, so readers see either the old or the new content, never a truncated one.
+func WriteFileAtomic(path string, data []byte, perm os.FileMode) error {
+	dir, base := filepath.Split(path)
+	if dir == "" {
+		dir = "."
+	}
+	tmp, err := os.CreateTemp(dir, "."+base+".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		// no-op once the file has been renamed.
+		_ = os.Remove(tmp.Name())
+	}()
+	if _, err := tmp.Write(data); err != nil {
+		_ = tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		_ = tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), perm); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return err
+	}
+	return SyncDir(dir)
+}
+
+// SyncDir flushes the directory entries of dir, making a rename durable.
+func SyncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+// CheckWritable returns an error if the existing file path can't be opened
+// for writing, e.g. on a read-only filesystem. Nothing is written.
+func CheckWritable(path string) error {
+	f, err := os.OpenFile(path, os.O_WRONLY, 0)
+	if err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+// Lock is an exclusive advisory lock held on a file.
+type Lock struct {
+	f    *os.File
+	path string
+}
+
+// LockFile takes an exclusive advisory lock on path, creating the file if needed.
+// It returns ErrLocked if another process already holds the lock.
+func LockFile(path string) (*Lock, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0o600)
+	if err != nil {
+		return nil, err
+	}
+	if err := lock(f); err != nil {
+		_ = f.Close()
+		return nil, err
+	}
+	return &Lock{f: f, path: path}, nil
+}
+
+// Check returns an error if the lock file was removed or replaced: another
+// process could then lock the new file, and the lock no longer protects it.
+func (l *Lock) Check() error {
+	held, err := l.f.Stat()
+	if err != nil {
+		return err
+	}
+	current, err := os.Stat(l.path)
+	if err != nil {
+		return fmt.Errorf("lost lock %s: %w", l.path, err)
+	}
+	if !os.SameFile(held, current) {
+		return fmt.Errorf("lost lock %s: the file was replaced", l.path)
+	}
+	return nil
+}
+
+// Unlock releases the lock.
+func (l *Lock) Unlock() error {
+	if err := unlock(l.f); err != nil {
+		_ = l.f.Close()
+		return err
+	}
+	return l.f.Close()
+}
@@ -7,14 +7,36 @@
 
 package hash
 
-import "golang.org/x/crypto/bcrypt"
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// DefaultCost is the bcrypt cost used to hash user passwords.
+const DefaultCost = 14
 
 func HashPassword(password string) (string, error) {
-	bytes, err := bcrypt.GenerateFromPassword([]byte(password), 14)
+	return HashPasswordCost(password, DefaultCost)
+}
+
+// HashPasswordCost hashes password with bcrypt, using the given cost.
+func HashPasswordCost(password string, cost int) (string, error) {
+	defer observe("hash", time.Now())
+	bytes, err := bcrypt.GenerateFromPassword([]byte(password), cost)
 	return string(bytes), err
 }
 
 func CheckPasswordHash(password, hash string) bool {
+	defer observe("compare", time.Now())
 	err := bcrypt.CompareHashAndPassword([]byte(hash), []byte(password))
 	return err == nil
 }
+
+// DigestHA1 returns the HTTP digest HA1 of a credential: MD5(user:realm:password), hex encoded.
+func DigestHA1(user, realm, password string) string {
+	sum := md5.Sum([]byte(user + ":" + realm + ":" + password))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,18 @@
+//
+// hash_test.go
+// Copyright (C) 2024 rmelo <Ricardo Melo <rmelo@ludia.com>>
+//
+// Distributed under terms of the MIT license.
+//
+
+package hash
+
+import "testing"
+
+func TestDigestHA1(t *testing.T) {
+	// example of RFC 2617, section 3.5.
+	want := "939e7578ed9e3c518a452acee763bce9"
+	if got := DigestHA1("Mufasa", "testrealm@host.com", "Circle Of Life"); got != want {
+		t.Errorf("DigestHA1() = %s, want %s", got, want)
+	}
+}
@@ -0,0 +1,27 @@
+//
+// metrics.go
+// Copyright (C) 2024 rmelo <Ricardo Melo <rmelo@ludia.com>>
+//
+// Distributed under terms of the MIT license.
+//
+
+package hash
+
+import (
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// BcryptDuration measures the time spent hashing and comparing bcrypt passwords.
+var BcryptDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+	Namespace: "squiddb",
+	Name:      "bcrypt_duration_seconds",
+	Help:      "Time spent in bcrypt, by operation: hash or compare.",
+	Buckets:   prometheus.ExponentialBuckets(0.005, 2, 12),
+}, []string{"op"})
+
+// observe records the bcrypt operation op started at start.
+func observe(op string, start time.Time) {
+	BcryptDuration.WithLabelValues(op).Observe(time.Since(start).Seconds())
+}
@@ -0,0 +1,180 @@
+//
+// cache.go
+// Copyright (C) 2024 rmelo <Ricardo Melo <rmelo@ludia.com>>
+//
+// Distributed under terms of the MIT license.
+//
+
+package helper
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"sync"
+	"time"
+)
+
+// digest identifies a credential in the cache, without keeping it in clear text.
+type digest [sha256.Size]byte
+
+type cacheEntry struct {
+	user    string
+	reply   Reply
+	expires time.Time
+}
+
+// Cache keeps the replies given to recent credentials.
+// Successful replies are kept for positive TTL, denials for negative TTL.
+// Credentials are identified by a keyed digest, the key being random and
+// only known by the running process.
+// At most size replies are kept, so a client trying many passwords can't
+// grow it without limit.
+type Cache struct {
+	positive time.Duration
+	negative time.Duration
+	size     int
+	key      []byte
+
+	mu        sync.Mutex
+	entries   map[digest]cacheEntry
+	byUser    map[string]map[digest]struct{}
+	lastSweep time.Time
+}
+
+// NewCache creates an empty cache keeping up to size replies.
+// A zero TTL disables the matching cache.
+func NewCache(positive time.Duration, negative time.Duration, size int) (*Cache, error) {
+	if size <= 0 {
+		return nil, errors.New("cache size must be positive")
+	}
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+	return &Cache{
+		positive:  positive,
+		negative:  negative,
+		size:      size,
+		key:       key,
+		entries:   map[digest]cacheEntry{},
+		byUser:    map[string]map[digest]struct{}{},
+		lastSweep: time.Now(),
+	}, nil
+}
+
+func (c *Cache) digest(user string, password string) digest {
+	var d digest
+	m := hmac.New(sha256.New, c.key)
+	m.Write([]byte(user))
+	m.Write([]byte{0})
+	m.Write([]byte(password))
+	copy(d[:], m.Sum(nil))
+	return d
+}
+
+// Get returns the cached reply of a credential.
+func (c *Cache) Get(user string, password string) (Reply, bool) {
+	d := c.digest(user, password)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.entries[d]
+	if !ok || !time.Now().Before(e.expires) {
+		cacheLookups.WithLabelValues("miss").Inc()
+		return Reply{}, false
+	}
+	cacheLookups.WithLabelValues("hit").Inc()
+	return e.reply, true
+}
+
+// Put caches the reply given to a credential. BH replies are never cached.
+// A successful reply isn't kept after notAfter, when the user record expires.
+// A zero notAfter means the record never expires.
+func (c *Cache) Put(user string, password string, r Reply, notAfter time.Time) {
+	var ttl time.Duration
+	switch r.Result {
+	case ResultOK:
+		ttl = c.positive
+	case ResultERR:
+		ttl = c.negative
+	}
+	if ttl <= 0 {
+		return
+	}
+	d := c.digest(user, password)
+	now := time.Now()
+	expires := now.Add(ttl)
+	if r.Result == ResultOK && !notAfter.IsZero() && notAfter.Before(expires) {
+		expires = notAfter
+	}
+	if !expires.After(now) {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.entries[d]; !ok && len(c.entries) >= c.size {
+		c.sweep(now)
+		// still full: drop any entry, map iteration order being random.
+		for old, e := range c.entries {
+			if len(c.entries) < c.size {
+				break
+			}
+			c.remove(old, e.user)
+		}
+	}
+	c.entries[d] = cacheEntry{user: user, reply: r, expires: expires}
+	if c.byUser[user] == nil {
+		c.byUser[user] = map[digest]struct{}{}
+	}
+	c.byUser[user][d] = struct{}{}
+	if now.Sub(c.lastSweep) > max(c.positive, c.negative) {
+		c.sweep(now)
+	}
+}
+
+// sweep removes expired entries. The caller must hold the lock.
+func (c *Cache) sweep(now time.Time) {
+	for d, e := range c.entries {
+		if now.After(e.expires) {
+			c.remove(d, e.user)
+		}
+	}
+	c.lastSweep = now
+}
+
+// remove drops an entry. The caller must hold the lock.
+func (c *Cache) remove(d digest, user string) {
+	delete(c.entries, d)
+	delete(c.byUser[user], d)
+	if len(c.byUser[user]) == 0 {
+		delete(c.byUser, user)
+	}
+}
+
+// Evict drops all cached replies of users.
+func (c *Cache) Evict(users ...string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, u := range users {
+		for d := range c.byUser[u] {
+			delete(c.entries, d)
+		}
+		delete(c.byUser, u)
+	}
+}
+
+// Flush drops all cached replies.
+func (c *Cache) Flush() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entries = map[digest]cacheEntry{}
+	c.byUser = map[string]map[digest]struct{}{}
+}
+
+// Len returns how many replies are cached.
+func (c *Cache) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.entries)
+}
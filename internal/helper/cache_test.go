@@ -0,0 +1,109 @@
+//
+// cache_test.go
+// Copyright (C) 2024 rmelo <Ricardo Melo <rmelo@ludia.com>>
+//
+// Distributed under terms of the MIT license.
+//
+
+package helper
+
+import (
+	"testing"
+	"time"
+)
+
+func newTestCache(t *testing.T, positive time.Duration, negative time.Duration, size int) *Cache {
+	t.Helper()
+	c, err := NewCache(positive, negative, size)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func TestCache(t *testing.T) {
+	c := newTestCache(t, time.Hour, time.Hour, 100)
+	c.Put("bob", "pass", OK(), time.Time{})
+	c.Put("bob", "wrong", ERR("invalid password"), time.Time{})
+	c.Put("alice", "pass", BH("down"), time.Time{})
+
+	if r, ok := c.Get("bob", "pass"); !ok || r.Result != ResultOK {
+		t.Fatalf("expected a cached OK, got %v, %v", r, ok)
+	}
+	if r, ok := c.Get("bob", "wrong"); !ok || r.Result != ResultERR {
+		t.Fatalf("expected a cached ERR, got %v, %v", r, ok)
+	}
+	if _, ok := c.Get("bob", "other"); ok {
+		t.Fatal("a different password must not hit the cache")
+	}
+	if _, ok := c.Get("alice", "pass"); ok {
+		t.Fatal("BH replies must not be cached")
+	}
+
+	c.Put("alice", "pass", OK(), time.Time{})
+	c.Evict("bob")
+	if _, ok := c.Get("bob", "pass"); ok {
+		t.Fatal("evicted users must not hit the cache")
+	}
+	if _, ok := c.Get("alice", "pass"); !ok || c.Len() != 1 {
+		t.Fatalf("Evict must only drop the given users, %d entries left", c.Len())
+	}
+	c.Flush()
+	if c.Len() != 0 {
+		t.Fatalf("expected an empty cache after Flush, got %d entries", c.Len())
+	}
+}
+
+func TestCacheTTL(t *testing.T) {
+	c := newTestCache(t, time.Hour, 0, 100)
+	c.Put("bob", "wrong", ERR("invalid password"), time.Time{})
+	if _, ok := c.Get("bob", "wrong"); ok {
+		t.Fatal("a zero negative TTL must disable the negative cache")
+	}
+
+	c = newTestCache(t, 20*time.Millisecond, time.Hour, 100)
+	c.Put("bob", "pass", OK(), time.Time{})
+	time.Sleep(30 * time.Millisecond)
+	if _, ok := c.Get("bob", "pass"); ok {
+		t.Fatal("entries must expire after their TTL")
+	}
+}
+
+func TestCacheUserExpiry(t *testing.T) {
+	c := newTestCache(t, time.Hour, time.Hour, 100)
+	c.Put("bob", "pass", OK(), time.Now().Add(20*time.Millisecond))
+	c.Put("alice", "pass", OK(), time.Now().Add(-time.Second))
+	if _, ok := c.Get("bob", "pass"); !ok {
+		t.Fatal("expected a cached OK before the user expires")
+	}
+	if _, ok := c.Get("alice", "pass"); ok {
+		t.Fatal("an expired user must not be cached")
+	}
+	time.Sleep(30 * time.Millisecond)
+	if _, ok := c.Get("bob", "pass"); ok {
+		t.Fatal("a cached OK must not outlive the user expiration date")
+	}
+}
+
+func TestCacheSize(t *testing.T) {
+	if _, err := NewCache(time.Hour, time.Hour, 0); err == nil {
+		t.Fatal("a zero size must be refused")
+	}
+	c := newTestCache(t, time.Hour, time.Hour, 10)
+	for i := 0; i < 100; i++ {
+		c.Put("bob", string(rune('a'+i)), ERR("invalid password"), time.Time{})
+		if c.Len() > 10 {
+			t.Fatalf("expected at most 10 entries, got %d", c.Len())
+		}
+	}
+	// replacing an entry doesn't evict another one.
+	c.Put("alice", "pass", OK(), time.Time{})
+	n := c.Len()
+	c.Put("alice", "pass", OK(), time.Time{})
+	if c.Len() != n {
+		t.Fatalf("replacing an entry must not change the size, got %d then %d", n, c.Len())
+	}
+	if _, ok := c.Get("alice", "pass"); !ok {
+		t.Fatal("expected the last entry to be cached")
+	}
+}
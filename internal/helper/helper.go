@@ -0,0 +1,67 @@
+//
+// helper.go
+// Copyright (C) 2024 rmelo <Ricardo Melo <rmelo@ludia.com>>
+//
+// Distributed under terms of the MIT license.
+//
+
+// Package implementing the squid helper protocol.
+package helper
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+)
+
+// Handler answers one squid request. fields are the decoded fields of the
+// request line, without channel-ID.
+type Handler func(fields []string) Reply
+
+// Serve reads squid requests from r and writes the replies to w.
+// It returns when r reaches EOF, after all pending requests are answered.
+//
+// With concurrency set to 0, requests are answered one at a time, in order.
+// Otherwise each request line starts with a channel-ID, up to concurrency
+// requests are processed in parallel, and replies are written as soon as they
+// are ready, tagged with the channel-ID of their request.
+func Serve(r io.Reader, w io.Writer, concurrency int, h Handler) error {
+	s := bufio.NewScanner(r)
+	var mu sync.Mutex
+	reply := func(line string) {
+		mu.Lock()
+		defer mu.Unlock()
+		_, _ = fmt.Fprintln(w, line)
+	}
+	handle := func(line string) Reply {
+		fields, err := Fields(line)
+		if err != nil {
+			return BH("invalid request: " + err.Error())
+		}
+		return h(fields)
+	}
+
+	if concurrency <= 0 {
+		for s.Scan() {
+			reply(handle(s.Text()).String())
+		}
+		return s.Err()
+	}
+
+	workers := make(chan struct{}, concurrency)
+	var wg sync.WaitGroup
+	for s.Scan() {
+		id, line, _ := strings.Cut(s.Text(), " ")
+		workers <- struct{}{}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer func() { <-workers }()
+			reply(id + " " + handle(line).String())
+		}()
+	}
+	wg.Wait()
+	return s.Err()
+}
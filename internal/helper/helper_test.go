@@ -0,0 +1,129 @@
+//
+// helper_test.go
+// Copyright (C) 2024 rmelo <Ricardo Melo <rmelo@ludia.com>>
+//
+// Distributed under terms of the MIT license.
+//
+
+package helper
+
+import (
+	"bytes"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// echo replies OK with the request fields joined by '+'.
+func echo(fields []string) Reply {
+	return OK().With("f", strings.Join(fields, "+"))
+}
+
+func TestServeSequential(t *testing.T) {
+	var out bytes.Buffer
+	in := strings.NewReader("bob pass\nalice secret\n")
+	if err := Serve(in, &out, 0, echo); err != nil {
+		t.Fatal(err)
+	}
+	want := "OK f=bob+pass\nOK f=alice+secret\n"
+	if out.String() != want {
+		t.Fatalf("expected %q, got %q", want, out.String())
+	}
+}
+
+func TestServeConcurrent(t *testing.T) {
+	// the first request is slow, so its reply is written last, with its channel-ID.
+	release := make(chan struct{})
+	h := func(fields []string) Reply {
+		if fields[0] == "slow" {
+			<-release
+		}
+		return echo(fields)
+	}
+	r, w := io.Pipe()
+	var out syncBuffer
+	done := make(chan error)
+	go func() { done <- Serve(r, &out, 2, h) }()
+	if _, err := io.WriteString(w, "0 slow x\n1 fast y\n"); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, func() bool { return out.String() == "1 OK f=fast+y\n" })
+	close(release)
+	_ = w.Close()
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	if want := "1 OK f=fast+y\n0 OK f=slow+x\n"; out.String() != want {
+		t.Fatalf("expected %q, got %q", want, out.String())
+	}
+}
+
+func TestServeBoundedConcurrency(t *testing.T) {
+	const concurrency = 3
+	var running, peak atomic.Int32
+	h := func(fields []string) Reply {
+		n := running.Add(1)
+		for {
+			p := peak.Load()
+			if n <= p || peak.CompareAndSwap(p, n) {
+				break
+			}
+		}
+		time.Sleep(5 * time.Millisecond)
+		running.Add(-1)
+		return echo(fields)
+	}
+	var in strings.Builder
+	var want []string
+	for i := 0; i < 20; i++ {
+		id := string(rune('a' + i))
+		in.WriteString(id + " user" + id + "\n")
+		want = append(want, id+" OK f=user"+id)
+	}
+	var out syncBuffer
+	if err := Serve(strings.NewReader(in.String()), &out, concurrency, h); err != nil {
+		t.Fatal(err)
+	}
+	if p := peak.Load(); p > concurrency || p < 2 {
+		t.Fatalf("expected up to %d requests in parallel, got %d", concurrency, p)
+	}
+	// all requests are answered before Serve returns at EOF.
+	got := strings.Split(strings.TrimSpace(out.String()), "\n")
+	sort.Strings(got)
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Fatalf("expected replies %q, got %q", want, got)
+	}
+}
+
+// syncBuffer is a bytes.Buffer safe for concurrent use.
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+func waitFor(t *testing.T, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("timeout")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
@@ -0,0 +1,150 @@
+//
+// metrics.go
+// Copyright (C) 2024 rmelo <Ricardo Melo <rmelo@ludia.com>>
+//
+// Distributed under terms of the MIT license.
+//
+
+package helper
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/cropalato/squid-vault-auth/internal/varenv"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+var (
+	requests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "squiddb_helper",
+		Name:      "requests_total",
+		Help:      "Requests answered by the helper, by result: OK, ERR or BH.",
+	}, []string{"helper", "result"})
+
+	duration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "squiddb_helper",
+		Name:      "request_duration_seconds",
+		Help:      "Time spent answering requests, by result.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"helper", "result"})
+
+	cacheLookups = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "squiddb_helper",
+		Name:      "cache_lookups_total",
+		Help:      "Lookups in the reply cache, by result: hit or miss.",
+	}, []string{"result"})
+
+	// OfflineReplies counts the requests answered from the offline snapshot.
+	OfflineReplies = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "squiddb_helper",
+		Name:      "offline_replies_total",
+		Help:      "Requests answered from the offline snapshot, squid db service being unreachable.",
+	})
+)
+
+// Instrument returns h, counting and timing its replies under the helper name.
+func Instrument(name string, h Handler) Handler {
+	return func(fields []string) Reply {
+		start := time.Now()
+		r := h(fields)
+		requests.WithLabelValues(name, r.Result).Inc()
+		duration.WithLabelValues(name, r.Result).Observe(time.Since(start).Seconds())
+		return r
+	}
+}
+
+// MetricsConfig selects how a helper exposes its metrics. Both are disabled when empty.
+type MetricsConfig struct {
+	// Listen is the address of the local /metrics endpoint.
+	Listen string
+	// Textfile is written for the node exporter textfile collector.
+	// '{pid}' is replaced by the process id, as squid runs several helpers.
+	Textfile string
+	// Interval is how often Textfile is written.
+	Interval time.Duration
+}
+
+// RegisterMetricsFlags defines the metrics flags in fs, using SQUIDDB_METRICS_* env variables as defaults.
+func RegisterMetricsFlags(fs *flag.FlagSet) *MetricsConfig {
+	c := &MetricsConfig{}
+	fs.StringVar(&c.Listen, "metrics_listen", varenv.LookupEnvOrString("SQUIDDB_METRICS_LISTEN", ""), "address serving the helper metrics on /metrics. format: '[<ip>]:<port>'. Disabled when empty")
+	fs.StringVar(&c.Textfile, "metrics_textfile", varenv.LookupEnvOrString("SQUIDDB_METRICS_TEXTFILE", ""), "file the helper metrics are written to, for the node exporter textfile collector. '{pid}' is replaced by the process id. Disabled when empty")
+	fs.DurationVar(&c.Interval, "metrics_textfile_interval", varenv.LookupEnvOrDuration("SQUIDDB_METRICS_TEXTFILE_INTERVAL", 15*time.Second), "how often the metrics textfile is written")
+	return c
+}
+
+// StartMetrics exposes the helper metrics as configured in c. The returned
+// function stops it, writing the textfile one last time.
+// Failures are logged and never stop the helper, as squid runs several of
+// them and only one can listen on a given address.
+func StartMetrics(c MetricsConfig) (stop func()) {
+	if c.Listen == "" && c.Textfile == "" {
+		return func() {}
+	}
+	reg := prometheus.NewRegistry()
+	reg.MustRegister(collectors.NewGoCollector(), collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}), requests, duration, cacheLookups, OfflineReplies)
+	ctx, cancel := context.WithCancel(context.Background())
+	var srv *http.Server
+	if c.Listen != "" {
+		mux := http.NewServeMux()
+		mux.Handle("/metrics", promhttp.HandlerFor(reg, promhttp.HandlerOpts{}))
+		srv = &http.Server{Addr: c.Listen, Handler: mux, ReadHeaderTimeout: 2 * time.Second}
+		go func() {
+			if err := srv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+				log.Printf("failed serving metrics on %s: %s", c.Listen, err)
+			}
+		}()
+	}
+	path := strings.ReplaceAll(c.Textfile, "{pid}", strconv.Itoa(os.Getpid()))
+	done := make(chan struct{})
+	if c.Textfile != "" && c.Interval > 0 {
+		go func() {
+			defer close(done)
+			writeTextfile(ctx, reg, path, c.Interval)
+		}()
+	} else {
+		close(done)
+	}
+	return func() {
+		cancel()
+		<-done
+		if srv != nil {
+			_ = srv.Close()
+		}
+		if c.Textfile != "" {
+			writeMetrics(reg, path)
+		}
+	}
+}
+
+// writeTextfile writes the metrics of g to path every interval, until ctx is done.
+func writeTextfile(ctx context.Context, g prometheus.Gatherer, path string, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		writeMetrics(g, path)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// writeMetrics writes the metrics of g to path. WriteToTextfile renames a
+// temporary file, so the collector never reads a partial file.
+func writeMetrics(g prometheus.Gatherer, path string) {
+	if err := prometheus.WriteToTextfile(path, g); err != nil {
+		log.Printf("failed writing metrics to %s: %s", path, err)
+	}
+}
@@ -0,0 +1,75 @@
+//
+// reply.go
+// Copyright (C) 2024 rmelo <Ricardo Melo <rmelo@ludia.com>>
+//
+// Distributed under terms of the MIT license.
+//
+
+package helper
+
+import (
+	"net/url"
+	"strings"
+)
+
+// Results of a squid helper reply.
+const (
+	ResultOK  = "OK"
+	ResultERR = "ERR"
+	ResultBH  = "BH"
+)
+
+// Reply is a squid helper reply: a result followed by kv-pairs.
+type Reply struct {
+	Result string
+	pairs  []string
+}
+
+// OK returns a successful reply.
+func OK() Reply {
+	return Reply{Result: ResultOK}
+}
+
+// ERR returns a reply denying the request. reason is shown on the error page
+// and in the access log.
+func ERR(reason string) Reply {
+	return Reply{Result: ResultERR}.With("message", reason).With("log", reason)
+}
+
+// BH returns a reply reporting the helper failed to process the request.
+func BH(reason string) Reply {
+	return Reply{Result: ResultBH}.With("message", reason).With("log", reason)
+}
+
+// With returns a copy of r with the kv-pair key=value appended.
+func (r Reply) With(key string, value string) Reply {
+	r.pairs = append(append([]string{}, r.pairs...), key+"="+quote(value))
+	return r
+}
+
+// String formats the reply as expected by squid.
+func (r Reply) String() string {
+	return strings.Join(append([]string{r.Result}, r.pairs...), " ")
+}
+
+// quote returns value as a kv-pair value, quoted if needed.
+func quote(value string) string {
+	if value != "" && !strings.ContainsAny(value, " \t\"\\\r\n") {
+		return value
+	}
+	r := strings.NewReplacer("\\", "\\\\", "\"", "\\\"", "\r", "\\r", "\n", "\\n", "\t", "\\t")
+	return "\"" + r.Replace(value) + "\""
+}
+
+// Fields splits a squid request line and decodes its URL-encoded fields.
+func Fields(line string) ([]string, error) {
+	fields := strings.Fields(line)
+	for i, f := range fields {
+		v, err := url.PathUnescape(f)
+		if err != nil {
+			return nil, err
+		}
+		fields[i] = v
+	}
+	return fields, nil
+}
@@ -0,0 +1,73 @@
+//
+// reply_test.go
+// Copyright (C) 2024 rmelo <Ricardo Melo <rmelo@ludia.com>>
+//
+// Distributed under terms of the MIT license.
+//
+
+package helper
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestWireFormat(t *testing.T) {
+	// the handler replies with the kind asked by the first field, and the
+	// decoded second field as message.
+	h := func(fields []string) Reply {
+		switch fields[0] {
+		case "ok":
+			return OK().With("user", fields[1])
+		case "err":
+			return ERR(fields[1])
+		}
+		return BH(fields[1])
+	}
+	for _, tc := range []struct {
+		name string
+		in   string
+		want string
+	}{
+		{"plain", "ok bob", `OK user=bob`},
+		{"url-encoded space", "ok john%20doe", `OK user="john doe"`},
+		{"url-encoded quote and backslash", `ok a%22b%5Cc`, `OK user="a\"b\\c"`},
+		{"url-encoded newline and tab", "ok a%0Ab%09c%0D", `OK user="a\nb\tc\r"`},
+		{"space only", "ok %20", `OK user=" "`},
+		{"err message and log", "err invalid%20password", `ERR message="invalid password" log="invalid password"`},
+		{"bh", "bh down", `BH message=down log=down`},
+		{"invalid escape", "ok bad%zz", `BH message="invalid request: invalid URL escape \"%zz\"" log="invalid request: invalid URL escape \"%zz\""`},
+		{"extra spaces", "ok   bob  ", `OK user=bob`},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var out bytes.Buffer
+			if err := Serve(strings.NewReader(tc.in+"\n"), &out, 0, h); err != nil {
+				t.Fatal(err)
+			}
+			if got := strings.TrimSuffix(out.String(), "\n"); got != tc.want {
+				t.Fatalf("expected %s, got %s", tc.want, got)
+			}
+		})
+	}
+}
+
+func TestWireFormatConcurrent(t *testing.T) {
+	var out bytes.Buffer
+	in := "7 john%20doe pass%25word\n"
+	h := func(fields []string) Reply {
+		return OK().With("user", fields[0]).With("password", fields[1])
+	}
+	if err := Serve(strings.NewReader(in), &out, 1, h); err != nil {
+		t.Fatal(err)
+	}
+	if want := "7 OK user=\"john doe\" password=pass%word\n"; out.String() != want {
+		t.Fatalf("expected %q, got %q", want, out.String())
+	}
+}
+
+func TestEmptyValue(t *testing.T) {
+	if got := OK().With("note", "").String(); got != `OK note=""` {
+		t.Fatalf("expected an empty value to be quoted, got %s", got)
+	}
+}
@@ -0,0 +1,196 @@
+//
+// fallback.go
+// Copyright (C) 2024 rmelo <Ricardo Melo <rmelo@ludia.com>>
+//
+// Distributed under terms of the MIT license.
+//
+
+package snapshot
+
+import (
+	"context"
+	"crypto/ed25519"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/fs"
+	"log"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/cropalato/squid-vault-auth/internal/client"
+	"github.com/cropalato/squid-vault-auth/internal/fsutil"
+	"github.com/cropalato/squid-vault-auth/internal/varenv"
+)
+
+// ErrStale the snapshot is missing or older than the maximum staleness
+var ErrStale = errors.New("no usable offline snapshot")
+
+// errOlder the snapshot is older than the current one
+var errOlder = errors.New("snapshot is older than the current one")
+
+// Config of a Fallback.
+type Config struct {
+	// Path is the local copy of the snapshot. The fallback is disabled when empty.
+	Path string
+	// PublicKey is the ed25519 public key (PEM) checking snapshot signatures.
+	PublicKey string
+	// Interval between two snapshot refreshes.
+	Interval time.Duration
+	// MaxAge is the maximum staleness of a snapshot used to answer requests.
+	MaxAge time.Duration
+}
+
+// RegisterFlags defines the fallback flags in fs, using SQUIDDB_* env variables as defaults.
+func RegisterFlags(fs *flag.FlagSet) *Config {
+	c := &Config{}
+	fs.StringVar(&c.Path, "snapshot_path", varenv.LookupEnvOrString("SQUIDDB_SNAPSHOT_PATH", ""), "local copy of the offline snapshot, used when squid db service is unreachable. Disabled when empty")
+	fs.StringVar(&c.PublicKey, "snapshot_pubkey", varenv.LookupEnvOrString("SQUIDDB_SNAPSHOT_PUBKEY", ""), "ed25519 public key (PEM) checking the offline snapshot signature")
+	fs.DurationVar(&c.Interval, "snapshot_interval", varenv.LookupEnvOrDuration("SQUIDDB_SNAPSHOT_INTERVAL", 5*time.Minute), "delay between two offline snapshot refreshes")
+	fs.DurationVar(&c.MaxAge, "snapshot_max_age", varenv.LookupEnvOrDuration("SQUIDDB_SNAPSHOT_MAX_AGE", 24*time.Hour), "maximum staleness of the offline snapshot")
+	return c
+}
+
+// Start creates the fallback described by cfg, and refreshes it in background
+// until ctx is done. It returns nil if the fallback is disabled.
+func Start(ctx context.Context, cfg Config, c *client.Client) (*Fallback, error) {
+	if cfg.Path == "" {
+		return nil, nil
+	}
+	if cfg.PublicKey == "" {
+		return nil, errors.New("snapshot_pubkey is required to use an offline snapshot")
+	}
+	pub, err := LoadPublicKey(cfg.PublicKey)
+	if err != nil {
+		return nil, err
+	}
+	f, err := NewFallback(cfg.Path, pub, cfg.MaxAge)
+	if err != nil {
+		return nil, err
+	}
+	go f.Run(ctx, c, cfg.Interval)
+	return f, nil
+}
+
+// Fallback keeps a local copy of the last snapshot fetched from squid db service.
+// Helpers answer from it while squid db service is unreachable.
+// Switches between online and offline modes are logged on stderr, so they
+// show up in squid cache.log.
+type Fallback struct {
+	path   string
+	pub    ed25519.PublicKey
+	maxAge time.Duration
+
+	mu      sync.RWMutex
+	current *Snapshot
+	offline bool
+}
+
+// NewFallback creates a fallback stored in path, accepting snapshots signed by
+// pub and younger than maxAge. A valid snapshot already in path is loaded.
+func NewFallback(path string, pub ed25519.PublicKey, maxAge time.Duration) (*Fallback, error) {
+	f := &Fallback{path: path, pub: pub, maxAge: maxAge}
+	content, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return f, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := f.load(content); err != nil {
+		log.Printf("ignoring offline snapshot %s: %s", path, err)
+	}
+	return f, nil
+}
+
+// load checks and installs a serialized envelope.
+// Snapshots older than the current one are refused.
+func (f *Fallback) load(content []byte) error {
+	var e Envelope
+	if err := json.Unmarshal(content, &e); err != nil {
+		return err
+	}
+	s, err := e.Open(f.pub)
+	if err != nil {
+		return err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.current != nil && s.GeneratedAt < f.current.GeneratedAt {
+		return errOlder
+	}
+	f.current = s
+	return nil
+}
+
+// Refresh fetches a new snapshot from squid db service, and stores it in path
+// once it is accepted.
+func (f *Fallback) Refresh(ctx context.Context, c *client.Client) error {
+	var e Envelope
+	status, err := c.Do(ctx, http.MethodGet, "/api/v1/snapshot", nil, &e)
+	if err != nil {
+		return err
+	}
+	if status != http.StatusOK {
+		return fmt.Errorf("status code %d", status)
+	}
+	content, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	if err := f.load(content); err != nil {
+		return err
+	}
+	return fsutil.WriteFileAtomic(f.path, content, 0o600)
+}
+
+// Run refreshes the snapshot every interval until ctx is done.
+func (f *Fallback) Run(ctx context.Context, c *client.Client, interval time.Duration) {
+	for {
+		if err := f.Refresh(ctx, c); err != nil {
+			log.Printf("failed refreshing offline snapshot: %s", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(interval):
+		}
+	}
+}
+
+// Snapshot returns the current snapshot, or ErrStale if it is missing or too old.
+// It marks the helper as offline.
+func (f *Fallback) Snapshot(now time.Time) (*Snapshot, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if !f.offline {
+		f.offline = true
+		log.Printf("squid db service unreachable, answering from offline snapshot %s", f.path)
+	}
+	if f.current == nil {
+		return nil, ErrStale
+	}
+	if age := f.current.Age(now); age > f.maxAge {
+		return nil, fmt.Errorf("%w: snapshot is %s old", ErrStale, age.Round(time.Second))
+	}
+	return f.current, nil
+}
+
+// Online marks the helper as online again.
+func (f *Fallback) Online() {
+	f.mu.RLock()
+	offline := f.offline
+	f.mu.RUnlock()
+	if !offline {
+		return
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.offline {
+		f.offline = false
+		log.Printf("squid db service reachable again, leaving offline snapshot")
+	}
+}
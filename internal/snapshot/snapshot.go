@@ -0,0 +1,124 @@
+//
+// snapshot.go
+// Copyright (C) 2024 rmelo <Ricardo Melo <rmelo@ludia.com>>
+//
+// Distributed under terms of the MIT license.
+//
+
+// Package implementing signed, read-only snapshots of the user records.
+// Helpers keep a snapshot on disk, and use it when squid db service is unreachable.
+package snapshot
+
+import (
+	"crypto/ed25519"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/cropalato/squid-vault-auth/internal/db"
+)
+
+// ErrInvalidSignature the snapshot wasn't signed by the expected key
+var ErrInvalidSignature = errors.New("invalid snapshot signature")
+
+// Snapshot is a read-only copy of the user records.
+type Snapshot struct {
+	GeneratedAt int64           `json:"generated_at"`
+	ExpiryGrace time.Duration   `json:"expiry_grace"`
+	Users       []db.UserRecord `json:"users"`
+
+	index map[string]*db.UserRecord
+}
+
+// Envelope is a signed snapshot, as served by squid db service and stored by helpers.
+type Envelope struct {
+	Payload   []byte `json:"payload"`
+	Signature []byte `json:"signature"`
+}
+
+// Sign serializes and signs s with key.
+func Sign(key ed25519.PrivateKey, s *Snapshot) (*Envelope, error) {
+	payload, err := json.Marshal(s)
+	if err != nil {
+		return nil, err
+	}
+	return &Envelope{Payload: payload, Signature: ed25519.Sign(key, payload)}, nil
+}
+
+// Open checks the envelope signature with pub and returns the snapshot it holds.
+func (e *Envelope) Open(pub ed25519.PublicKey) (*Snapshot, error) {
+	if !ed25519.Verify(pub, e.Payload, e.Signature) {
+		return nil, ErrInvalidSignature
+	}
+	var s Snapshot
+	if err := json.Unmarshal(e.Payload, &s); err != nil {
+		return nil, err
+	}
+	s.index = make(map[string]*db.UserRecord, len(s.Users))
+	for i := range s.Users {
+		s.index[s.Users[i].Username] = &s.Users[i]
+	}
+	return &s, nil
+}
+
+// Lookup returns the record of user, or nil if it isn't in the snapshot.
+func (s *Snapshot) Lookup(user string) *db.UserRecord {
+	return s.index[user]
+}
+
+// Age returns how old the snapshot is at now.
+func (s *Snapshot) Age(now time.Time) time.Duration {
+	return now.Sub(time.Unix(s.GeneratedAt, 0))
+}
+
+// LoadPrivateKey reads a PEM encoded PKCS #8 ed25519 private key.
+// It can be generated with 'openssl genpkey -algorithm ed25519 -out snapshot.pem'.
+func LoadPrivateKey(path string) (ed25519.PrivateKey, error) {
+	block, err := readPEM(path)
+	if err != nil {
+		return nil, err
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("invalid private key %s: %w", path, err)
+	}
+	k, ok := key.(ed25519.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("invalid private key %s: not an ed25519 key", path)
+	}
+	return k, nil
+}
+
+// LoadPublicKey reads a PEM encoded PKIX ed25519 public key.
+// It can be generated with 'openssl pkey -in snapshot.pem -pubout -out snapshot.pub'.
+func LoadPublicKey(path string) (ed25519.PublicKey, error) {
+	block, err := readPEM(path)
+	if err != nil {
+		return nil, err
+	}
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("invalid public key %s: %w", path, err)
+	}
+	k, ok := key.(ed25519.PublicKey)
+	if !ok {
+		return nil, fmt.Errorf("invalid public key %s: not an ed25519 key", path)
+	}
+	return k, nil
+}
+
+func readPEM(path string) (*pem.Block, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(content)
+	if block == nil {
+		return nil, fmt.Errorf("no PEM data found in %s", path)
+	}
+	return block, nil
+}
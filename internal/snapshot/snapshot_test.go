@@ -0,0 +1,142 @@
+//
+// snapshot_test.go
+// Copyright (C) 2024 rmelo <Ricardo Melo <rmelo@ludia.com>>
+//
+// Distributed under terms of the MIT license.
+//
+
+package snapshot
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/cropalato/squid-vault-auth/internal/client"
+	"github.com/cropalato/squid-vault-auth/internal/db"
+)
+
+func newKey(t *testing.T) (ed25519.PublicKey, ed25519.PrivateKey) {
+	pub, key, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pub, key
+}
+
+func sign(t *testing.T, key ed25519.PrivateKey, generatedAt time.Time, users ...string) *Envelope {
+	s := &Snapshot{GeneratedAt: generatedAt.Unix(), Users: []db.UserRecord{}}
+	for _, u := range users {
+		s.Users = append(s.Users, db.UserRecord{Username: u, Groups: []string{}})
+	}
+	e, err := Sign(key, s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return e
+}
+
+func TestOpen(t *testing.T) {
+	pub, key := newKey(t)
+	other, _ := newKey(t)
+	e := sign(t, key, time.Now(), "bob")
+
+	s, err := e.Open(pub)
+	if err != nil {
+		t.Fatalf("Open() error = %v", err)
+	}
+	if s.Lookup("bob") == nil || s.Lookup("alice") != nil {
+		t.Errorf("Lookup() doesn't match the signed users: %+v", s.Users)
+	}
+
+	tampered := &Envelope{Payload: bytes.Replace(e.Payload, []byte("bob"), []byte("eve"), 1), Signature: e.Signature}
+	if _, err := tampered.Open(pub); !errors.Is(err, ErrInvalidSignature) {
+		t.Errorf("Open() of a tampered payload error = %v, want ErrInvalidSignature", err)
+	}
+	if _, err := e.Open(other); !errors.Is(err, ErrInvalidSignature) {
+		t.Errorf("Open() with the wrong key error = %v, want ErrInvalidSignature", err)
+	}
+}
+
+func TestFallbackStale(t *testing.T) {
+	pub, key := newKey(t)
+	path := filepath.Join(t.TempDir(), "snapshot.json")
+	now := time.Now()
+	content, _ := json.Marshal(sign(t, key, now.Add(-2*time.Hour), "bob"))
+	if err := os.WriteFile(path, content, 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := NewFallback(path, pub, 3*time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s, err := f.Snapshot(now); err != nil || s.Lookup("bob") == nil {
+		t.Fatalf("Snapshot() = %v, %v, want the stored snapshot", s, err)
+	}
+	if _, err := f.Snapshot(now.Add(2 * time.Hour)); !errors.Is(err, ErrStale) {
+		t.Errorf("Snapshot() of a stale snapshot error = %v, want ErrStale", err)
+	}
+
+	empty, err := NewFallback(filepath.Join(t.TempDir(), "missing.json"), pub, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := empty.Snapshot(now); !errors.Is(err, ErrStale) {
+		t.Errorf("Snapshot() without snapshot error = %v, want ErrStale", err)
+	}
+}
+
+func TestRefresh(t *testing.T) {
+	pub, key := newKey(t)
+	_, otherKey := newKey(t)
+	now := time.Now()
+	var served *Envelope
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_ = json.NewEncoder(w).Encode(served)
+	}))
+	defer srv.Close()
+	c, err := client.New(client.Config{URL: srv.URL, Timeout: time.Second})
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "snapshot.json")
+	f, err := NewFallback(path, pub, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	served = sign(t, key, now, "bob")
+	if err := f.Refresh(context.Background(), c); err != nil {
+		t.Fatalf("Refresh() error = %v", err)
+	}
+	stored, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("snapshot wasn't stored: %v", err)
+	}
+
+	// older snapshots, e.g. from a lagging endpoint, and badly signed ones are refused and not stored.
+	for name, e := range map[string]*Envelope{
+		"older":     sign(t, key, now.Add(-time.Minute), "alice"),
+		"wrong key": sign(t, otherKey, now.Add(time.Minute), "alice"),
+	} {
+		served = e
+		if err := f.Refresh(context.Background(), c); err == nil {
+			t.Errorf("%s: Refresh() succeeded, want an error", name)
+		}
+		if content, _ := os.ReadFile(path); !bytes.Equal(content, stored) {
+			t.Errorf("%s: refused snapshot was stored", name)
+		}
+		if s, _ := f.Snapshot(now); s == nil || s.Lookup("bob") == nil {
+			t.Errorf("%s: refused snapshot replaced the current one", name)
+		}
+	}
+}
@@ -8,7 +8,9 @@
 package squid
 
 import (
+	"bytes"
 	"context"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
@@ -16,6 +18,7 @@ import (
 	"sync"
 	"time"
 
+	"github.com/cropalato/squid-vault-auth/internal/tlsutil"
 	"github.com/hashicorp/go-secure-stdlib/parseutil"
 	dbplugin "github.com/hashicorp/vault/sdk/database/dbplugin/v5"
 	"github.com/hashicorp/vault/sdk/database/helper/connutil"
@@ -27,10 +30,17 @@ type squidConnectionProducer struct {
 	ConnectionURL     string      `json:"connection_url"   mapstructure:"connection_url"  structs:"connection_url"`
 	Username          string      `json:"username"         mapstructure:"username"        structs:"username"`
 	Password          string      `json:"password"         mapstructure:"password"        structs:"password"`
+	Token             string      `json:"token"            mapstructure:"token"           structs:"token"`
 	ConnectTimeoutRaw interface{} `json:"connect_timeout" structs:"connect_timeout" mapstructure:"connect_timeout"`
+	// TLSCA, TLSCert and TLSKey are PEM content or files.
+	TLSCA              string `json:"tls_ca"               mapstructure:"tls_ca"               structs:"tls_ca"`
+	TLSCert            string `json:"tls_cert"             mapstructure:"tls_cert"             structs:"tls_cert"`
+	TLSKey             string `json:"tls_key"              mapstructure:"tls_key"              structs:"tls_key"`
+	InsecureSkipVerify bool   `json:"insecure_skip_verify" mapstructure:"insecure_skip_verify" structs:"insecure_skip_verify"`
 
 	rawConfig      map[string]interface{}
 	connectTimeout time.Duration
+	httpClient     *http.Client
 	Initialized    bool
 	Type           string
 	sync.Mutex
@@ -56,12 +66,26 @@ func (s *squidConnectionProducer) Initialize(ctx context.Context, req dbplugin.I
 	switch {
 	case len(s.ConnectionURL) == 0:
 		return dbplugin.InitializeResponse{}, fmt.Errorf("connection_url cannot be empty")
+	case len(s.Token) > 0:
+		// username and password are optional with a token.
 	case len(s.Username) == 0:
 		return dbplugin.InitializeResponse{}, fmt.Errorf("username cannot be empty")
 	case len(s.Password) == 0:
 		return dbplugin.InitializeResponse{}, fmt.Errorf("password cannot be empty")
 	}
 
+	tlsCfg := tlsutil.ClientConfig{CA: s.TLSCA, Cert: s.TLSCert, Key: s.TLSKey, InsecureSkipVerify: s.InsecureSkipVerify}
+	tlsConfig, err := tlsCfg.TLSConfig()
+	if err != nil {
+		return dbplugin.InitializeResponse{}, err
+	}
+	s.httpClient = &http.Client{Timeout: s.connectTimeout}
+	if tlsConfig != nil {
+		transport := http.DefaultTransport.(*http.Transport).Clone()
+		transport.TLSClientConfig = tlsConfig
+		s.httpClient.Transport = transport
+	}
+
 	s.Initialized = true
 
 	if req.VerifyConnection {
@@ -82,33 +106,71 @@ func (c *squidConnectionProducer) Connection(ctx context.Context) (interface{},
 		return nil, connutil.ErrNotInitialized
 	}
 
-	req, err := http.NewRequest(http.MethodGet, strings.TrimRight(c.ConnectionURL, "/")+"/authTest", nil)
-	if err != nil {
-		log.Fatal().Err(err)
+	// the service must be ready, and accept the credentials.
+	for _, path := range []string{"/readyz", "/authTest"} {
+		err := c.request(ctx, http.MethodGet, path, nil)
+		if err != nil {
+			log.Err(err)
+			return nil, err
+		}
 	}
-	req.SetBasicAuth(c.Username, c.Password)
 
-	client := http.DefaultClient
-	res, err := client.Do(req)
+	return nil, nil
+}
+
+// APIError is returned when squid db service replies with a non 2xx status code.
+type APIError struct {
+	Method     string
+	Path       string
+	StatusCode int
+	Body       string
+}
+
+func (e *APIError) Error() string {
+	return fmt.Sprintf("%s %s failed with status code: %d and body: %s", e.Method, e.Path, e.StatusCode, strings.TrimSpace(e.Body))
+}
+
+// IsNotFound returns true if err is an APIError for a missing resource.
+func IsNotFound(err error) bool {
+	var apiErr *APIError
+	return errors.As(err, &apiErr) && apiErr.StatusCode == http.StatusNotFound
+}
+
+// request calls squid db service API with the token, or the admin credentials.
+// Non 2xx replies are returned as *APIError.
+func (c *squidConnectionProducer) request(ctx context.Context, method string, path string, data []byte) error {
+	var body io.Reader
+	if data != nil {
+		body = bytes.NewReader(data)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, strings.TrimRight(c.ConnectionURL, " /")+path, body)
 	if err != nil {
-		log.Fatal().Err(err)
+		return err
+	}
+	if data != nil {
+		req.Header.Set("Content-Type", "application/json")
 	}
-	body, err := io.ReadAll(res.Body)
+	if c.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.Token)
+	} else {
+		req.SetBasicAuth(c.Username, c.Password)
+	}
+
+	res, err := c.httpClient.Do(req)
 	if err != nil {
-		log.Err(err)
-		return nil, err
+		return err
 	}
-	readErr := res.Body.Close()
-	if readErr != nil {
-		log.Err(readErr)
-		return nil, err
+	defer res.Body.Close()
+
+	// read the response body
+	resBody, err := io.ReadAll(res.Body)
+	if err != nil {
+		return err
 	}
 	if res.StatusCode > 299 || res.StatusCode < 200 {
-		log.Error().Msg(fmt.Sprintf("Response failed with status code: %d and body: %s", res.StatusCode, body))
-		return nil, fmt.Errorf("response failed with status code: %d and body: %s", res.StatusCode, body)
+		return &APIError{Method: method, Path: path, StatusCode: res.StatusCode, Body: string(resBody)}
 	}
-
-	return nil, nil
+	return nil
 }
 
 // Close attempts to close the connection
@@ -122,7 +184,14 @@ func (c *squidConnectionProducer) Close() error {
 }
 
 func (c *squidConnectionProducer) SecretValues() map[string]string {
-	return map[string]string{
+	secrets := map[string]string{
 		c.Password: "[password]",
 	}
+	if c.Token != "" {
+		secrets[c.Token] = "[token]"
+	}
+	if c.TLSKey != "" {
+		secrets[c.TLSKey] = "[tls_key]"
+	}
+	return secrets
 }
@@ -8,12 +8,12 @@
 package squid
 
 import (
-	"bytes"
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
-	"io"
 	"net/http"
-	"strings"
+	"net/url"
 
 	multierror "github.com/hashicorp/go-multierror"
 	"github.com/hashicorp/go-secure-stdlib/strutil"
@@ -24,7 +24,12 @@ import (
 )
 
 const (
-	squidDbTypeName         = "squidDB"
+	squidDbTypeName = "squidDB"
+	// rootRotationStatement marks the root credential rotation. It must be
+	// set as root_rotation_statements of the Vault connection, which Vault
+	// only sends when rotating the root credential.
+	rootRotationStatement   = "rotate-root"
+	defaultRotationIFQL     = "{\"password\": \"{{password}}\"}"
 	defaultUserNameTemplate = `{{ printf "v_%s_%s_%s_%s" (.DisplayName | truncate 15) (.RoleName | truncate 15) (random 20) (unix_time) | truncate 100 | replace "-" "_" | lowercase }}`
 )
 
@@ -100,15 +105,14 @@ func (s *SquidDatabase) NewUser(ctx context.Context, req dbplugin.NewUserRequest
 	}
 
 	m := map[string]string{
-		"username": username,
-		"password": req.Password,
-		"rolename": req.UsernameConfig.RoleName,
+		"username": jsonEscape(username),
+		"password": jsonEscape(req.Password),
+		"rolename": jsonEscape(req.UsernameConfig.RoleName),
 		"exp_date": string(fmt.Sprintf("%d", req.Expiration.Unix())),
 	}
 	data := []byte(dbutil.QueryHelper(creationIFQL[0], m))
 
-	url := strings.TrimRight(s.ConnectionURL, " /") + "/api/v1/users"
-	err = addUser(url, data, s.Username, s.Password)
+	err = s.request(ctx, http.MethodPut, "/api/v1/users", data)
 	if err != nil {
 		result = multierror.Append(result, err)
 	}
@@ -122,41 +126,15 @@ func (s *SquidDatabase) NewUser(ctx context.Context, req dbplugin.NewUserRequest
 	return resp, nil
 }
 
-func delUser(url string, user string, pass string) error {
-	// create a new HTTP client
-	client := &http.Client{}
-
-	// create a new DELETE request
-	req, err := http.NewRequest("DELETE", url, nil)
-	if err != nil {
-		return err
-	}
-	req.SetBasicAuth(user, pass)
-
-	// send the request
-	resp, err := client.Do(req)
-	if err != nil {
-		return err
-	}
-	defer resp.Body.Close()
-
-	// read the response body
-	_, err = io.ReadAll(resp.Body)
-	if err != nil {
-		return err
-	}
-	return nil
-}
-
 func (s *SquidDatabase) DeleteUser(ctx context.Context, req dbplugin.DeleteUserRequest) (dbplugin.DeleteUserResponse, error) {
 	s.Lock()
 	defer s.Unlock()
 
 	var result *multierror.Error
 
-	url := strings.TrimRight(s.ConnectionURL, " /") + "/api/v1/users/" + req.Username
-	err := delUser(url, s.Username, s.Password)
-	if err != nil {
+	err := s.request(ctx, http.MethodDelete, userPath(req.Username), nil)
+	// the user is already gone, there is nothing left to revoke.
+	if err != nil && !IsNotFound(err) {
 		result = multierror.Append(result, err)
 	}
 
@@ -166,34 +144,10 @@ func (s *SquidDatabase) DeleteUser(ctx context.Context, req dbplugin.DeleteUserR
 	return dbplugin.DeleteUserResponse{}, nil
 }
 
-func addUser(url string, data []byte, user string, pass string) error {
-	// create a new HTTP client
-	client := &http.Client{}
-
-	// create a new DELETE request
-	req, err := http.NewRequest(http.MethodPut, url, bytes.NewBuffer(data))
-	if err != nil {
-		return err
-	}
-
-	req.Header.Set("Content-Type", "application/json")
-	req.SetBasicAuth(user, pass)
-
-	// send the request
-	resp, err := client.Do(req)
-	if err != nil {
-		return err
-	}
-	defer resp.Body.Close()
-
-	// read the response body
-	_, err = io.ReadAll(resp.Body)
-	if err != nil {
-		return err
-	}
-	return nil
-}
-
+// UpdateUser changes the password and/or the expiration of a user.
+// Password changes are also used by static roles, to rotate the password of
+// long-lived accounts created outside of Vault, and by root credential
+// rotation when the statements are rootRotationStatement.
 func (s *SquidDatabase) UpdateUser(ctx context.Context, req dbplugin.UpdateUserRequest) (dbplugin.UpdateUserResponse, error) {
 	if req.Password == nil && req.Expiration == nil {
 		return dbplugin.UpdateUserResponse{}, fmt.Errorf("no changes requested")
@@ -203,51 +157,93 @@ func (s *SquidDatabase) UpdateUser(ctx context.Context, req dbplugin.UpdateUserR
 	defer s.Unlock()
 
 	var result *multierror.Error
+	if req.Password != nil && isRootRotation(req.Password.Statements) {
+		if req.Username != s.Username {
+			return dbplugin.UpdateUserResponse{}, fmt.Errorf("root credential rotation of %q, but the plugin authenticates as %q", req.Username, s.Username)
+		}
+		err := s.rotateRoot(ctx, req.Password.NewPassword)
+		if err != nil {
+			result = multierror.Append(result, err)
+		}
+
+		if result.ErrorOrNil() != nil {
+			return dbplugin.UpdateUserResponse{}, fmt.Errorf("unable to rotate root credential cleanly: %w", result.ErrorOrNil())
+		}
+		return dbplugin.UpdateUserResponse{}, nil
+	}
 	if req.Password != nil {
-		tpl := "{\"password\": \"{{password}}\"}"
+		// only the password is sent, so groups and exp_date are kept by the server.
+		tpl := defaultRotationIFQL
+		if len(req.Password.Statements.Commands) > 0 {
+			tpl = req.Password.Statements.Commands[0]
+		}
 
 		m := map[string]string{
-			"password": req.Password.NewPassword,
+			"username": jsonEscape(req.Username),
+			"password": jsonEscape(req.Password.NewPassword),
 		}
 		data := []byte(dbutil.QueryHelper(tpl, m))
 
-		url := strings.TrimRight(s.ConnectionURL, " /") + "/api/v1/users/" + req.Username
-		err := changeUserPassword(url, data)
+		err := s.request(ctx, http.MethodPatch, userPath(req.Username), data)
 		if err != nil {
 			result = multierror.Append(result, err)
 		}
 
 		if result.ErrorOrNil() != nil {
-			return dbplugin.UpdateUserResponse{}, fmt.Errorf("unable to create user cleanly: %w", result.ErrorOrNil())
+			return dbplugin.UpdateUserResponse{}, fmt.Errorf("unable to change user password cleanly: %w", result.ErrorOrNil())
 		}
 	}
-	// Expiration is a no-op
-	return dbplugin.UpdateUserResponse{}, nil
-}
+	if req.Expiration != nil {
+		// only exp_date is sent, so password and groups are kept by the server.
+		data := []byte(fmt.Sprintf("{\"exp_date\": %d}", req.Expiration.NewExpiration.Unix()))
 
-func changeUserPassword(url string, data []byte) error {
-	// create a new HTTP client
-	client := &http.Client{}
+		err := s.request(ctx, http.MethodPatch, userPath(req.Username), data)
+		if err != nil {
+			result = multierror.Append(result, err)
+		}
 
-	// create a new DELETE request
-	req, err := http.NewRequest(http.MethodPatch, url, bytes.NewBuffer(data))
-	if err != nil {
-		return err
+		if result.ErrorOrNil() != nil {
+			return dbplugin.UpdateUserResponse{}, fmt.Errorf("unable to update user expiration cleanly: %w", result.ErrorOrNil())
+		}
 	}
+	return dbplugin.UpdateUserResponse{}, nil
+}
 
-	req.Header.Set("Content-Type", "application/json")
+// isRootRotation returns true if statements are the root_rotation_statements
+// marking the root credential rotation.
+func isRootRotation(statements dbplugin.Statements) bool {
+	return len(statements.Commands) == 1 && statements.Commands[0] == rootRotationStatement
+}
 
-	// send the request
-	resp, err := client.Do(req)
-	if err != nil {
-		return err
+// rotateRoot changes the password of the admin account used by the plugin.
+// Afterwards, the new password is only known by Vault.
+func (s *SquidDatabase) rotateRoot(ctx context.Context, password string) error {
+	if s.Token != "" {
+		return errors.New("root credential rotation isn't supported with a token: issue a new token and revoke the old one instead")
 	}
-	defer resp.Body.Close()
+	m := map[string]string{
+		"password": jsonEscape(password),
+	}
+	data := []byte(dbutil.QueryHelper(defaultRotationIFQL, m))
 
-	// read the response body
-	_, err = io.ReadAll(resp.Body)
+	err := s.request(ctx, http.MethodPut, "/api/v1/admin/credentials", data)
 	if err != nil {
 		return err
 	}
+	s.Password = password
+	if s.rawConfig != nil {
+		s.rawConfig["password"] = password
+	}
 	return nil
 }
+
+// userPath returns the API path of a user record.
+func userPath(username string) string {
+	return "/api/v1/users/" + url.PathEscape(username)
+}
+
+// jsonEscape escapes v so it can be used inside a json string.
+func jsonEscape(v string) string {
+	b, _ := json.Marshal(v)
+	return string(b[1 : len(b)-1])
+}
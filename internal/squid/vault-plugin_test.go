@@ -0,0 +1,303 @@
+//
+// vault-plugin_test.go
+// Copyright (C) 2024 rmelo <Ricardo Melo <rmelo@ludia.com>>
+//
+// Distributed under terms of the MIT license.
+//
+
+package squid
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	dbplugin "github.com/hashicorp/vault/sdk/database/dbplugin/v5"
+)
+
+// recordedRequest keeps what the fake squid db service received.
+type recordedRequest struct {
+	method string
+	path   string
+	user   string
+	pass   string
+	auth   string
+	body   map[string]interface{}
+}
+
+func newTestServer(t *testing.T, status int) (*httptest.Server, *[]recordedRequest) {
+	t.Helper()
+	var reqs []recordedRequest
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rr := recordedRequest{method: r.Method, path: r.URL.Path}
+		rr.user, rr.pass, _ = r.BasicAuth()
+		rr.auth = r.Header.Get("Authorization")
+		if r.Body != nil {
+			_ = json.NewDecoder(r.Body).Decode(&rr.body)
+		}
+		reqs = append(reqs, rr)
+		w.WriteHeader(status)
+	}))
+	t.Cleanup(srv.Close)
+	return srv, &reqs
+}
+
+func newTestDatabase(t *testing.T, url string) *SquidDatabase {
+	t.Helper()
+	db := new()
+	_, err := db.Initialize(context.Background(), dbplugin.InitializeRequest{
+		Config: map[string]interface{}{
+			"connection_url": url,
+			"username":       "admin",
+			"password":       "secret",
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
+
+func TestUpdateUserExpiration(t *testing.T) {
+	srv, reqs := newTestServer(t, http.StatusOK)
+	db := newTestDatabase(t, srv.URL)
+
+	exp := time.Now().Add(time.Hour).Truncate(time.Second)
+	_, err := db.UpdateUser(context.Background(), dbplugin.UpdateUserRequest{
+		Username:   "v_token_role",
+		Expiration: &dbplugin.ChangeExpiration{NewExpiration: exp},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(*reqs) != 1 {
+		t.Fatalf("expected 1 request, got %d", len(*reqs))
+	}
+	r := (*reqs)[0]
+	if r.method != http.MethodPatch || r.path != "/api/v1/users/v_token_role" {
+		t.Fatalf("unexpected request %s %s", r.method, r.path)
+	}
+	if r.user != "admin" || r.pass != "secret" {
+		t.Fatalf("unexpected credentials %s/%s", r.user, r.pass)
+	}
+	if len(r.body) != 1 {
+		t.Fatalf("only exp_date should be sent, got %v", r.body)
+	}
+	if got, ok := r.body["exp_date"].(float64); !ok || int64(got) != exp.Unix() {
+		t.Fatalf("expected exp_date %d, got %v", exp.Unix(), r.body["exp_date"])
+	}
+}
+
+func TestUpdateUserExpirationServerError(t *testing.T) {
+	srv, _ := newTestServer(t, http.StatusNotFound)
+	db := newTestDatabase(t, srv.URL)
+
+	_, err := db.UpdateUser(context.Background(), dbplugin.UpdateUserRequest{
+		Username:   "v_token_role",
+		Expiration: &dbplugin.ChangeExpiration{NewExpiration: time.Now().Add(time.Hour)},
+	})
+	if err == nil {
+		t.Fatal("expected an error when the server rejects the update")
+	}
+}
+
+func TestUpdateUserNoChanges(t *testing.T) {
+	srv, reqs := newTestServer(t, http.StatusOK)
+	db := newTestDatabase(t, srv.URL)
+
+	_, err := db.UpdateUser(context.Background(), dbplugin.UpdateUserRequest{Username: "v_token_role"})
+	if err == nil {
+		t.Fatal("expected an error when no changes are requested")
+	}
+	if len(*reqs) != 0 {
+		t.Fatalf("expected no request, got %d", len(*reqs))
+	}
+}
+
+func TestUpdateUserPassword(t *testing.T) {
+	srv, reqs := newTestServer(t, http.StatusOK)
+	db := newTestDatabase(t, srv.URL)
+
+	_, err := db.UpdateUser(context.Background(), dbplugin.UpdateUserRequest{
+		Username: "svc-proxy",
+		Password: &dbplugin.ChangePassword{NewPassword: `new"pass`},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(*reqs) != 1 {
+		t.Fatalf("expected 1 request, got %d", len(*reqs))
+	}
+	r := (*reqs)[0]
+	if r.method != http.MethodPatch || r.path != "/api/v1/users/svc-proxy" {
+		t.Fatalf("unexpected request %s %s", r.method, r.path)
+	}
+	if r.user != "admin" || r.pass != "secret" {
+		t.Fatalf("unexpected credentials %s/%s", r.user, r.pass)
+	}
+	if len(r.body) != 1 || r.body["password"] != `new"pass` {
+		t.Fatalf("only the new password should be sent, got %v", r.body)
+	}
+}
+
+func TestUpdateUserPasswordStatements(t *testing.T) {
+	srv, reqs := newTestServer(t, http.StatusOK)
+	db := newTestDatabase(t, srv.URL)
+
+	_, err := db.UpdateUser(context.Background(), dbplugin.UpdateUserRequest{
+		Username: "svc-proxy",
+		Password: &dbplugin.ChangePassword{
+			NewPassword: "newpass",
+			Statements:  dbplugin.Statements{Commands: []string{`{"password": "{{password}}", "groups": ["{{username}}"]}`}},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	groups, ok := (*reqs)[0].body["groups"].([]interface{})
+	if !ok || len(groups) != 1 || groups[0] != "svc-proxy" {
+		t.Fatalf("rotation statement not used, got %v", (*reqs)[0].body)
+	}
+}
+
+func TestNewUserServerError(t *testing.T) {
+	srv, _ := newTestServer(t, http.StatusConflict)
+	db := newTestDatabase(t, srv.URL)
+
+	_, err := db.NewUser(context.Background(), dbplugin.NewUserRequest{
+		UsernameConfig: dbplugin.UsernameMetadata{DisplayName: "token", RoleName: "role"},
+		Password:       "pass",
+		Expiration:     time.Now().Add(time.Hour),
+	})
+	var apiErr *APIError
+	if !errors.As(err, &apiErr) || apiErr.StatusCode != http.StatusConflict {
+		t.Fatalf("expected an APIError with status %d, got %v", http.StatusConflict, err)
+	}
+}
+
+func TestDeleteUserAlreadyGone(t *testing.T) {
+	srv, reqs := newTestServer(t, http.StatusNotFound)
+	db := newTestDatabase(t, srv.URL)
+
+	_, err := db.DeleteUser(context.Background(), dbplugin.DeleteUserRequest{Username: "v_token_role"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := (*reqs)[0]
+	if r.method != http.MethodDelete || r.user != "admin" {
+		t.Fatalf("unexpected request %s by %s", r.method, r.user)
+	}
+}
+
+func TestUpdateUserRotateRoot(t *testing.T) {
+	srv, reqs := newTestServer(t, http.StatusOK)
+	db := newTestDatabase(t, srv.URL)
+
+	_, err := db.UpdateUser(context.Background(), dbplugin.UpdateUserRequest{
+		Username: "admin",
+		Password: &dbplugin.ChangePassword{NewPassword: "rotated", Statements: dbplugin.Statements{Commands: []string{rootRotationStatement}}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := (*reqs)[0]
+	if r.method != http.MethodPut || r.path != "/api/v1/admin/credentials" {
+		t.Fatalf("unexpected request %s %s", r.method, r.path)
+	}
+	if r.pass != "secret" || r.body["password"] != "rotated" {
+		t.Fatalf("unexpected rotation request with password %s and body %v", r.pass, r.body)
+	}
+
+	// next calls use the rotated password.
+	_, err = db.DeleteUser(context.Background(), dbplugin.DeleteUserRequest{Username: "v_token_role"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if (*reqs)[1].pass != "rotated" {
+		t.Fatalf("expected the rotated password to be used, got %s", (*reqs)[1].pass)
+	}
+}
+
+func TestUpdateUserNamedLikeAdmin(t *testing.T) {
+	srv, reqs := newTestServer(t, http.StatusOK)
+	db := newTestDatabase(t, srv.URL)
+
+	// a static role of a proxy user named like the plugin principal changes
+	// the user password, not the API credential.
+	_, err := db.UpdateUser(context.Background(), dbplugin.UpdateUserRequest{
+		Username: "admin",
+		Password: &dbplugin.ChangePassword{NewPassword: "rotated"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := (*reqs)[0]
+	if r.method != http.MethodPatch || r.path != "/api/v1/users/admin" || r.body["password"] != "rotated" {
+		t.Fatalf("unexpected request %s %s %v", r.method, r.path, r.body)
+	}
+	if db.Password != "secret" {
+		t.Fatal("the plugin credential must be kept")
+	}
+
+	// the root rotation of another account is refused.
+	_, err = db.UpdateUser(context.Background(), dbplugin.UpdateUserRequest{
+		Username: "bob",
+		Password: &dbplugin.ChangePassword{NewPassword: "rotated", Statements: dbplugin.Statements{Commands: []string{rootRotationStatement}}},
+	})
+	if err == nil || len(*reqs) != 1 {
+		t.Fatalf("expected the rotation to be refused without request, got %v", err)
+	}
+}
+
+func TestTokenAuthentication(t *testing.T) {
+	srv, reqs := newTestServer(t, http.StatusOK)
+	db := new()
+	_, err := db.Initialize(context.Background(), dbplugin.InitializeRequest{
+		Config: map[string]interface{}{
+			"connection_url": srv.URL,
+			"token":          "sqdb_secret",
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.DeleteUser(context.Background(), dbplugin.DeleteUserRequest{Username: "v_token_role"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if auth := (*reqs)[0].auth; auth != "Bearer sqdb_secret" {
+		t.Fatalf("expected the bearer token, got %q", auth)
+	}
+	_, err = db.UpdateUser(context.Background(), dbplugin.UpdateUserRequest{
+		Password: &dbplugin.ChangePassword{NewPassword: "rotated", Statements: dbplugin.Statements{Commands: []string{rootRotationStatement}}},
+	})
+	if err == nil || len(*reqs) != 1 {
+		t.Fatalf("root rotation should be refused with a token, got %v", err)
+	}
+}
+
+func TestConnectionChecksReadiness(t *testing.T) {
+	srv, reqs := newTestServer(t, http.StatusOK)
+	db := newTestDatabase(t, srv.URL)
+	if _, err := db.Connection(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if len(*reqs) != 2 || (*reqs)[0].path != "/readyz" || (*reqs)[1].path != "/authTest" {
+		t.Fatalf("expected /readyz then /authTest, got %+v", *reqs)
+	}
+
+	srv, reqs = newTestServer(t, http.StatusServiceUnavailable)
+	db = newTestDatabase(t, srv.URL)
+	if _, err := db.Connection(context.Background()); err == nil {
+		t.Fatal("expected an error when the service isn't ready")
+	}
+	if len(*reqs) != 1 {
+		t.Fatalf("credentials shouldn't be checked when the service isn't ready, got %d requests", len(*reqs))
+	}
+}
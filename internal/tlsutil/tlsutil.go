@@ -0,0 +1,262 @@
+//
+// tlsutil.go
+// Copyright (C) 2024 rmelo <Ricardo Melo <rmelo@ludia.com>>
+//
+// Distributed under terms of the MIT license.
+//
+
+// Package with the TLS configuration of squid db service and its clients.
+package tlsutil
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/cropalato/squid-vault-auth/internal/varenv"
+	"github.com/rs/zerolog/log"
+)
+
+// readPEM returns v if it is PEM content, or the content of the file v.
+// Inline PEM lets the Vault plugin get certificates through its config.
+func readPEM(v string) ([]byte, error) {
+	if strings.HasPrefix(strings.TrimSpace(v), "-----BEGIN") {
+		return []byte(v), nil
+	}
+	return os.ReadFile(v)
+}
+
+// loadPool returns a pool with the certificates of ca, a PEM file or content.
+func loadPool(ca string) (*x509.CertPool, error) {
+	data, err := readPEM(ca)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("no certificate found in %s", ca)
+	}
+	return pool, nil
+}
+
+// loadKeyPair loads a certificate and its key, PEM files or content.
+func loadKeyPair(cert string, key string) (tls.Certificate, error) {
+	certPEM, err := readPEM(cert)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	keyPEM, err := readPEM(key)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	return tls.X509KeyPair(certPEM, keyPEM)
+}
+
+// ClientConfig is the TLS configuration of a squid db service client.
+// CA, Cert and Key are PEM files or PEM content.
+type ClientConfig struct {
+	// CA verifies the server certificate. The system pool is used when empty.
+	CA string
+	// Cert and Key are the client certificate, sent for mutual TLS.
+	Cert string
+	Key  string
+	// InsecureSkipVerify disables the verification of the server certificate.
+	InsecureSkipVerify bool
+}
+
+// RegisterClientFlags defines the client TLS flags in fs, using SQUIDDB_TLS_* env variables as defaults.
+func RegisterClientFlags(fs *flag.FlagSet) *ClientConfig {
+	c := &ClientConfig{}
+	fs.StringVar(&c.CA, "tls_ca", varenv.LookupEnvOrString("SQUIDDB_TLS_CA", ""), "CA certificate (PEM) verifying squid db service certificate. default: the system CAs")
+	fs.StringVar(&c.Cert, "tls_cert", varenv.LookupEnvOrString("SQUIDDB_TLS_CERT", ""), "client certificate (PEM) sent to squid db service, for mutual TLS")
+	fs.StringVar(&c.Key, "tls_key", varenv.LookupEnvOrString("SQUIDDB_TLS_KEY", ""), "key (PEM) of the client certificate")
+	fs.BoolVar(&c.InsecureSkipVerify, "insecure_skip_verify", varenv.LookupEnvOrBool("SQUIDDB_INSECURE_SKIP_VERIFY", false), "don't verify squid db service certificate. Only for tests")
+	return c
+}
+
+// TLSConfig returns the tls configuration of c, or nil if c is empty.
+func (c *ClientConfig) TLSConfig() (*tls.Config, error) {
+	if c.CA == "" && c.Cert == "" && c.Key == "" && !c.InsecureSkipVerify {
+		return nil, nil
+	}
+	cfg := &tls.Config{MinVersion: tls.VersionTLS12, InsecureSkipVerify: c.InsecureSkipVerify}
+	if c.CA != "" {
+		pool, err := loadPool(c.CA)
+		if err != nil {
+			return nil, fmt.Errorf("failed loading tls_ca: %w", err)
+		}
+		cfg.RootCAs = pool
+	}
+	if (c.Cert == "") != (c.Key == "") {
+		return nil, errors.New("tls_cert and tls_key must be set together")
+	}
+	if c.Cert != "" {
+		cert, err := loadKeyPair(c.Cert, c.Key)
+		if err != nil {
+			return nil, fmt.Errorf("failed loading tls_cert: %w", err)
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+	return cfg, nil
+}
+
+// ServerConfig is the TLS configuration of squid db service.
+type ServerConfig struct {
+	// Cert and Key are the PEM files of the server certificate. TLS is disabled when empty.
+	Cert string
+	Key  string
+	// ClientCA is the PEM file of the CA verifying client certificates.
+	// Clients without certificate are still accepted, unless RequireClientCert is set.
+	ClientCA          string
+	RequireClientCert bool
+	// ReloadInterval is how often the files are checked for changes. Zero disables it.
+	ReloadInterval time.Duration
+}
+
+// RegisterServerFlags defines the server TLS flags in fs, using SQUIDDB_TLS_* env variables as defaults.
+func RegisterServerFlags(fs *flag.FlagSet) *ServerConfig {
+	c := &ServerConfig{}
+	fs.StringVar(&c.Cert, "tls_cert", varenv.LookupEnvOrString("SQUIDDB_TLS_CERT", ""), "certificate file (PEM) of squid db service. TLS is disabled when empty")
+	fs.StringVar(&c.Key, "tls_key", varenv.LookupEnvOrString("SQUIDDB_TLS_KEY", ""), "key file (PEM) of the certificate")
+	fs.StringVar(&c.ClientCA, "tls_client_ca", varenv.LookupEnvOrString("SQUIDDB_TLS_CLIENT_CA", ""), "CA file (PEM) verifying client certificates, enabling mutual TLS")
+	fs.BoolVar(&c.RequireClientCert, "tls_require_client_cert", varenv.LookupEnvOrBool("SQUIDDB_TLS_REQUIRE_CLIENT_CERT", false), "reject clients without a valid certificate")
+	fs.DurationVar(&c.ReloadInterval, "tls_reload_interval", varenv.LookupEnvOrDuration("SQUIDDB_TLS_RELOAD_INTERVAL", time.Minute), "how often the TLS files are checked for changes. They are also reloaded on SIGHUP. '0' disables it")
+	return c
+}
+
+// Enabled returns true if a server certificate is configured.
+func (c *ServerConfig) Enabled() bool {
+	return c.Cert != ""
+}
+
+// Reloader serves the TLS configuration of squid db service, reloading its
+// files when they change or when SIGHUP is received. A failed reload keeps
+// the previous configuration.
+type Reloader struct {
+	cfg   ServerConfig
+	mu    sync.RWMutex
+	tls   *tls.Config
+	mtime map[string]time.Time
+}
+
+// NewReloader loads the files of cfg.
+func NewReloader(cfg ServerConfig) (*Reloader, error) {
+	if cfg.Key == "" {
+		return nil, errors.New("tls_key is required with tls_cert")
+	}
+	if cfg.RequireClientCert && cfg.ClientCA == "" {
+		return nil, errors.New("tls_client_ca is required to require client certificates")
+	}
+	r := &Reloader{cfg: cfg}
+	if err := r.Reload(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// files returns the files of the configuration.
+func (r *Reloader) files() []string {
+	files := []string{r.cfg.Cert, r.cfg.Key}
+	if r.cfg.ClientCA != "" {
+		files = append(files, r.cfg.ClientCA)
+	}
+	return files
+}
+
+// Reload reads the files again.
+func (r *Reloader) Reload() error {
+	mtime := map[string]time.Time{}
+	for _, f := range r.files() {
+		info, err := os.Stat(f)
+		if err != nil {
+			return err
+		}
+		mtime[f] = info.ModTime()
+	}
+	cert, err := loadKeyPair(r.cfg.Cert, r.cfg.Key)
+	if err != nil {
+		return fmt.Errorf("failed loading tls_cert: %w", err)
+	}
+	// the config replaces the one http.Server sets up, so HTTP/2 must be
+	// offered here.
+	cfg := &tls.Config{MinVersion: tls.VersionTLS12, Certificates: []tls.Certificate{cert}, NextProtos: []string{"h2", "http/1.1"}}
+	if r.cfg.ClientCA != "" {
+		pool, err := loadPool(r.cfg.ClientCA)
+		if err != nil {
+			return fmt.Errorf("failed loading tls_client_ca: %w", err)
+		}
+		cfg.ClientCAs = pool
+		cfg.ClientAuth = tls.VerifyClientCertIfGiven
+		if r.cfg.RequireClientCert {
+			cfg.ClientAuth = tls.RequireAndVerifyClientCert
+		}
+	}
+	r.mu.Lock()
+	r.tls, r.mtime = cfg, mtime
+	r.mu.Unlock()
+	return nil
+}
+
+// changed returns true if a file changed since the last reload.
+func (r *Reloader) changed() bool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	for f, t := range r.mtime {
+		info, err := os.Stat(f)
+		if err != nil || !info.ModTime().Equal(t) {
+			return true
+		}
+	}
+	return false
+}
+
+// TLSConfig returns the server tls configuration, always using the last
+// loaded files.
+func (r *Reloader) TLSConfig() *tls.Config {
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			r.mu.RLock()
+			defer r.mu.RUnlock()
+			return r.tls, nil
+		},
+	}
+}
+
+// Run reloads the files on SIGHUP, and when they change, until ctx is done.
+func (r *Reloader) Run(ctx context.Context) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+	var tick <-chan time.Time
+	if r.cfg.ReloadInterval > 0 {
+		t := time.NewTicker(r.cfg.ReloadInterval)
+		defer t.Stop()
+		tick = t.C
+	}
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-hup:
+		case <-tick:
+			if !r.changed() {
+				continue
+			}
+		}
+		if err := r.Reload(); err != nil {
+			log.Err(err).Msg("failed reloading TLS files, keeping the previous ones")
+			continue
+		}
+		log.Info().Str("cert", r.cfg.Cert).Msg("reloaded TLS files")
+	}
+}
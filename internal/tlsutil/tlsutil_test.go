@@ -0,0 +1,152 @@
+//
+// tlsutil_test.go
+// Copyright (C) 2024 rmelo <Ricardo Melo <rmelo@ludia.com>>
+//
+// Distributed under terms of the MIT license.
+//
+
+package tlsutil
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeCert writes a self-signed certificate for cn and its key to certPath
+// and keyPath, with the given modification time.
+func writeCert(t *testing.T, cn string, certPath string, keyPath string, mtime time.Time) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: cn},
+		NotBefore:    time.Now().Add(-time.Minute),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tpl, tpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for path, block := range map[string]*pem.Block{certPath: {Type: "CERTIFICATE", Bytes: der}, keyPath: {Type: "PRIVATE KEY", Bytes: keyDER}} {
+		if err := os.WriteFile(path, pem.EncodeToMemory(block), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(path, mtime, mtime); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// servedCN returns the common name of the certificate served by tlsConfig.
+func servedCN(t *testing.T, tlsConfig *tls.Config) string {
+	t.Helper()
+	cfg, err := tlsConfig.GetConfigForClient(&tls.ClientHelloInfo{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, err := x509.ParseCertificate(cfg.Certificates[0].Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return leaf.Subject.CommonName
+}
+
+func TestReloader(t *testing.T) {
+	dir := t.TempDir()
+	certPath, keyPath := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	mtime := time.Now().Add(-time.Hour)
+	writeCert(t, "first", certPath, keyPath, mtime)
+
+	r, err := NewReloader(ServerConfig{Cert: certPath, Key: keyPath})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tlsConfig := r.TLSConfig()
+	if cn := servedCN(t, tlsConfig); cn != "first" {
+		t.Fatalf("served certificate %s, want first", cn)
+	}
+	if r.changed() {
+		t.Error("changed() is true without change")
+	}
+
+	// the certificate is renewed.
+	writeCert(t, "second", certPath, keyPath, mtime.Add(time.Minute))
+	if !r.changed() {
+		t.Fatal("changed() is false after renewal")
+	}
+	if err := r.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	if cn := servedCN(t, tlsConfig); cn != "second" {
+		t.Errorf("served certificate %s after reload, want second", cn)
+	}
+	if r.changed() {
+		t.Error("changed() is true after reload")
+	}
+
+	// a failed reload keeps the previous configuration.
+	if err := os.WriteFile(keyPath, []byte("not a key"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Reload(); err == nil {
+		t.Fatal("Reload() of an invalid key succeeded")
+	}
+	if cn := servedCN(t, tlsConfig); cn != "second" {
+		t.Errorf("served certificate %s after a failed reload, want second", cn)
+	}
+	if err := os.Remove(certPath); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Reload(); err == nil {
+		t.Fatal("Reload() of a missing certificate succeeded")
+	}
+	if cn := servedCN(t, tlsConfig); cn != "second" {
+		t.Errorf("served certificate %s after a failed reload, want second", cn)
+	}
+}
+
+func TestReloaderHTTP2(t *testing.T) {
+	dir := t.TempDir()
+	certPath, keyPath := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	writeCert(t, "server", certPath, keyPath, time.Now())
+	r, err := NewReloader(ServerConfig{Cert: certPath, Key: keyPath})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &http.Server{Handler: http.HandlerFunc(func(http.ResponseWriter, *http.Request) {}), TLSConfig: r.TLSConfig()}
+	go func() { _ = srv.ServeTLS(ln, "", "") }()
+	t.Cleanup(func() { srv.Close() })
+
+	c := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}, ForceAttemptHTTP2: true}}
+	resp, err := c.Get("https://" + ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.ProtoMajor != 2 {
+		t.Errorf("negotiated %s, want HTTP/2", resp.Proto)
+	}
+}
@@ -10,6 +10,7 @@ package varenv
 import (
 	"os"
 	"strconv"
+	"time"
 )
 
 // LookupEnvOrString returns the value from env variable key is exists or defaultVal as string
@@ -41,3 +42,14 @@ func LookupEnvOrBool(key string, defaultVal bool) bool {
 	}
 	return defaultVal
 }
+
+// LookupEnvOrDuration returns the value from env variable key is exists or defaultVal as time.Duration
+func LookupEnvOrDuration(key string, defaultVal time.Duration) time.Duration {
+	if val, ok := os.LookupEnv(key); ok {
+		newVal, err := time.ParseDuration(val)
+		if err == nil {
+			return newVal
+		}
+	}
+	return defaultVal
+}
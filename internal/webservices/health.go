@@ -0,0 +1,136 @@
+//
+// health.go
+// Copyright (C) 2024 rmelo <Ricardo Melo <rmelo@ludia.com>>
+//
+// Distributed under terms of the MIT license.
+//
+
+package webservices
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// Status of a health check, and of the service.
+const (
+	CheckOK       = "ok"
+	CheckFail     = "fail"
+	CheckDisabled = "disabled"
+)
+
+// Check is the result of a single health check. Error is set when it failed.
+type Check struct {
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+// HealthResponse is returned by the Healthz and Readyz handlers.
+// Status is ok only when no check failed. Checks are only given to
+// authenticated callers.
+type HealthResponse struct {
+	Status string           `json:"status"`
+	Checks map[string]Check `json:"checks,omitempty"`
+}
+
+// storeCheckInterval is how long the write check of the store is cached for
+// anonymous probes, as it writes a file on every run.
+const storeCheckInterval = 30 * time.Second
+
+// healthState caches the write check of the store, and keeps the checks
+// failing at the last probe so only their changes are logged.
+type healthState struct {
+	mu      sync.Mutex
+	storeAt time.Time
+	store   error
+	failing map[string]bool
+}
+
+// newCheck returns the check matching err.
+func newCheck(err error) Check {
+	if err != nil {
+		return Check{Status: CheckFail, Error: err.Error()}
+	}
+	return Check{Status: CheckOK}
+}
+
+// readiness runs the readiness checks: the database can be read and written,
+// and the expiry reaper runs. There is no replication check: every instance
+// owns its database, and doesn't depend on another one.
+// The write check is run again when fresh is true, or once cached for
+// storeCheckInterval. Checks are logged when they fail, then when they recover.
+func (h *HTTPHandlers) readiness(now time.Time, fresh bool) HealthResponse {
+	h.health.mu.Lock()
+	defer h.health.mu.Unlock()
+	if fresh || h.health.storeAt.IsZero() || now.Sub(h.health.storeAt) >= storeCheckInterval {
+		h.health.store, h.health.storeAt = h.UserDB.Check(), now
+	}
+	resp := HealthResponse{Status: CheckOK, Checks: map[string]Check{}}
+	resp.Checks["database"] = newCheck(h.UserDB.Ping())
+	resp.Checks["store"] = newCheck(h.health.store)
+	resp.Checks["reaper"] = Check{Status: CheckDisabled}
+	if h.Reaper != nil {
+		resp.Checks["reaper"] = newCheck(h.Reaper.Check(now))
+	}
+	if h.health.failing == nil {
+		h.health.failing = map[string]bool{}
+	}
+	for name, c := range resp.Checks {
+		failing := c.Status == CheckFail
+		if failing {
+			resp.Status = CheckFail
+		}
+		if failing && !h.health.failing[name] {
+			log.Warn().Str("check", name).Str("error", c.Error).Msg("readiness check failed")
+		} else if !failing && h.health.failing[name] {
+			log.Info().Str("check", name).Msg("readiness check recovered")
+		}
+		h.health.failing[name] = failing
+	}
+	return resp
+}
+
+// writeHealth sends resp, with 503 if it isn't ok.
+func writeHealth(w http.ResponseWriter, resp HealthResponse) {
+	data, err := json.Marshal(resp)
+	if err != nil {
+		log.Err(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if resp.Status != CheckOK {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	_, err = w.Write(data)
+	if err != nil {
+		log.Err(err)
+	}
+}
+
+// Healthz is the liveness check: the service answers requests.
+func (h *HTTPHandlers) Healthz(w http.ResponseWriter, r *http.Request) {
+	writeHealth(w, HealthResponse{Status: CheckOK})
+}
+
+// Readyz is the readiness check. It replies 503 when a check fails.
+// Anonymous callers only get the status, not the detail of the checks,
+// which could disclose paths or errors of the host, and the cached write
+// check. Probes without credentials aren't authenticated, so they never
+// pay for a bcrypt compare.
+func (h *HTTPHandlers) Readyz(w http.ResponseWriter, r *http.Request) {
+	authenticated := false
+	if r.Header.Get("Authorization") != "" || (r.TLS != nil && len(r.TLS.VerifiedChains) > 0) {
+		_, err := h.authenticate(r)
+		authenticated = err == nil
+	}
+	resp := h.readiness(time.Now(), authenticated)
+	if !authenticated {
+		resp.Checks = nil
+	}
+	writeHealth(w, resp)
+}
@@ -0,0 +1,122 @@
+//
+// health_test.go
+// Copyright (C) 2024 rmelo <Ricardo Melo <rmelo@ludia.com>>
+//
+// Distributed under terms of the MIT license.
+//
+
+package webservices
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/cropalato/squid-vault-auth/internal/db"
+)
+
+// readyz calls /readyz as the admin, or anonymously.
+func readyz(t *testing.T, r http.Handler, anonymous bool) (int, HealthResponse) {
+	t.Helper()
+	req := httptest.NewRequest(http.MethodGet, "/readyz", nil)
+	if !anonymous {
+		req.SetBasicAuth(testAdmin, testPass)
+	}
+	rec := httptest.NewRecorder()
+	r.ServeHTTP(rec, req)
+	var resp HealthResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("invalid reply %q: %s", rec.Body.String(), err)
+	}
+	return rec.Code, resp
+}
+
+func TestReadiness(t *testing.T) {
+	h := newTestHandlers(t)
+	r := NewRouter(h)
+
+	code, resp := readyz(t, r, false)
+	if code != http.StatusOK || resp.Status != CheckOK {
+		t.Fatalf("expected ready, got %d: %+v", code, resp)
+	}
+	for name, want := range map[string]string{"database": CheckOK, "store": CheckOK, "reaper": CheckDisabled} {
+		if resp.Checks[name].Status != want {
+			t.Errorf("expected %s check %s, got %+v", name, want, resp.Checks[name])
+		}
+	}
+
+	// a reaper which never ran is reported after two intervals.
+	h.Reaper = db.NewReaper(h.UserDB, 50*time.Millisecond)
+	time.Sleep(120 * time.Millisecond)
+	code, resp = readyz(t, r, false)
+	if code != http.StatusServiceUnavailable || resp.Checks["reaper"].Status != CheckFail {
+		t.Fatalf("expected the reaper check to fail, got %d: %+v", code, resp)
+	}
+	// anonymous callers only get the status.
+	code, resp = readyz(t, r, true)
+	if code != http.StatusServiceUnavailable || resp.Status != CheckFail || resp.Checks != nil {
+		t.Fatalf("expected only the status for anonymous callers, got %d: %+v", code, resp)
+	}
+	if _, err := h.Reaper.Reap(time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	if code, resp = readyz(t, r, false); code != http.StatusOK {
+		t.Fatalf("expected ready after a reap, got %d: %+v", code, resp)
+	}
+	h.Reaper = nil
+
+	// the database lost the lock of its file.
+	if err := os.Rename(h.UserDB.Cfg.DbPath+".lock", h.UserDB.Cfg.DbPath+".lock.old"); err != nil {
+		t.Fatal(err)
+	}
+	code, resp = readyz(t, r, false)
+	if code != http.StatusServiceUnavailable || resp.Checks["database"].Status != CheckFail || resp.Checks["store"].Status != CheckOK {
+		t.Fatalf("expected the database check to fail, got %d: %+v", code, resp)
+	}
+	if err := os.Rename(h.UserDB.Cfg.DbPath+".lock.old", h.UserDB.Cfg.DbPath+".lock"); err != nil {
+		t.Fatal(err)
+	}
+
+	// a closed store can't be read nor written.
+	if err := h.UserDB.Close(); err != nil {
+		t.Fatal(err)
+	}
+	code, resp = readyz(t, r, false)
+	if code != http.StatusServiceUnavailable || resp.Checks["database"].Status != CheckFail || resp.Checks["store"].Status != CheckFail || resp.Checks["store"].Error == "" {
+		t.Fatalf("expected the database and store checks to fail, got %d: %+v", code, resp)
+	}
+	rec := httptest.NewRecorder()
+	r.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/state", nil))
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Fatalf("expected /state to follow readiness, got %d", rec.Code)
+	}
+	rec = httptest.NewRecorder()
+	r.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/healthz", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected /healthz to stay ok, got %d", rec.Code)
+	}
+}
+
+func TestReadinessCache(t *testing.T) {
+	h := newTestHandlers(t)
+	now := time.Now()
+	if resp := h.readiness(now, false); resp.Checks["store"].Status != CheckOK {
+		t.Fatalf("expected the store check to pass, got %+v", resp)
+	}
+	if err := h.UserDB.Close(); err != nil {
+		t.Fatal(err)
+	}
+	// anonymous probes reuse the last write check, authenticated ones run it.
+	if resp := h.readiness(now.Add(time.Second), false); resp.Checks["store"].Status != CheckOK {
+		t.Errorf("expected the cached store check, got %+v", resp.Checks["store"])
+	}
+	if resp := h.readiness(now.Add(storeCheckInterval), false); resp.Checks["store"].Status != CheckFail {
+		t.Errorf("expected the store check to run once expired, got %+v", resp.Checks["store"])
+	}
+	if resp := h.readiness(now, true); resp.Checks["store"].Status != CheckFail {
+		t.Errorf("expected a fresh store check, got %+v", resp.Checks["store"])
+	}
+}
@@ -0,0 +1,99 @@
+//
+// metrics.go
+// Copyright (C) 2024 rmelo <Ricardo Melo <rmelo@ludia.com>>
+//
+// Distributed under terms of the MIT license.
+//
+
+package webservices
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/cropalato/squid-vault-auth/internal/db"
+	"github.com/cropalato/squid-vault-auth/internal/hash"
+	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+var (
+	// httpRequests counts the API requests, by route, method and status.
+	httpRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "squiddb",
+		Name:      "http_requests_total",
+		Help:      "HTTP requests, by route, method and status code.",
+	}, []string{"route", "method", "status"})
+
+	// httpDuration measures the API requests, by route, method and status.
+	httpDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "squiddb",
+		Name:      "http_request_duration_seconds",
+		Help:      "Latency of HTTP requests, by route, method and status code.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"route", "method", "status"})
+
+	// verifyOutcomes counts the decisions of the verify and digest endpoints.
+	verifyOutcomes = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "squiddb",
+		Name:      "verify_total",
+		Help:      "Decisions of the verify and digest endpoints, by endpoint, result and reason.",
+	}, []string{"endpoint", "result", "reason"})
+)
+
+// newRegistry returns the registry served on /metrics, collecting the
+// metrics of the process, of the API and of the user database d.
+func newRegistry(d *db.Database) *prometheus.Registry {
+	reg := prometheus.NewRegistry()
+	reg.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		httpRequests,
+		httpDuration,
+		verifyOutcomes,
+		hash.BcryptDuration,
+		db.SaveDuration,
+		db.ReaperRuns,
+		db.ReaperPurged,
+		db.NewCollector(d),
+	)
+	return reg
+}
+
+// Metrics serves the metrics in the Prometheus text format.
+func (h *HTTPHandlers) Metrics(w http.ResponseWriter, r *http.Request) {
+	promhttp.HandlerFor(h.metrics, promhttp.HandlerOpts{}).ServeHTTP(w, r)
+}
+
+// statusRecorder keeps the status code written by a handler.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (s *statusRecorder) WriteHeader(code int) {
+	s.status = code
+	s.ResponseWriter.WriteHeader(code)
+}
+
+// metricsMiddleware counts and times the requests, labelled with the route
+// template so user names never end up in label values.
+func metricsMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(rec, r)
+		route := "unknown"
+		if cr := mux.CurrentRoute(r); cr != nil {
+			if tpl, err := cr.GetPathTemplate(); err == nil {
+				route = tpl
+			}
+		}
+		status := strconv.Itoa(rec.status)
+		httpRequests.WithLabelValues(route, r.Method, status).Inc()
+		httpDuration.WithLabelValues(route, r.Method, status).Observe(time.Since(start).Seconds())
+	})
+}
@@ -0,0 +1,65 @@
+//
+// metrics_test.go
+// Copyright (C) 2024 rmelo <Ricardo Melo <rmelo@ludia.com>>
+//
+// Distributed under terms of the MIT license.
+//
+
+package webservices
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+
+	"github.com/cropalato/squid-vault-auth/internal/db"
+)
+
+func TestMetrics(t *testing.T) {
+	h := newTestHandlers(t)
+	h.UserDB.Cfg.ExpiryWindow = time.Hour
+	r := NewRouter(h)
+	secret, err := bcrypt.GenerateFromPassword([]byte("pass"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	for _, u := range []db.UserRecord{
+		{Username: "alice", Password: string(secret), Groups: []string{"g1", "g2"}, ExpDate: now.Add(time.Minute).Unix()},
+		{Username: "bob", Password: string(secret), Groups: []string{"g1"}},
+		{Username: "carol", Password: string(secret), Groups: []string{"g1"}, Disabled: true},
+		{Username: "dave", Password: string(secret), ExpDate: now.Add(-time.Minute).Unix()},
+	} {
+		if err := h.UserDB.AddRecord(u); err != nil {
+			t.Fatal(err)
+		}
+	}
+	send(t, r, http.MethodPost, "/api/v1/verify", `{"username": "bob", "password": "wrong"}`)
+	send(t, r, http.MethodGet, "/api/v1/users/bob", "")
+
+	rec := send(t, r, http.MethodGet, "/metrics", "")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", rec.Code, rec.Body.String())
+	}
+	body := rec.Body.String()
+	for _, want := range []string{
+		`squiddb_users{state="active"} 2`,
+		`squiddb_users{state="disabled"} 1`,
+		`squiddb_users{state="expired"} 1`,
+		`squiddb_group_users{group="g1"} 2`,
+		`squiddb_group_users{group="g2"} 1`,
+		`squiddb_users_expiring_soon 1`,
+		`squiddb_verify_total{endpoint="verify",reason="invalid password",result="deny"}`,
+		`squiddb_http_requests_total{method="GET",route="/api/v1/users/{user}",status="200"}`,
+		`squiddb_store_save_duration_seconds_count{backend="json",result="ok"}`,
+		`squiddb_bcrypt_duration_seconds_count{op="compare"}`,
+		`squiddb_database_size_bytes`,
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("missing %s", want)
+		}
+	}
+}
@@ -0,0 +1,350 @@
+//
+// rbac.go
+// Copyright (C) 2024 rmelo <Ricardo Melo <rmelo@ludia.com>>
+//
+// Distributed under terms of the MIT license.
+//
+
+package webservices
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/cropalato/squid-vault-auth/internal/credentials"
+	"github.com/gorilla/mux"
+	"github.com/rs/zerolog/log"
+)
+
+// permission is an action on the API granted to roles.
+type permission string
+
+// Permissions checked by the routes.
+const (
+	// permWriteUsers creates, replaces, patches and deletes user records.
+	permWriteUsers permission = "users:write"
+	// permReadUsers reads a single user record, without its password hash.
+	permReadUsers permission = "users:read"
+	// permListUsers lists user records.
+	permListUsers permission = "users:list"
+	// permVerify verifies credentials.
+	permVerify permission = "verify"
+	// permSync fetches the user changes and the signed snapshots. Snapshots
+	// hold the password hashes, so it is only granted to the helpers.
+	permSync permission = "sync"
+	// permSecrets reads password hashes.
+	permSecrets permission = "secrets"
+	// permPrincipals manages the API principals and tokens.
+	permPrincipals permission = "principals"
+	// permRotate rotates the credential of the caller.
+	permRotate permission = "rotate"
+	// permMetrics scrapes the Prometheus metrics.
+	permMetrics permission = "metrics"
+)
+
+// rolePermissions lists the permissions of each role. The admin role has them all.
+// Helpers and readers run on many hosts and keep their credential in config
+// files, so they can't rotate it: a leaked credential must not lock out the admin.
+// Helpers sync the changes and snapshots to evict their cache and answer offline.
+// Readers serve inventory and monitoring: they list and read user records,
+// never their hashes, and scrape the metrics.
+var rolePermissions = map[string][]permission{
+	credentials.RoleVault:  {permWriteUsers, permReadUsers, permRotate},
+	credentials.RoleHelper: {permVerify, permSync, permReadUsers},
+	credentials.RoleReader: {permListUsers, permReadUsers, permMetrics},
+}
+
+// can returns true if role is granted p.
+func can(role string, p permission) bool {
+	if role == credentials.RoleAdmin {
+		return true
+	}
+	for _, granted := range rolePermissions[role] {
+		if granted == p {
+			return true
+		}
+	}
+	return false
+}
+
+// permissions lists every permission, which are also the scopes of tokens.
+var permissions = []permission{permWriteUsers, permReadUsers, permListUsers, permVerify, permSync, permSecrets, permPrincipals, permRotate, permMetrics}
+
+// validScope returns true if scope is a known permission.
+func validScope(scope string) bool {
+	for _, p := range permissions {
+		if string(p) == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// principal is the caller authenticated by AuthMiddleware.
+type principal struct {
+	Username string
+	Role     string
+	// TokenID and Scopes are set when the caller used a bearer token.
+	TokenID string
+	Scopes  []string
+}
+
+// can returns true if the principal is granted p, by its token scopes or its role.
+func (c principal) can(p permission) bool {
+	if c.TokenID == "" {
+		return can(c.Role, p)
+	}
+	for _, scope := range c.Scopes {
+		if scope == string(p) {
+			return true
+		}
+	}
+	return false
+}
+
+// principalKey is the context key of the authenticated principal.
+type principalKey struct{}
+
+// withPrincipal returns a copy of ctx holding the authenticated principal.
+func withPrincipal(ctx context.Context, c principal) context.Context {
+	return context.WithValue(ctx, principalKey{}, c)
+}
+
+// principalFrom returns the principal authenticated by AuthMiddleware.
+func principalFrom(ctx context.Context) principal {
+	c, _ := ctx.Value(principalKey{}).(principal)
+	return c
+}
+
+// require wraps next, rejecting with 403 the principals not granted p.
+// CORS preflight requests are let through, as AuthMiddleware does.
+func require(p permission, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodOptions {
+			c := principalFrom(r.Context())
+			if !c.can(p) {
+				log.Info().Str("username", c.Username).Str("role", c.Role).Str("token", c.TokenID).Str("path", r.URL.Path).Str("permission", string(p)).Msg("permission denied")
+				w.Header().Set("Content-Type", "application/json")
+				w.WriteHeader(http.StatusForbidden)
+				_, err := w.Write([]byte("{ \"msg\": \"permission denied\" }\n"))
+				if err != nil {
+					log.Err(err)
+				}
+				return
+			}
+		}
+		next(w, r)
+	}
+}
+
+// PrincipalRequest is the payload accepted by the PutPrincipal handler.
+// The principal authenticates with Password, or with a client certificate
+// matching CertSubject, or both.
+type PrincipalRequest struct {
+	Password    string `json:"password,omitempty"`
+	Role        string `json:"role"`
+	CertSubject string `json:"cert_subject,omitempty"`
+}
+
+// ListPrincipals returns the API principals and their role, without the admin.
+func (h *HTTPHandlers) ListPrincipals(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Access-Control-Allow-Origin", h.UserDB.Cfg.CorsOrigin)
+	if r.Method == http.MethodOptions {
+		return
+	}
+	data, err := json.Marshal(h.Admin.Principals())
+	if err != nil {
+		log.Err(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(200)
+	_, err = w.Write(data)
+	if err != nil {
+		log.Err(err)
+	}
+}
+
+// PutPrincipal creates or replaces the API principal named in the path.
+// It replies 201 when the principal is created, and 200 when it is replaced.
+func (h *HTTPHandlers) PutPrincipal(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Access-Control-Allow-Origin", h.UserDB.Cfg.CorsOrigin)
+	if r.Method == http.MethodOptions {
+		return
+	}
+	username := mux.Vars(r)["principal"]
+	var req PrincipalRequest
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		log.Err(err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if (req.Password == "" && req.CertSubject == "") || !credentials.ValidRole(req.Role) {
+		http.Error(w, "a password or a cert_subject, and a valid role are required", http.StatusBadRequest)
+		return
+	}
+	created, err := h.Admin.SetPrincipal(username, req.Password, req.Role, req.CertSubject)
+	if errors.Is(err, credentials.ErrPrincipalExists) {
+		http.Error(w, "the admin principal can't be replaced", http.StatusConflict)
+		return
+	}
+	if errors.Is(err, credentials.ErrCertSubjectExists) {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	if err != nil {
+		log.Err(err)
+		http.Error(w, "failed processing request", http.StatusInternalServerError)
+		return
+	}
+	status, msg := http.StatusOK, "Replaced principal"
+	if created {
+		status, msg = http.StatusCreated, "Added new principal"
+	}
+	log.Info().Str("username", username).Str("role", req.Role).Str("remote", r.RemoteAddr).Msg(msg)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_, err = w.Write([]byte("{ \"msg\": \"" + msg + ", username=" + username + "\" }\n"))
+	if err != nil {
+		log.Err(err)
+	}
+}
+
+// DeletePrincipal removes the API principal named in the path.
+// It replies 204, or 404 if the principal doesn't exist.
+func (h *HTTPHandlers) DeletePrincipal(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Access-Control-Allow-Origin", h.UserDB.Cfg.CorsOrigin)
+	if r.Method == http.MethodOptions {
+		return
+	}
+	username := mux.Vars(r)["principal"]
+	err := h.Admin.DeletePrincipal(username)
+	if errors.Is(err, credentials.ErrPrincipalNotFound) {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Err(err)
+		http.Error(w, "failed processing request", http.StatusInternalServerError)
+		return
+	}
+	log.Info().Str("username", username).Str("remote", r.RemoteAddr).Msg("deleted principal")
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// TokenRequest is the payload accepted by the IssueToken handler.
+// TTL is a duration, e.g. '720h'. Tokens never expire when it is empty.
+type TokenRequest struct {
+	Name   string   `json:"name"`
+	Scopes []string `json:"scopes"`
+	TTL    string   `json:"ttl,omitempty"`
+}
+
+// IssuedToken is the reply of the IssueToken handler.
+// Secret is only returned once, it can't be retrieved later.
+type IssuedToken struct {
+	credentials.Token
+	Secret string `json:"token"`
+}
+
+// IssueToken creates a bearer token with the requested scopes and lifetime.
+func (h *HTTPHandlers) IssueToken(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Access-Control-Allow-Origin", h.UserDB.Cfg.CorsOrigin)
+	if r.Method == http.MethodOptions {
+		return
+	}
+	var req TokenRequest
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		log.Err(err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if req.Name == "" || len(req.Scopes) == 0 {
+		http.Error(w, "name and scopes are required", http.StatusBadRequest)
+		return
+	}
+	for _, scope := range req.Scopes {
+		if !validScope(scope) {
+			http.Error(w, fmt.Sprintf("unknown scope %q", scope), http.StatusBadRequest)
+			return
+		}
+	}
+	now := time.Now()
+	var expiresAt time.Time
+	if req.TTL != "" {
+		ttl, err := time.ParseDuration(req.TTL)
+		if err != nil || ttl <= 0 {
+			http.Error(w, "ttl must be a positive duration", http.StatusBadRequest)
+			return
+		}
+		expiresAt = now.Add(ttl)
+	}
+	t, secret, err := h.Tokens.Issue(req.Name, req.Scopes, expiresAt, principalFrom(r.Context()).Username, now)
+	if err != nil {
+		log.Err(err)
+		http.Error(w, "failed processing request", http.StatusInternalServerError)
+		return
+	}
+	log.Info().Str("token", t.ID).Str("name", t.Name).Strs("scopes", t.Scopes).Str("remote", r.RemoteAddr).Msg("issued token")
+	data, err := json.Marshal(IssuedToken{Token: t, Secret: secret})
+	if err != nil {
+		log.Err(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	_, err = w.Write(data)
+	if err != nil {
+		log.Err(err)
+	}
+}
+
+// ListTokens returns the tokens, expired ones included, without their secret.
+func (h *HTTPHandlers) ListTokens(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Access-Control-Allow-Origin", h.UserDB.Cfg.CorsOrigin)
+	if r.Method == http.MethodOptions {
+		return
+	}
+	data, err := json.Marshal(h.Tokens.List())
+	if err != nil {
+		log.Err(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(200)
+	_, err = w.Write(data)
+	if err != nil {
+		log.Err(err)
+	}
+}
+
+// RevokeToken deletes the token with the id given in the path.
+// It replies 204, or 404 if the token doesn't exist.
+func (h *HTTPHandlers) RevokeToken(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Access-Control-Allow-Origin", h.UserDB.Cfg.CorsOrigin)
+	if r.Method == http.MethodOptions {
+		return
+	}
+	id := mux.Vars(r)["id"]
+	err := h.Tokens.Revoke(id)
+	if errors.Is(err, credentials.ErrTokenNotFound) {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Err(err)
+		http.Error(w, "failed processing request", http.StatusInternalServerError)
+		return
+	}
+	log.Info().Str("token", id).Str("remote", r.RemoteAddr).Msg("revoked token")
+	w.WriteHeader(http.StatusNoContent)
+}
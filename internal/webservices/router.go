@@ -0,0 +1,123 @@
+//
+// router.go
+// Copyright (C) 2024 rmelo <Ricardo Melo <rmelo@ludia.com>>
+//
+// Distributed under terms of the MIT license.
+//
+
+package webservices
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/rs/zerolog/log"
+)
+
+// authRealm is the realm announced in WWW-Authenticate headers.
+const authRealm = "squid-database"
+
+// NewRouter returns the router exposing all squid db service endpoints.
+// Every route under /api/v1, and /metrics, requires credentials, and a role granting its permission.
+func NewRouter(h *HTTPHandlers) *mux.Router {
+	r := mux.NewRouter()
+	r.Use(metricsMiddleware, mux.CORSMethodMiddleware(r))
+	r.HandleFunc("/authTest", h.AuthHandle)
+	r.HandleFunc("/state", h.State).Methods(http.MethodGet, http.MethodOptions)
+	r.HandleFunc("/healthz", h.Healthz).Methods(http.MethodGet)
+	r.HandleFunc("/readyz", h.Readyz).Methods(http.MethodGet)
+	r.Handle("/metrics", h.AuthMiddleware(require(permMetrics, h.Metrics))).Methods(http.MethodGet)
+
+	api := r.PathPrefix("/api/v1").Subrouter()
+	api.Use(h.AuthMiddleware)
+	api.HandleFunc("/admin/credentials", require(permRotate, h.RotateAdmin)).Methods(http.MethodPut, http.MethodOptions)
+	api.HandleFunc("/changes", require(permSync, h.Changes)).Methods(http.MethodGet, http.MethodOptions)
+	api.HandleFunc("/digest", require(permVerify, h.Digest)).Methods(http.MethodPost, http.MethodOptions)
+	api.HandleFunc("/principals", require(permPrincipals, h.ListPrincipals)).Methods(http.MethodGet, http.MethodOptions)
+	api.HandleFunc("/principals/{principal}", require(permPrincipals, h.PutPrincipal)).Methods(http.MethodPut, http.MethodOptions)
+	api.HandleFunc("/principals/{principal}", require(permPrincipals, h.DeletePrincipal)).Methods(http.MethodDelete)
+	api.HandleFunc("/snapshot", require(permSync, h.Snapshot)).Methods(http.MethodGet, http.MethodOptions)
+	api.HandleFunc("/tokens", require(permPrincipals, h.IssueToken)).Methods(http.MethodPost, http.MethodOptions)
+	api.HandleFunc("/tokens", require(permPrincipals, h.ListTokens)).Methods(http.MethodGet)
+	api.HandleFunc("/tokens/{id}", require(permPrincipals, h.RevokeToken)).Methods(http.MethodDelete, http.MethodOptions)
+	api.HandleFunc("/verify", require(permVerify, h.Verify)).Methods(http.MethodPost, http.MethodOptions)
+	api.HandleFunc("/users", require(permWriteUsers, h.PutUser)).Methods(http.MethodPut, http.MethodOptions)
+	api.HandleFunc("/users", require(permListUsers, h.ListUsers)).Methods(http.MethodGet)
+	api.HandleFunc("/users/{user}", require(permWriteUsers, h.DeleteUser)).Methods(http.MethodDelete, http.MethodOptions)
+	api.HandleFunc("/users/{user}", require(permReadUsers, h.GetUser)).Methods(http.MethodGet)
+	api.HandleFunc("/users/{user}", require(permWriteUsers, h.PatchUser)).Methods(http.MethodPatch)
+	api.HandleFunc("/users/{user}", require(permWriteUsers, h.ReplaceUser)).Methods(http.MethodPut)
+	return r
+}
+
+// AuthMiddleware rejects requests without a valid bearer token or basic
+// credentials, and keeps the authenticated principal in the request context.
+// CORS preflight requests are let through, as browsers never send credentials with them.
+func (h *HTTPHandlers) AuthMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodOptions {
+			next.ServeHTTP(w, r)
+			return
+		}
+		c, err := h.authenticate(r)
+		if errors.Is(err, errMissingCredentials) {
+			unauthorized(w, h.UserDB.Cfg.CorsOrigin, "missing credentials")
+			return
+		}
+		if err != nil {
+			log.Info().Str("remote", r.RemoteAddr).Str("path", r.URL.Path).Msg(err.Error())
+			unauthorized(w, h.UserDB.Cfg.CorsOrigin, "invalid credentials")
+			return
+		}
+		next.ServeHTTP(w, r.WithContext(withPrincipal(r.Context(), c)))
+	})
+}
+
+// errMissingCredentials the request has neither a bearer token nor basic credentials
+var errMissingCredentials = errors.New("missing credentials")
+
+// authenticate returns the principal of the request, authenticated by a
+// bearer token, by basic credentials, or by a verified client certificate.
+func (h *HTTPHandlers) authenticate(r *http.Request) (principal, error) {
+	// the scheme is case-insensitive (RFC 7235).
+	if scheme, secret, ok := strings.Cut(r.Header.Get("Authorization"), " "); ok && strings.EqualFold(scheme, "Bearer") {
+		t, err := h.Tokens.Authenticate(strings.TrimSpace(secret), time.Now())
+		if err != nil {
+			return principal{}, err
+		}
+		return principal{Username: t.Name, TokenID: t.ID, Scopes: t.Scopes}, nil
+	}
+	u, p, ok := r.BasicAuth()
+	if !ok && r.TLS != nil && len(r.TLS.VerifiedChains) > 0 {
+		// the client certificate is only used without other credentials.
+		u, role, err := h.Admin.ValidateCert(r.TLS.PeerCertificates[0])
+		if err != nil {
+			return principal{}, err
+		}
+		return principal{Username: u, Role: role}, nil
+	}
+	if !ok {
+		return principal{}, errMissingCredentials
+	}
+	role, err := h.ValidateCredential(u, p)
+	if err != nil {
+		return principal{}, err
+	}
+	return principal{Username: u, Role: role}, nil
+}
+
+// unauthorized replies with a 401 asking the client for basic credentials or a bearer token.
+func unauthorized(w http.ResponseWriter, origin string, msg string) {
+	w.Header().Set("Access-Control-Allow-Origin", origin)
+	w.Header().Set("WWW-Authenticate", "Basic realm=\""+authRealm+"\", charset=\"UTF-8\"")
+	w.Header().Add("WWW-Authenticate", "Bearer realm=\""+authRealm+"\"")
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusUnauthorized)
+	_, err := w.Write([]byte("{ \"msg\": \"" + msg + "\" }\n"))
+	if err != nil {
+		log.Err(err)
+	}
+}
@@ -0,0 +1,373 @@
+//
+// router_test.go
+// Copyright (C) 2024 rmelo <Ricardo Melo <rmelo@ludia.com>>
+//
+// Distributed under terms of the MIT license.
+//
+
+package webservices
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+
+	"github.com/cropalato/squid-vault-auth/internal/conf"
+	"github.com/cropalato/squid-vault-auth/internal/credentials"
+)
+
+const (
+	testAdmin = "admin"
+	testPass  = "secret"
+)
+
+func newTestRouter(t *testing.T) http.Handler {
+	t.Helper()
+	return NewRouter(newTestHandlers(t))
+}
+
+func newTestHandlers(t *testing.T) *HTTPHandlers {
+	t.Helper()
+	secret, err := bcrypt.GenerateFromPassword([]byte(testPass), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := &conf.Config{
+		AdminID:     testAdmin,
+		AdminSecret: string(secret),
+		DbPath:      filepath.Join(t.TempDir(), "squid-vault.json"),
+		CorsOrigin:  "*",
+	}
+	// one principal per role, named after it, sharing the admin password.
+	var principals []credentials.Credential
+	for _, role := range []string{credentials.RoleVault, credentials.RoleHelper, credentials.RoleReader} {
+		principals = append(principals, credentials.Credential{Username: role, Secret: string(secret), Role: role})
+	}
+	data, err := json.Marshal(principals)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(cfg.DbPath+".principals", data, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	h, err := NewHandlers(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = h.UserDB.Close() })
+	return h
+}
+
+var userRoutes = []struct {
+	method string
+	path   string
+	body   string
+}{
+	{http.MethodPut, "/api/v1/users", `{"username": "bob", "password": "pass", "groups": ["g1"]}`},
+	{http.MethodGet, "/api/v1/users", ""},
+	{http.MethodGet, "/api/v1/users/bob", ""},
+	{http.MethodPatch, "/api/v1/users/bob", `{"username": "bob", "password": "pass"}`},
+	{http.MethodPut, "/api/v1/users/bob", `{"password": "pass", "groups": ["g1"]}`},
+	{http.MethodDelete, "/api/v1/users/bob", ""},
+	{http.MethodPost, "/api/v1/verify", `{"username": "bob", "password": "pass"}`},
+	{http.MethodPost, "/api/v1/digest", `{"username": "bob", "realm": "proxy"}`},
+}
+
+func TestUserRoutesRejectAnonymous(t *testing.T) {
+	r := newTestRouter(t)
+	for _, tc := range userRoutes {
+		t.Run(tc.method+" "+tc.path, func(t *testing.T) {
+			req := httptest.NewRequest(tc.method, tc.path, strings.NewReader(tc.body))
+			rec := httptest.NewRecorder()
+			r.ServeHTTP(rec, req)
+			if rec.Code != http.StatusUnauthorized {
+				t.Fatalf("expected %d, got %d", http.StatusUnauthorized, rec.Code)
+			}
+			if !strings.HasPrefix(rec.Header().Get("WWW-Authenticate"), "Basic ") {
+				t.Fatalf("missing WWW-Authenticate header, got %q", rec.Header().Get("WWW-Authenticate"))
+			}
+		})
+	}
+}
+
+func TestUserRoutesRejectInvalidCredentials(t *testing.T) {
+	r := newTestRouter(t)
+	for _, tc := range userRoutes {
+		t.Run(tc.method+" "+tc.path, func(t *testing.T) {
+			req := httptest.NewRequest(tc.method, tc.path, strings.NewReader(tc.body))
+			req.SetBasicAuth(testAdmin, "wrong")
+			rec := httptest.NewRecorder()
+			r.ServeHTTP(rec, req)
+			if rec.Code != http.StatusUnauthorized {
+				t.Fatalf("expected %d, got %d", http.StatusUnauthorized, rec.Code)
+			}
+		})
+	}
+}
+
+func TestUserRoutesAcceptAdmin(t *testing.T) {
+	r := newTestRouter(t)
+	req := httptest.NewRequest(http.MethodGet, "/api/v1/users/nobody", nil)
+	req.SetBasicAuth(testAdmin, testPass)
+	rec := httptest.NewRecorder()
+	r.ServeHTTP(rec, req)
+	if rec.Code != http.StatusNotFound {
+		t.Fatalf("expected %d, got %d", http.StatusNotFound, rec.Code)
+	}
+}
+
+func TestPublicRoutes(t *testing.T) {
+	r := newTestRouter(t)
+	for _, tc := range []struct {
+		method string
+		path   string
+	}{
+		{http.MethodGet, "/state"},
+		{http.MethodGet, "/healthz"},
+		{http.MethodGet, "/readyz"},
+		{http.MethodOptions, "/api/v1/users"},
+		{http.MethodOptions, "/api/v1/users/bob"},
+	} {
+		req := httptest.NewRequest(tc.method, tc.path, nil)
+		rec := httptest.NewRecorder()
+		r.ServeHTTP(rec, req)
+		if rec.Code != http.StatusOK {
+			t.Errorf("%s %s: expected %d, got %d", tc.method, tc.path, http.StatusOK, rec.Code)
+		}
+	}
+}
+
+func TestRolePermissions(t *testing.T) {
+	r := newTestRouter(t)
+	for _, tc := range []struct {
+		method  string
+		path    string
+		allowed []string
+	}{
+		{http.MethodPut, "/api/v1/users", []string{"admin", "vault"}},
+		{http.MethodPut, "/api/v1/users/bob", []string{"admin", "vault"}},
+		{http.MethodPatch, "/api/v1/users/bob", []string{"admin", "vault"}},
+		{http.MethodDelete, "/api/v1/users/bob", []string{"admin", "vault"}},
+		{http.MethodGet, "/api/v1/users", []string{"admin", "reader"}},
+		{http.MethodGet, "/api/v1/users/bob", []string{"admin", "vault", "helper", "reader"}},
+		{http.MethodGet, "/api/v1/users/bob?include_password=true", []string{"admin"}},
+		{http.MethodPost, "/api/v1/verify", []string{"admin", "helper"}},
+		{http.MethodPost, "/api/v1/digest", []string{"admin", "helper"}},
+		{http.MethodGet, "/api/v1/changes", []string{"admin", "helper"}},
+		{http.MethodGet, "/api/v1/snapshot", []string{"admin", "helper"}},
+		{http.MethodGet, "/api/v1/principals", []string{"admin"}},
+		{http.MethodPut, "/api/v1/principals/bob", []string{"admin"}},
+		{http.MethodDelete, "/api/v1/principals/bob", []string{"admin"}},
+		{http.MethodGet, "/metrics", []string{"admin", "reader"}},
+		{http.MethodPut, "/api/v1/admin/credentials", []string{"admin", "vault"}},
+	} {
+		for _, user := range []string{"admin", "vault", "helper", "reader"} {
+			t.Run(user+" "+tc.method+" "+tc.path, func(t *testing.T) {
+				// the bodies are invalid, so allowed requests stop before changing anything.
+				req := httptest.NewRequest(tc.method, tc.path, strings.NewReader("{"))
+				req.SetBasicAuth(user, testPass)
+				rec := httptest.NewRecorder()
+				r.ServeHTTP(rec, req)
+				denied := rec.Code == http.StatusForbidden
+				allowed := false
+				for _, u := range tc.allowed {
+					allowed = allowed || u == user
+				}
+				if denied == allowed {
+					t.Fatalf("expected allowed=%v, got %d: %s", allowed, rec.Code, rec.Body.String())
+				}
+			})
+		}
+	}
+}
+
+func TestPrincipals(t *testing.T) {
+	h := newTestHandlers(t)
+	r := NewRouter(h)
+	rec := send(t, r, http.MethodPut, "/api/v1/principals/"+testAdmin, `{"password": "pass", "role": "reader"}`)
+	if rec.Code != http.StatusConflict {
+		t.Fatalf("expected %d when replacing the admin, got %d", http.StatusConflict, rec.Code)
+	}
+	rec = send(t, r, http.MethodPut, "/api/v1/principals/bob", `{"password": "pass", "role": "root"}`)
+	if rec.Code != http.StatusBadRequest {
+		t.Fatalf("expected %d for an unknown role, got %d", http.StatusBadRequest, rec.Code)
+	}
+	rec = send(t, r, http.MethodDelete, "/api/v1/principals/reader", "")
+	if rec.Code != http.StatusNoContent {
+		t.Fatalf("expected %d, got %d: %s", http.StatusNoContent, rec.Code, rec.Body.String())
+	}
+	rec = send(t, r, http.MethodDelete, "/api/v1/principals/reader", "")
+	if rec.Code != http.StatusNotFound {
+		t.Fatalf("expected %d, got %d", http.StatusNotFound, rec.Code)
+	}
+	rec = send(t, r, http.MethodGet, "/api/v1/principals", "")
+	var list []credentials.Credential
+	if err := json.Unmarshal(rec.Body.Bytes(), &list); err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 2 || list[0].Username != "helper" || list[1].Username != "vault" || list[0].Secret != "" {
+		t.Fatalf("unexpected principals: %+v", list)
+	}
+	// the principals file is reloaded on restart.
+	admin, err := credentials.Open(filepath.Join(t.TempDir(), "admin"), h.UserDB.Cfg.DbPath+".principals", credentials.Credential{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if role, err := admin.Validate("vault", testPass); err != nil || role != credentials.RoleVault {
+		t.Fatalf("expected the vault role, got %q, %v", role, err)
+	}
+}
+
+func TestBearerTokens(t *testing.T) {
+	h := newTestHandlers(t)
+	r := NewRouter(h)
+	bearer := func(method string, path string, token string) int {
+		req := httptest.NewRequest(method, path, strings.NewReader("{"))
+		req.Header.Set("Authorization", "Bearer "+token)
+		rec := httptest.NewRecorder()
+		r.ServeHTTP(rec, req)
+		return rec.Code
+	}
+
+	rec := send(t, r, http.MethodPost, "/api/v1/tokens", `{"name": "squid", "scopes": ["verify", "users:read"], "ttl": "1h"}`)
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("expected %d, got %d: %s", http.StatusCreated, rec.Code, rec.Body.String())
+	}
+	var issued IssuedToken
+	if err := json.Unmarshal(rec.Body.Bytes(), &issued); err != nil {
+		t.Fatal(err)
+	}
+	if issued.Secret == "" || issued.ExpiresAt == 0 || issued.Digest != "" {
+		t.Fatalf("unexpected issued token: %+v", issued)
+	}
+	if rec := send(t, r, http.MethodPost, "/api/v1/tokens", `{"name": "bad", "scopes": ["everything"]}`); rec.Code != http.StatusBadRequest {
+		t.Fatalf("expected %d for an unknown scope, got %d", http.StatusBadRequest, rec.Code)
+	}
+
+	if code := bearer(http.MethodGet, "/api/v1/users/bob", issued.Secret); code != http.StatusNotFound {
+		t.Fatalf("expected %d within the token scopes, got %d", http.StatusNotFound, code)
+	}
+	if code := bearer(http.MethodGet, "/api/v1/users", issued.Secret); code != http.StatusForbidden {
+		t.Fatalf("expected %d outside the token scopes, got %d", http.StatusForbidden, code)
+	}
+	// snapshots hold the password hashes: verify doesn't grant them.
+	if code := bearer(http.MethodGet, "/api/v1/snapshot", issued.Secret); code != http.StatusForbidden {
+		t.Fatalf("expected %d for a snapshot without the sync scope, got %d", http.StatusForbidden, code)
+	}
+	if code := bearer(http.MethodGet, "/api/v1/users/bob", issued.Secret+"x"); code != http.StatusUnauthorized {
+		t.Fatalf("expected %d with a wrong token, got %d", http.StatusUnauthorized, code)
+	}
+	// the scheme is case-insensitive.
+	for _, scheme := range []string{"bearer", "BEARER"} {
+		req := httptest.NewRequest(http.MethodGet, "/api/v1/users/bob", nil)
+		req.Header.Set("Authorization", scheme+" "+issued.Secret)
+		rec := httptest.NewRecorder()
+		r.ServeHTTP(rec, req)
+		if rec.Code != http.StatusNotFound {
+			t.Fatalf("expected %d with the %s scheme, got %d", http.StatusNotFound, scheme, rec.Code)
+		}
+	}
+
+	list := h.Tokens.List()
+	if len(list) != 1 || list[0].LastUsed == 0 || list[0].Digest != "" {
+		t.Fatalf("unexpected tokens: %+v", list)
+	}
+
+	if rec := send(t, r, http.MethodDelete, "/api/v1/tokens/"+issued.ID, ""); rec.Code != http.StatusNoContent {
+		t.Fatalf("expected %d, got %d", http.StatusNoContent, rec.Code)
+	}
+	if code := bearer(http.MethodGet, "/api/v1/users/bob", issued.Secret); code != http.StatusUnauthorized {
+		t.Fatalf("expected %d with a revoked token, got %d", http.StatusUnauthorized, code)
+	}
+
+	// expired tokens are rejected.
+	_, secret, err := h.Tokens.Issue("old", []string{"verify"}, time.Now().Add(-time.Minute), testAdmin, time.Now().Add(-time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if code := bearer(http.MethodGet, "/api/v1/changes", secret); code != http.StatusUnauthorized {
+		t.Fatalf("expected %d with an expired token, got %d", http.StatusUnauthorized, code)
+	}
+}
+
+// newTestCert returns a certificate for cn, signed by parent, or self-signed if parent is nil.
+func newTestCert(t *testing.T, cn string, parent *tls.Certificate) tls.Certificate {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: cn},
+		NotBefore:             time.Now().Add(-time.Minute),
+		NotAfter:              time.Now().Add(time.Hour),
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  parent == nil,
+	}
+	signer, signerKey := tpl, interface{}(key)
+	if parent != nil {
+		signer, signerKey = parent.Leaf, parent.PrivateKey
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tpl, signer, &key.PublicKey, signerKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}
+}
+
+func TestClientCertificatePrincipal(t *testing.T) {
+	h := newTestHandlers(t)
+	if _, err := h.Admin.SetPrincipal("squid", "", credentials.RoleHelper, "squid-helper"); err != nil {
+		t.Fatal(err)
+	}
+	ca := newTestCert(t, "test ca", nil)
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.Leaf)
+	srv := httptest.NewUnstartedServer(NewRouter(h))
+	srv.TLS = &tls.Config{ClientCAs: pool, ClientAuth: tls.VerifyClientCertIfGiven}
+	srv.StartTLS()
+	t.Cleanup(srv.Close)
+
+	get := func(cn string, path string) int {
+		t.Helper()
+		client := srv.Client()
+		transport := client.Transport.(*http.Transport)
+		transport.TLSClientConfig.Certificates = []tls.Certificate{newTestCert(t, cn, &ca)}
+		transport.CloseIdleConnections()
+		resp, err := client.Get(srv.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	if code := get("squid-helper", "/api/v1/changes"); code != http.StatusOK {
+		t.Fatalf("expected %d, got %d", http.StatusOK, code)
+	}
+	if code := get("squid-helper", "/api/v1/users"); code != http.StatusForbidden {
+		t.Fatalf("expected %d outside the principal role, got %d", http.StatusForbidden, code)
+	}
+	if code := get("someone", "/api/v1/changes"); code != http.StatusUnauthorized {
+		t.Fatalf("expected %d for an unknown subject, got %d", http.StatusUnauthorized, code)
+	}
+}
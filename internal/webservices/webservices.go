@@ -9,54 +9,194 @@
 package webservices
 
 import (
+	"crypto/ed25519"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/cropalato/squid-vault-auth/internal/conf"
+	"github.com/cropalato/squid-vault-auth/internal/credentials"
 	"github.com/cropalato/squid-vault-auth/internal/db"
 	"github.com/cropalato/squid-vault-auth/internal/hash"
+	"github.com/cropalato/squid-vault-auth/internal/snapshot"
+	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/rs/zerolog/log"
 )
 
 type HTTPHandlers struct {
 	UserDB *db.Database
+	Admin  *credentials.Store
+	Tokens *credentials.TokenStore
+	// Reaper is checked by the readiness probe, when the expiry reaper runs.
+	Reaper      *db.Reaper
+	snapshotKey ed25519.PrivateKey
+	metrics     *prometheus.Registry
+	health      healthState
+}
+
+// ChangesResponse lists the users changed since a revision.
+// Clients must drop everything they cached when Reset is true, or when Epoch changes.
+type ChangesResponse struct {
+	Epoch    string   `json:"epoch"`
+	Revision uint64   `json:"revision"`
+	Users    []string `json:"users"`
+	Reset    bool     `json:"reset"`
+}
+
+// AdminCredentialRequest is the payload accepted by the RotateAdmin handler.
+type AdminCredentialRequest struct {
+	Username string `json:"username,omitempty"`
+	Password string `json:"password"`
+}
+
+// Results returned by the Verify handler.
+const (
+	VerifyAllow = "allow"
+	VerifyDeny  = "deny"
+)
+
+// VerifyRequest is the payload accepted by the Verify handler.
+type VerifyRequest struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+}
+
+// VerifyResponse is the decision returned by the Verify handler.
+// Groups and ExpiresAt are only returned when the credential is allowed.
+// ExpiresAt is the unix timestamp the user stops being accepted, 0 meaning never.
+type VerifyResponse struct {
+	Result    string   `json:"result"`
+	Reason    string   `json:"reason"`
+	Groups    []string `json:"groups,omitempty"`
+	ExpiresAt int64    `json:"expires_at,omitempty"`
+}
+
+// DigestRequest is the payload accepted by the Digest handler.
+type DigestRequest struct {
+	Username string `json:"username"`
+	Realm    string `json:"realm"`
+}
+
+// DigestResponse is the decision returned by the Digest handler.
+// HA1 is only returned when the user can authenticate in the realm.
+type DigestResponse struct {
+	Result string `json:"result"`
+	Reason string `json:"reason"`
+	HA1    string `json:"ha1,omitempty"`
 }
 
 // NewHandlers create a new HTTPHandlers class
 func NewHandlers(cfg *conf.Config) (*HTTPHandlers, error) {
-	db, err := db.NewBD(cfg)
+	adminPath := cfg.AdminPath
+	if adminPath == "" {
+		adminPath = cfg.DbPath + ".admin"
+	}
+	principalsPath := cfg.PrincipalsPath
+	if principalsPath == "" {
+		principalsPath = cfg.DbPath + ".principals"
+	}
+	admin, err := credentials.Open(adminPath, principalsPath, credentials.Credential{Username: cfg.AdminID, Secret: cfg.AdminSecret})
 	if err != nil {
 		log.Err(err)
+		return nil, err
 	}
 
-	err = db.LoadDatabase()
+	tokensPath := cfg.TokensPath
+	if tokensPath == "" {
+		tokensPath = cfg.DbPath + ".tokens"
+	}
+	tokens, err := credentials.OpenTokens(tokensPath)
 	if err != nil {
-		panic(err)
+		log.Err(err)
+		return nil, err
 	}
 
-	return &HTTPHandlers{UserDB: db}, nil
+	var snapshotKey ed25519.PrivateKey
+	if cfg.SnapshotKey != "" {
+		snapshotKey, err = snapshot.LoadPrivateKey(cfg.SnapshotKey)
+		if err != nil {
+			log.Err(err)
+			return nil, err
+		}
+	}
+
+	db, err := db.NewBD(cfg)
+	if err != nil {
+		log.Err(err)
+		return nil, err
+	}
+
+	return &HTTPHandlers{UserDB: db, Admin: admin, Tokens: tokens, snapshotKey: snapshotKey, metrics: newRegistry(db)}, nil
 }
 
 // ValidateCredential can be use to be sure the user/password is valid.
-func (h *HTTPHandlers) ValidateCredential(user string, pass string) error {
-	if user != h.UserDB.Cfg.AdminID {
-		return fmt.Errorf("invalid User %s", user)
+// It returns the role of the principal.
+func (h *HTTPHandlers) ValidateCredential(user string, pass string) (string, error) {
+	return h.Admin.Validate(user, pass)
+}
+
+// RotateAdmin replaces the credential of the caller, the admin or another principal.
+// The new credential is persisted, so it survives restarts.
+func (h *HTTPHandlers) RotateAdmin(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Access-Control-Allow-Origin", h.UserDB.Cfg.CorsOrigin)
+	if r.Method == http.MethodOptions {
+		return
 	}
-	if !hash.CheckPasswordHash(pass, h.UserDB.Cfg.AdminSecret) {
-		return fmt.Errorf("invalid password for user %s", user)
+	var req AdminCredentialRequest
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		log.Err(err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if req.Password == "" {
+		http.Error(w, "password cannot be empty", http.StatusBadRequest)
+		return
+	}
+	current := principalFrom(r.Context())
+	if current.TokenID != "" {
+		http.Error(w, "tokens can't be rotated, issue a new one and revoke this one", http.StatusBadRequest)
+		return
+	}
+	username, err := h.Admin.Rotate(current.Username, req.Username, req.Password)
+	if errors.Is(err, credentials.ErrPrincipalExists) {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	if err != nil {
+		log.Err(err)
+		http.Error(w, "failed processing request", http.StatusInternalServerError)
+		return
+	}
+	log.Info().Str("username", username).Str("role", current.Role).Str("remote", r.RemoteAddr).Msg("credential rotated")
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(200)
+	_, err = w.Write([]byte("{ \"msg\": \"Rotated credential, username=" + username + "\" }\n"))
+	if err != nil {
+		log.Err(err)
 	}
-	return nil
 }
 
 // State is used to check is the service is running and health.
+// It replies 503 when a readiness check fails. See Readyz for the details.
 func (h *HTTPHandlers) State(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Access-Control-Allow-Origin", h.UserDB.Cfg.CorsOrigin)
 	if r.Method == http.MethodOptions {
 		return
 	}
-	// TODO: Add code to validate if service is ready to reply requests
+	if h.readiness(time.Now(), false).Status != CheckOK {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		_, err := w.Write([]byte("Service is not ready"))
+		if err != nil {
+			log.Err(err)
+		}
+		return
+	}
 	w.WriteHeader(200)
 	_, err := w.Write([]byte("Service is ready"))
 	if err != nil {
@@ -70,13 +210,12 @@ func (h *HTTPHandlers) AuthHandle(w http.ResponseWriter, r *http.Request) {
 	if r.Method == http.MethodOptions {
 		return
 	}
-	u, p, ok := r.BasicAuth()
-	if !ok {
+	_, err := h.authenticate(r)
+	if errors.Is(err, errMissingCredentials) {
 		fmt.Println("Error parsing basic auth")
 		w.WriteHeader(401)
 		return
 	}
-	err := h.ValidateCredential(u, p)
 	if err != nil {
 		w.WriteHeader(401)
 		_, err := w.Write([]byte(fmt.Sprintf("Authentication fail. %s\n", err)))
@@ -92,6 +231,94 @@ func (h *HTTPHandlers) AuthHandle(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// Page sizes of the ListUsers handler.
+const (
+	defaultListLimit = 100
+	maxListLimit     = 1000
+)
+
+// UserList is a page of user records returned by the ListUsers handler.
+// Next is the cursor of the next page, empty on the last page.
+type UserList struct {
+	Users []db.UserRecord `json:"users"`
+	Next  string          `json:"next,omitempty"`
+}
+
+// ListUsers return json with a page of user records, expired ones included.
+// Records are filtered with the group, prefix, state, expires_after and
+// expires_before parameters, and ordered by the sort parameter.
+// Password hashes are never sent.
+func (h *HTTPHandlers) ListUsers(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Access-Control-Allow-Origin", h.UserDB.Cfg.CorsOrigin)
+	if r.Method == http.MethodOptions {
+		return
+	}
+	params := r.URL.Query()
+	q := db.Query{
+		Group:  params.Get("group"),
+		Prefix: params.Get("prefix"),
+		State:  params.Get("state"),
+		Sort:   params.Get("sort"),
+		Cursor: params.Get("cursor"),
+		Limit:  defaultListLimit,
+	}
+	var err error
+	if v := params.Get("limit"); v != "" {
+		q.Limit, err = strconv.Atoi(v)
+		if err != nil || q.Limit < 1 || q.Limit > maxListLimit {
+			http.Error(w, fmt.Sprintf("limit must be between 1 and %d", maxListLimit), http.StatusBadRequest)
+			return
+		}
+	}
+	if q.ExpiresAfter, err = parseTime(params.Get("expires_after")); err != nil {
+		http.Error(w, "invalid expires_after: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if q.ExpiresBefore, err = parseTime(params.Get("expires_before")); err != nil {
+		http.Error(w, "invalid expires_before: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	users, next, err := h.UserDB.QueryRecords(q, time.Now())
+	if errors.Is(err, db.ErrInvalidQuery) {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		log.Err(err)
+		http.Error(w, "failed processing request", http.StatusInternalServerError)
+		return
+	}
+	list := UserList{Users: []db.UserRecord{}, Next: next}
+	for _, u := range users {
+		u.Password = ""
+		u.HA1 = nil
+		list.Users = append(list.Users, u)
+	}
+	data, err := json.Marshal(list)
+	if err != nil {
+		log.Err(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(200)
+	_, err = w.Write(data)
+	if err != nil {
+		log.Err(err)
+	}
+}
+
+// parseTime parses a unix timestamp or an RFC 3339 date. An empty value returns the zero time.
+func parseTime(v string) (time.Time, error) {
+	if v == "" {
+		return time.Time{}, nil
+	}
+	if ts, err := strconv.ParseInt(v, 10, 64); err == nil {
+		return time.Unix(ts, 0), nil
+	}
+	return time.Parse(time.RFC3339, v)
+}
+
 // GetUser return json with user details.
 func (h *HTTPHandlers) GetUser(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Access-Control-Allow-Origin", h.UserDB.Cfg.CorsOrigin)
@@ -100,11 +327,21 @@ func (h *HTTPHandlers) GetUser(w http.ResponseWriter, r *http.Request) {
 	}
 	path := strings.Split(r.URL.Path, "/")
 	user := path[len(path)-1]
+	// password hashes are only sent to admins, when explicitly requested.
+	withPass, _ := strconv.ParseBool(r.URL.Query().Get("include_password"))
+	if withPass && !principalFrom(r.Context()).can(permSecrets) {
+		http.Error(w, "permission denied", http.StatusForbidden)
+		return
+	}
 	j, err := h.UserDB.GetRecord(user)
 	if err != nil {
 		w.WriteHeader(http.StatusNotFound)
 		return
 	}
+	if !withPass {
+		j.Password = ""
+		j.HA1 = nil
+	}
 	data, err := json.Marshal(j)
 	if err != nil {
 		log.Err(err)
@@ -118,51 +355,210 @@ func (h *HTTPHandlers) GetUser(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-// PutUser create new user.
-// If user exist it will upgrade the user record.
-func (h *HTTPHandlers) PutUser(w http.ResponseWriter, r *http.Request) {
+// Verify checks a user credential without exposing the password hash.
+// It always replies 200 with the decision and the reason behind it.
+func (h *HTTPHandlers) Verify(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Access-Control-Allow-Origin", h.UserDB.Cfg.CorsOrigin)
 	if r.Method == http.MethodOptions {
 		return
 	}
-	var user db.UserRecord
-	err := json.NewDecoder(r.Body).Decode(&user)
+	var vr VerifyRequest
+	err := json.NewDecoder(r.Body).Decode(&vr)
 	if err != nil {
 		log.Err(err)
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
-	up, err := hash.HashPassword(user.Password)
+	u, err := h.UserDB.LookupRecord(vr.Username)
+	if err != nil {
+		u = nil
+	}
+	resp := VerifyResponse{Result: VerifyDeny}
+	ok, reason := db.CheckCredential(u, vr.Password, time.Now(), h.UserDB.Cfg.ExpiryGrace)
+	if ok {
+		resp.Result = VerifyAllow
+		resp.Groups = u.Groups
+		if exp := u.ExpiresAt(h.UserDB.Cfg.ExpiryGrace); !exp.IsZero() {
+			resp.ExpiresAt = exp.Unix()
+		}
+	}
+	resp.Reason = reason
+	verifyOutcomes.WithLabelValues("verify", resp.Result, resp.Reason).Inc()
+	log.Debug().Str("username", vr.Username).Str("result", resp.Result).Str("reason", resp.Reason).Msg("verify")
+	data, err := json.Marshal(resp)
+	if err != nil {
+		log.Err(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(200)
+	_, err = w.Write(data)
+	if err != nil {
+		log.Err(err)
+	}
+}
+
+// Digest returns the HA1 of a user for a realm, used by the digest auth helper.
+// It always replies 200 with the decision and the reason behind it.
+func (h *HTTPHandlers) Digest(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Access-Control-Allow-Origin", h.UserDB.Cfg.CorsOrigin)
+	if r.Method == http.MethodOptions {
+		return
+	}
+	var dr DigestRequest
+	err := json.NewDecoder(r.Body).Decode(&dr)
+	if err != nil {
+		log.Err(err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	u, err := h.UserDB.LookupRecord(dr.Username)
+	if err != nil {
+		u = nil
+	}
+	resp := DigestResponse{Result: VerifyDeny}
+	resp.HA1, resp.Reason = db.DigestCredential(u, dr.Realm, time.Now(), h.UserDB.Cfg.ExpiryGrace)
+	if resp.HA1 != "" {
+		resp.Result = VerifyAllow
+	}
+	verifyOutcomes.WithLabelValues("digest", resp.Result, resp.Reason).Inc()
+	log.Debug().Str("username", dr.Username).Str("realm", dr.Realm).Str("result", resp.Result).Str("reason", resp.Reason).Msg("digest")
+	data, err := json.Marshal(resp)
+	if err != nil {
+		log.Err(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(200)
+	_, err = w.Write(data)
+	if err != nil {
+		log.Err(err)
+	}
+}
+
+// Changes returns the users changed since the revision given in the 'since' parameter.
+// It lets clients caching user records evict them early.
+func (h *HTTPHandlers) Changes(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Access-Control-Allow-Origin", h.UserDB.Cfg.CorsOrigin)
+	if r.Method == http.MethodOptions {
+		return
+	}
+	var since uint64
+	if v := r.URL.Query().Get("since"); v != "" {
+		var err error
+		since, err = strconv.ParseUint(v, 10, 64)
+		if err != nil {
+			http.Error(w, "invalid since parameter", http.StatusBadRequest)
+			return
+		}
+	}
+	resp := ChangesResponse{Epoch: h.UserDB.Changes.Epoch}
+	resp.Users, resp.Revision, resp.Reset = h.UserDB.Changes.Since(since)
+	data, err := json.Marshal(resp)
+	if err != nil {
+		log.Err(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(200)
+	_, err = w.Write(data)
+	if err != nil {
+		log.Err(err)
+	}
+}
+
+// Snapshot returns a signed copy of all the user records that aren't expired,
+// password hashes included. Helpers use it when the service is unreachable.
+func (h *HTTPHandlers) Snapshot(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Access-Control-Allow-Origin", h.UserDB.Cfg.CorsOrigin)
+	if r.Method == http.MethodOptions {
+		return
+	}
+	if h.snapshotKey == nil {
+		http.Error(w, "snapshots are disabled", http.StatusNotFound)
+		return
+	}
+	users, err := h.UserDB.ListRecords()
 	if err != nil {
 		log.Err(err)
 		http.Error(w, "failed processing request", http.StatusInternalServerError)
+		return
 	}
-	user.Password = up
-	err = h.UserDB.AddRecord(user)
+	now := time.Now()
+	s := &snapshot.Snapshot{GeneratedAt: now.Unix(), ExpiryGrace: h.UserDB.Cfg.ExpiryGrace, Users: []db.UserRecord{}}
+	for _, u := range users {
+		if !u.IsExpired(now, h.UserDB.Cfg.ExpiryGrace) {
+			s.Users = append(s.Users, u)
+		}
+	}
+	e, err := snapshot.Sign(h.snapshotKey, s)
 	if err != nil {
 		log.Err(err)
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		http.Error(w, "failed processing request", http.StatusInternalServerError)
 		return
 	}
-	tmp, err := json.Marshal(user)
+	data, err := json.Marshal(e)
 	if err != nil {
 		log.Err(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
 	}
-	log.Debug().Msg(string(tmp))
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(200)
+	_, err = w.Write(data)
+	if err != nil {
+		log.Err(err)
+	}
+}
+
+// PutUser create new user.
+// It replies 201, or 409 if the user already exists and isn't expired.
+func (h *HTTPHandlers) PutUser(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Access-Control-Allow-Origin", h.UserDB.Cfg.CorsOrigin)
+	if r.Method == http.MethodOptions {
+		return
+	}
+	var user db.UserRecord
+	err := json.NewDecoder(r.Body).Decode(&user)
+	if err != nil {
+		log.Err(err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if status, err := h.prepareRecord(&user); err != nil {
+		http.Error(w, err.Error(), status)
+		return
+	}
+	err = h.UserDB.AddRecord(user)
+	if errors.Is(err, db.ErrUserExists) {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	if err != nil {
+		log.Err(err)
+		http.Error(w, "failed processing request", http.StatusInternalServerError)
+		return
+	}
+	log.Debug().Str("username", user.Username).Msg("added user record")
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
 	_, err = w.Write([]byte("{ \"msg\": \"Added new user record, username=" + user.Username + "\" }\n"))
 	if err != nil {
 		log.Err(err)
 	}
 }
 
-// PatchUser upgrade user record
-func (h *HTTPHandlers) PatchUser(w http.ResponseWriter, r *http.Request) {
+// ReplaceUser creates or replaces the user record named in the path.
+// It replies 201 when the record is created, and 200 when it is replaced.
+func (h *HTTPHandlers) ReplaceUser(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Access-Control-Allow-Origin", h.UserDB.Cfg.CorsOrigin)
 	if r.Method == http.MethodOptions {
 		return
 	}
+	username := mux.Vars(r)["user"]
 	var user db.UserRecord
 	err := json.NewDecoder(r.Body).Decode(&user)
 	if err != nil {
@@ -170,18 +566,94 @@ func (h *HTTPHandlers) PatchUser(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
-	up, err := hash.HashPassword(user.Password)
+	if user.Username != "" && user.Username != username {
+		http.Error(w, "username doesn't match the path", http.StatusBadRequest)
+		return
+	}
+	user.Username = username
+	if status, err := h.prepareRecord(&user); err != nil {
+		http.Error(w, err.Error(), status)
+		return
+	}
+	created, err := h.UserDB.UpsertRecord(user)
 	if err != nil {
 		log.Err(err)
 		http.Error(w, "failed processing request", http.StatusInternalServerError)
+		return
+	}
+	status, msg := http.StatusOK, "Replaced user record"
+	if created {
+		status, msg = http.StatusCreated, "Added new user record"
+	}
+	log.Debug().Str("username", user.Username).Bool("created", created).Msg("replaced user record")
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_, err = w.Write([]byte("{ \"msg\": \"" + msg + ", username=" + user.Username + "\" }\n"))
+	if err != nil {
+		log.Err(err)
+	}
+}
+
+// prepareRecord validates a record sent by a client, and replaces its
+// plaintext password by its hashes. It returns the status code to reply on error.
+func (h *HTTPHandlers) prepareRecord(user *db.UserRecord) (int, error) {
+	if user.Username == "" {
+		return http.StatusBadRequest, errors.New("username cannot be empty")
+	}
+	if user.Password == "" {
+		return http.StatusBadRequest, errors.New("password cannot be empty")
+	}
+	up, err := hash.HashPassword(user.Password)
+	if err != nil {
+		log.Err(err)
+		return http.StatusInternalServerError, errors.New("failed processing request")
 	}
+	user.HA1 = h.digestHA1(user.Username, user.Password)
 	user.Password = up
+	if user.Groups == nil {
+		user.Groups = []string{}
+	}
+	return 0, nil
+}
 
-	err = h.UserDB.UpdateRecord(user)
+// PatchUser upgrade user record with a JSON merge patch (RFC 7396).
+// Only the fields present in the request are updated, and null resets a field.
+func (h *HTTPHandlers) PatchUser(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Access-Control-Allow-Origin", h.UserDB.Cfg.CorsOrigin)
+	if r.Method == http.MethodOptions {
+		return
+	}
+	path := strings.Split(r.URL.Path, "/")
+	username := path[len(path)-1]
+	var patch db.UserPatch
+	err := json.NewDecoder(r.Body).Decode(&patch)
+	if err != nil {
+		log.Err(err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if patch.Password != nil {
+		if *patch.Password == "" {
+			http.Error(w, "password cannot be empty", http.StatusBadRequest)
+			return
+		}
+		up, err := hash.HashPassword(*patch.Password)
+		if err != nil {
+			log.Err(err)
+			http.Error(w, "failed processing request", http.StatusInternalServerError)
+			return
+		}
+		// HA1 values of the previous password are always replaced.
+		ha1 := h.digestHA1(username, *patch.Password)
+		patch.HA1 = &ha1
+		patch.Password = &up
+	}
+
+	user, err := h.UserDB.PatchRecord(username, patch)
 	if err != nil {
 		log.Err(err)
 		w.Header().Set("Content-Type", "application/json")
-		if err.Error() == "user not found" {
+		if errors.Is(err, db.ErrUserNotFound) {
 			w.WriteHeader(http.StatusNotFound)
 		} else {
 			w.WriteHeader(http.StatusInternalServerError)
@@ -192,20 +664,29 @@ func (h *HTTPHandlers) PatchUser(w http.ResponseWriter, r *http.Request) {
 		}
 		return
 	}
-	tmp, err := json.Marshal(user)
-	if err != nil {
-		log.Err(err)
-	}
-	log.Debug().Msg(string(tmp))
-	w.WriteHeader(200)
+	log.Debug().Str("username", user.Username).Strs("fields", patch.Fields()).Msg("patched user record")
 	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(200)
 	_, err = w.Write([]byte("{ \"msg\": \"Updated user record, username=" + user.Username + "\" }\n"))
 	if err != nil {
 		log.Err(err)
 	}
 }
 
-// DeleteUser remove user record
+// digestHA1 computes the HA1 of a plaintext password for every configured digest realm.
+// It returns nil when no realm is configured.
+func (h *HTTPHandlers) digestHA1(username string, password string) map[string]string {
+	if len(h.UserDB.Cfg.DigestRealms) == 0 {
+		return nil
+	}
+	ha1 := make(map[string]string, len(h.UserDB.Cfg.DigestRealms))
+	for _, realm := range h.UserDB.Cfg.DigestRealms {
+		ha1[realm] = hash.DigestHA1(username, realm, password)
+	}
+	return ha1
+}
+
+// DeleteUser remove user record. It replies 204, or 404 if the user doesn't exist.
 func (h *HTTPHandlers) DeleteUser(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Access-Control-Allow-Origin", h.UserDB.Cfg.CorsOrigin)
 	if r.Method == http.MethodOptions {
@@ -214,13 +695,15 @@ func (h *HTTPHandlers) DeleteUser(w http.ResponseWriter, r *http.Request) {
 	path := strings.Split(r.URL.Path, "/")
 	user := path[len(path)-1]
 	err := h.UserDB.DeleteRecord(user)
-	if err != nil {
+	if errors.Is(err, db.ErrUserNotFound) {
 		http.Error(w, "user not found", http.StatusNotFound)
 		return
 	}
-	w.WriteHeader(200)
-	_, err = w.Write([]byte("{ \"msg\": \"Deleted user record, username=" + user + "\" }\n"))
 	if err != nil {
 		log.Err(err)
+		http.Error(w, "failed processing request", http.StatusInternalServerError)
+		return
 	}
+	log.Debug().Str("username", user).Msg("deleted user record")
+	w.WriteHeader(http.StatusNoContent)
 }
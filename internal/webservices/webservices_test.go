@@ -0,0 +1,291 @@
+//
+// webservices_test.go
+// Copyright (C) 2024 rmelo <Ricardo Melo <rmelo@ludia.com>>
+//
+// Distributed under terms of the MIT license.
+//
+
+package webservices
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+
+	"github.com/cropalato/squid-vault-auth/internal/db"
+)
+
+func listUsers(t *testing.T, r http.Handler, query url.Values) (int, UserList, string) {
+	t.Helper()
+	req := httptest.NewRequest(http.MethodGet, "/api/v1/users?"+query.Encode(), nil)
+	req.SetBasicAuth(testAdmin, testPass)
+	rec := httptest.NewRecorder()
+	r.ServeHTTP(rec, req)
+	var list UserList
+	if rec.Code == http.StatusOK {
+		if err := json.Unmarshal(rec.Body.Bytes(), &list); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return rec.Code, list, rec.Body.String()
+}
+
+func usernames(users []db.UserRecord) string {
+	var names []string
+	for _, u := range users {
+		names = append(names, u.Username)
+	}
+	return strings.Join(names, ",")
+}
+
+func TestListUsers(t *testing.T) {
+	h := newTestHandlers(t)
+	r := NewRouter(h)
+	now := time.Now()
+	for _, u := range []db.UserRecord{
+		{Username: "v_alice", Groups: []string{"dev"}, ExpDate: now.Add(2 * time.Hour).Unix()},
+		{Username: "v_bob", Groups: []string{"dev", "ops"}, ExpDate: now.Add(time.Hour).Unix()},
+		{Username: "carol", Groups: []string{"ops"}},
+		{Username: "v_dave", Groups: []string{"dev"}, ExpDate: now.Add(-time.Hour).Unix()},
+		{Username: "erin", Groups: []string{"ops"}, Disabled: true},
+	} {
+		u.Password = "$2a$04$hash"
+		u.HA1 = map[string]string{"proxy": "ha1"}
+		if err := h.UserDB.AddRecord(u); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, tc := range []struct {
+		name  string
+		query url.Values
+		want  string
+	}{
+		{"all", url.Values{}, "carol,erin,v_alice,v_bob,v_dave"},
+		{"group", url.Values{"group": {"dev"}}, "v_alice,v_bob,v_dave"},
+		{"prefix", url.Values{"prefix": {"v_"}}, "v_alice,v_bob,v_dave"},
+		{"active", url.Values{"state": {"active"}}, "carol,v_alice,v_bob"},
+		{"expired", url.Values{"state": {"expired"}}, "v_dave"},
+		{"disabled", url.Values{"state": {"disabled"}}, "erin"},
+		{"expiry range", url.Values{"expires_after": {now.Format(time.RFC3339)}, "expires_before": {now.Add(90 * time.Minute).Format(time.RFC3339)}}, "v_bob"},
+		{"sort by expiry", url.Values{"sort": {"exp_date"}}, "v_dave,v_bob,v_alice,carol,erin"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			status, list, body := listUsers(t, r, tc.query)
+			if status != http.StatusOK {
+				t.Fatalf("expected %d, got %d: %s", http.StatusOK, status, body)
+			}
+			if got := usernames(list.Users); got != tc.want {
+				t.Fatalf("expected %s, got %s", tc.want, got)
+			}
+			if strings.Contains(body, "$2a$") || strings.Contains(body, "ha1") {
+				t.Fatalf("password hashes must never be listed: %s", body)
+			}
+		})
+	}
+
+	t.Run("pagination", func(t *testing.T) {
+		var got []db.UserRecord
+		query := url.Values{"sort": {"exp_date"}, "limit": {"2"}}
+		for pages := 0; pages < 10; pages++ {
+			status, list, body := listUsers(t, r, query)
+			if status != http.StatusOK {
+				t.Fatalf("expected %d, got %d: %s", http.StatusOK, status, body)
+			}
+			got = append(got, list.Users...)
+			if list.Next == "" {
+				break
+			}
+			query.Set("cursor", list.Next)
+		}
+		if want := "v_dave,v_bob,v_alice,carol,erin"; usernames(got) != want {
+			t.Fatalf("expected %s, got %s", want, usernames(got))
+		}
+	})
+
+	for _, query := range []url.Values{
+		{"limit": {"0"}},
+		{"state": {"gone"}},
+		{"sort": {"password"}},
+		{"cursor": {"garbage"}},
+		{"expires_after": {"tomorrow"}},
+	} {
+		if status, _, _ := listUsers(t, r, query); status != http.StatusBadRequest {
+			t.Errorf("%s: expected %d, got %d", query.Encode(), http.StatusBadRequest, status)
+		}
+	}
+}
+
+func send(t *testing.T, r http.Handler, method string, path string, body string) *httptest.ResponseRecorder {
+	t.Helper()
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	req.SetBasicAuth(testAdmin, testPass)
+	rec := httptest.NewRecorder()
+	r.ServeHTTP(rec, req)
+	return rec
+}
+
+func TestUserLifecycle(t *testing.T) {
+	h := newTestHandlers(t)
+	r := NewRouter(h)
+	exp := time.Now().Add(time.Hour).Unix()
+
+	for _, tc := range []struct {
+		name   string
+		method string
+		path   string
+		body   string
+		want   int
+	}{
+		{"create", http.MethodPut, "/api/v1/users", `{"username": "bob", "password": "pass", "groups": ["g1"]}`, http.StatusCreated},
+		{"create existing", http.MethodPut, "/api/v1/users", `{"username": "bob", "password": "pass"}`, http.StatusConflict},
+		{"create without password", http.MethodPut, "/api/v1/users", `{"username": "alice"}`, http.StatusBadRequest},
+		{"upsert new", http.MethodPut, "/api/v1/users/alice", `{"password": "pass", "groups": ["g1"]}`, http.StatusCreated},
+		{"upsert existing", http.MethodPut, "/api/v1/users/alice", `{"password": "pass", "groups": ["g2"], "exp_date": ` + strconv.FormatInt(exp, 10) + `}`, http.StatusOK},
+		{"upsert other username", http.MethodPut, "/api/v1/users/alice", `{"username": "bob", "password": "pass"}`, http.StatusBadRequest},
+		{"patch unknown", http.MethodPatch, "/api/v1/users/carol", `{"disabled": true}`, http.StatusNotFound},
+		{"patch empty password", http.MethodPatch, "/api/v1/users/alice", `{"password": ""}`, http.StatusBadRequest},
+		{"patch null password", http.MethodPatch, "/api/v1/users/alice", `{"password": null}`, http.StatusBadRequest},
+		{"patch not an object", http.MethodPatch, "/api/v1/users/alice", `[]`, http.StatusBadRequest},
+		{"patch disabled", http.MethodPatch, "/api/v1/users/bob", `{"disabled": true}`, http.StatusOK},
+		{"delete", http.MethodDelete, "/api/v1/users/bob", "", http.StatusNoContent},
+		{"delete unknown", http.MethodDelete, "/api/v1/users/bob", "", http.StatusNotFound},
+	} {
+		rec := send(t, r, tc.method, tc.path, tc.body)
+		if rec.Code != tc.want {
+			t.Fatalf("%s: expected %d, got %d: %s", tc.name, tc.want, rec.Code, rec.Body.String())
+		}
+	}
+
+	u, err := h.UserDB.LookupRecord("alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(u.Groups, ",") != "g2" || u.ExpDate != exp {
+		t.Fatalf("upsert didn't replace the record: %+v", u)
+	}
+	password := u.Password
+
+	// null resets a field, absent fields are kept.
+	rec := send(t, r, http.MethodPatch, "/api/v1/users/alice", `{"groups": null, "exp_date": null}`)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected %d, got %d: %s", http.StatusOK, rec.Code, rec.Body.String())
+	}
+	u, err = h.UserDB.LookupRecord("alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(u.Groups) != 0 || u.Groups == nil || u.ExpDate != 0 || u.Password != password {
+		t.Fatalf("unexpected record after merge patch: %+v", u)
+	}
+}
+
+func TestVerify(t *testing.T) {
+	h := newTestHandlers(t)
+	r := NewRouter(h)
+	secret, err := bcrypt.GenerateFromPassword([]byte("pass"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	for _, u := range []db.UserRecord{
+		{Username: "alice", Password: string(secret), Groups: []string{"g1", "g2"}},
+		{Username: "bob", Password: string(secret), ExpDate: now.Add(-time.Minute).Unix()},
+		{Username: "dave", Password: string(secret), ExpDate: now.Add(time.Hour).Unix()},
+		{Username: "carol", Password: string(secret), Disabled: true},
+	} {
+		if err := h.UserDB.AddRecord(u); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, tc := range []struct {
+		name     string
+		username string
+		password string
+		result   string
+		reason   string
+		groups   string
+	}{
+		{"allow", "alice", "pass", VerifyAllow, db.ReasonOK, "g1,g2"},
+		{"wrong password", "alice", "wrong", VerifyDeny, db.ReasonInvalidPassword, ""},
+		{"unknown user", "nobody", "pass", VerifyDeny, db.ReasonUnknownUser, ""},
+		{"expired", "bob", "pass", VerifyDeny, db.ReasonExpired, ""},
+		{"expired wrong password", "bob", "wrong", VerifyDeny, db.ReasonInvalidPassword, ""},
+		{"disabled", "carol", "pass", VerifyDeny, db.ReasonDisabled, ""},
+	} {
+		body, err := json.Marshal(VerifyRequest{Username: tc.username, Password: tc.password})
+		if err != nil {
+			t.Fatal(err)
+		}
+		rec := send(t, r, http.MethodPost, "/api/v1/verify", string(body))
+		if rec.Code != http.StatusOK {
+			t.Fatalf("%s: expected 200, got %d: %s", tc.name, rec.Code, rec.Body.String())
+		}
+		var resp VerifyResponse
+		if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+			t.Fatal(err)
+		}
+		if resp.Result != tc.result || resp.Reason != tc.reason || strings.Join(resp.Groups, ",") != tc.groups || resp.ExpiresAt != 0 {
+			t.Errorf("%s: expected %s/%s/%s, got %+v", tc.name, tc.result, tc.reason, tc.groups, resp)
+		}
+	}
+
+	// helpers don't cache an allowed credential past its expiration date.
+	rec := send(t, r, http.MethodPost, "/api/v1/verify", `{"username": "dave", "password": "pass"}`)
+	var resp VerifyResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+	if resp.Result != VerifyAllow || resp.ExpiresAt != now.Add(time.Hour).Unix() {
+		t.Fatalf("expected expires_at to be returned, got %+v", resp)
+	}
+}
+
+func TestRotateAdmin(t *testing.T) {
+	h := newTestHandlers(t)
+	r := NewRouter(h)
+	if rec := send(t, r, http.MethodPut, "/api/v1/admin/credentials", `{"password": ""}`); rec.Code != http.StatusBadRequest {
+		t.Fatalf("expected an empty password to be refused, got %d", rec.Code)
+	}
+	if rec := send(t, r, http.MethodPut, "/api/v1/admin/credentials", `{"password": "rotated"}`); rec.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", rec.Code, rec.Body.String())
+	}
+	for _, tc := range []struct {
+		password string
+		want     int
+	}{
+		{testPass, http.StatusUnauthorized},
+		{"rotated", http.StatusNotFound},
+	} {
+		req := httptest.NewRequest(http.MethodGet, "/api/v1/users/nobody", nil)
+		req.SetBasicAuth(testAdmin, tc.password)
+		rec := httptest.NewRecorder()
+		r.ServeHTTP(rec, req)
+		if rec.Code != tc.want {
+			t.Fatalf("password %s: expected %d, got %d", tc.password, tc.want, rec.Code)
+		}
+	}
+	// the rotated credential is kept across restarts.
+	if err := h.UserDB.Close(); err != nil {
+		t.Fatal(err)
+	}
+	h, err := NewHandlers(h.UserDB.Cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.UserDB.Close()
+	if _, err := h.Admin.Validate(testAdmin, testPass); err == nil {
+		t.Fatal("the old password must be refused after a restart")
+	}
+	if _, err := h.Admin.Validate(testAdmin, "rotated"); err != nil {
+		t.Fatalf("expected the rotated password after a restart, got %v", err)
+	}
+}